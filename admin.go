@@ -0,0 +1,283 @@
+package codenames
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminGame summarizes a game for the admin game listing.
+type adminGame struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Round       int       `json:"round"`
+	Revealed    int       `json:"revealed"`
+	WinningTeam *Team     `json:"winning_team,omitempty"`
+}
+
+func summarizeGame(g *Game) adminGame {
+	ag := adminGame{
+		ID:          g.ID,
+		CreatedAt:   g.CreatedAt,
+		UpdatedAt:   g.UpdatedAt,
+		Round:       g.Round,
+		WinningTeam: g.WinningTeam,
+	}
+	for _, r := range g.Revealed {
+		if r {
+			ag.Revealed++
+		}
+	}
+	return ag
+}
+
+// bearerAuth requires requests to carry the given token in an
+// `Authorization: Bearer` header.
+func bearerAuth(handler http.Handler, token string) http.Handler {
+	want := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// handleAdmin routes the admin API:
+//
+//	GET    /admin/games              list games
+//	GET    /admin/games/<id>         fetch a game, including its layout
+//	DELETE /admin/games/<id>         delete a game from memory and the store
+//	POST   /admin/games/<id>/end     end a game, declaring a winner
+//	POST   /admin/games/<id>/reset   replace a game with a new one
+//	POST   /admin/broadcast          post a notice to the chat of every game in memory
+func (s *Server) handleAdmin(rw http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/admin")
+	switch {
+	case path == "/games" && req.Method == "GET":
+		s.handleAdminListGames(rw, req)
+	case path == "/broadcast" && req.Method == "POST":
+		s.handleAdminBroadcast(rw, req)
+	case strings.HasPrefix(path, "/games/"):
+		id := strings.TrimPrefix(path, "/games/")
+		var action string
+		if req.Method == "POST" {
+			i := strings.LastIndex(id, "/")
+			if i < 0 {
+				http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			id, action = id[:i], id[i+1:]
+		}
+		s.handleAdminGame(rw, req, id, action)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// handles returns the handles of the games held in memory. It
+// doesn't hold s.mu while the caller waits on each game's lock.
+func (s *Server) handles() []*GameHandle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	handles := make([]*GameHandle, 0, len(s.games))
+	for _, gh := range s.games {
+		handles = append(handles, gh)
+	}
+	return handles
+}
+
+// GET /admin/games?status=active|finished&idle=<duration>
+func (s *Server) handleAdminListGames(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	status := q.Get("status")
+	if status != "" && status != "active" && status != "finished" {
+		http.Error(rw, "status must be active or finished", 400)
+		return
+	}
+	var idle time.Duration
+	if v := q.Get("idle"); v != "" {
+		var err error
+		idle, err = time.ParseDuration(v)
+		if err != nil {
+			http.Error(rw, "Invalid idle duration", 400)
+			return
+		}
+	}
+
+	// Games in memory may be more up to date than their stored
+	// copies, so they take precedence.
+	byID := make(map[string]adminGame)
+	for _, gh := range s.handles() {
+		gh.mu.Lock()
+		byID[gh.g.ID] = summarizeGame(gh.g)
+		gh.mu.Unlock()
+	}
+	var cursor string
+	for {
+		page, next, err := s.store.List(cursor, 100)
+		if err != nil {
+			logger(req).Error("unable to list games in the store", "err", err)
+			http.Error(rw, "Unable to list games", 500)
+			return
+		}
+		for _, g := range page {
+			if _, ok := byID[g.ID]; !ok {
+				byID[g.ID] = summarizeGame(g)
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	now := time.Now()
+	games := []adminGame{}
+	for _, ag := range byID {
+		finished := ag.WinningTeam != nil
+		if (status == "active" && finished) || (status == "finished" && !finished) {
+			continue
+		}
+		if idle > 0 && now.Sub(ag.UpdatedAt) < idle {
+			continue
+		}
+		games = append(games, ag)
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].UpdatedAt.After(games[j].UpdatedAt)
+	})
+	writeJSON(rw, games)
+}
+
+func (s *Server) handleAdminGame(rw http.ResponseWriter, req *http.Request, id, action string) {
+	log := gameLogger(req, id)
+
+	gh, err := s.lookup(log, id, nil)
+	if errors.Is(err, ErrGameNotFound) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		loadError(rw, log, err)
+		return
+	}
+
+	switch {
+	case req.Method == "GET":
+		writeGame(rw, gh)
+
+	case req.Method == "DELETE":
+		s.mu.Lock()
+		if s.games[id] != gh {
+			// The game was replaced or deleted concurrently.
+			s.mu.Unlock()
+			http.NotFound(rw, req)
+			return
+		}
+		s.removeLocked(id)
+		close(gh.replaced)
+		s.mu.Unlock()
+
+		gh.mu.Lock()
+		err := s.store.Delete(gh.g)
+		gh.mu.Unlock()
+		if err != nil {
+			log.Error("unable to delete game from the store", "err", err)
+			http.Error(rw, "Unable to delete game from the store", 500)
+			return
+		}
+		log.Info("admin deleted game")
+		rw.WriteHeader(http.StatusNoContent)
+
+	case action == "end":
+		var body struct {
+			WinningTeam Team `json:"winning_team"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(rw, "Error decoding", 400)
+			return
+		}
+		if body.WinningTeam != Red && body.WinningTeam != Blue {
+			http.Error(rw, "winning_team must be red or blue", 400)
+			return
+		}
+		var ended bool
+		gh.update(log, func(g *Game) bool {
+			ended = g.End(body.WinningTeam)
+			return ended
+		})
+		if !ended {
+			http.Error(rw, "Game has already ended", http.StatusConflict)
+			return
+		}
+		log.Info("admin ended game", "winning_team", body.WinningTeam)
+		writeGame(rw, gh)
+
+	case action == "reset":
+		s.mu.Lock()
+		if s.games[id] != gh {
+			s.mu.Unlock()
+			http.NotFound(rw, req)
+			return
+		}
+		gh.mu.Lock()
+		opts := gh.g.GameOptions
+		gh.mu.Unlock()
+		gh = s.nextGameLocked(log, gh, opts)
+		s.mu.Unlock()
+		log.Info("admin reset game")
+		writeGame(rw, gh)
+
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// POST /admin/broadcast
+//
+// Only games held in memory receive the notice: the others haven't
+// been played recently.
+func (s *Server) handleAdminBroadcast(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(rw, "Error decoding", 400)
+		return
+	}
+	// Validate the notice up front, rather than once per game.
+	if err := new(Game).Notice(body.Text); err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+
+	handles := s.handles()
+
+	// Post the notice to every game before waiting for any of the
+	// saves, so that stores that commit saves in groups write them
+	// together. Posting the notice counts as an update, so it wakes
+	// long-polling clients.
+	log := logger(req)
+	waits := make([]func(), len(handles))
+	for i, gh := range handles {
+		waits[i] = gh.updateAsync(log, func(g *Game) bool {
+			return g.Notice(body.Text) == nil
+		})
+	}
+	for _, wait := range waits {
+		wait()
+	}
+	log.Info("admin broadcast notice", "games", len(handles))
+	writeJSON(rw, struct {
+		Games int `json:"games"`
+	}{len(handles)})
+}
@@ -0,0 +1,147 @@
+package codenames
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, s *Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	bearerAuth(http.HandlerFunc(s.handleAdmin), "secret").ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	s := newTestServer()
+	h := bearerAuth(http.HandlerFunc(s.handleAdmin), "secret")
+	for _, auth := range []string{"", "Bearer wrong", "Basic c2VjcmV0"} {
+		req := httptest.NewRequest("GET", "/admin/games", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got status %d, want %d", auth, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminListGames(t *testing.T) {
+	s := newTestServer()
+	mustGetGame(t, s, "active")
+	old := mustGetGame(t, s, "old")
+	old.g.UpdatedAt = time.Now().Add(-3 * time.Hour)
+	finished := mustGetGame(t, s, "finished")
+	finished.g.End(Red)
+
+	testCases := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"finished", "active", "old"}},
+		{"?status=active", []string{"active", "old"}},
+		{"?status=finished", []string{"finished"}},
+		{"?idle=2h", []string{"old"}},
+	}
+	for _, tc := range testCases {
+		rec := adminRequest(t, s, "GET", "/admin/games"+tc.query, "")
+		var games []adminGame
+		if err := json.Unmarshal(rec.Body.Bytes(), &games); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		var got []string
+		for _, g := range games {
+			got = append(got, g.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%q: got games %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestAdminManageGame(t *testing.T) {
+	s := newTestServer()
+	gh := mustGetGame(t, s, "foo")
+
+	rec := adminRequest(t, s, "GET", "/admin/games/foo", "")
+	var g Game
+	if err := json.Unmarshal(rec.Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Layout) != wordsPerGame {
+		t.Errorf("got layout of %d cards, want %d", len(g.Layout), wordsPerGame)
+	}
+
+	rec = adminRequest(t, s, "POST", "/admin/games/foo/end", `{"winning_team": "blue"}`)
+	if rec.Code != http.StatusOK || gh.g.WinningTeam == nil || *gh.g.WinningTeam != Blue {
+		t.Fatalf("got status %d after ending game, winner %v", rec.Code, gh.g.WinningTeam)
+	}
+	if v := gh.g.viewAt(time.Now()); v.WinningTeam == nil || *v.WinningTeam != Blue {
+		t.Errorf("replayed game has winner %v, want blue", v.WinningTeam)
+	}
+	if rec = adminRequest(t, s, "POST", "/admin/games/foo/end", `{"winning_team": "red"}`); rec.Code != http.StatusConflict {
+		t.Errorf("got status %d ending a finished game, want %d", rec.Code, http.StatusConflict)
+	}
+
+	rec = adminRequest(t, s, "POST", "/admin/games/foo/reset", "")
+	if rec.Code != http.StatusOK || s.games["foo"] == gh || s.games["foo"].g.WinningTeam != nil {
+		t.Fatalf("got status %d, game wasn't reset", rec.Code)
+	}
+	select {
+	case <-gh.replaced:
+	default:
+		t.Error("reset didn't signal that the game was replaced")
+	}
+
+	rec = adminRequest(t, s, "DELETE", "/admin/games/foo", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d deleting game", rec.Code)
+	}
+	if _, ok := s.games["foo"]; ok {
+		t.Error("game wasn't deleted from memory")
+	}
+	if rec = adminRequest(t, s, "GET", "/admin/games/foo", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d fetching deleted game, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminBroadcast(t *testing.T) {
+	s := newTestServer()
+	for _, id := range []string{"foo", "bar"} {
+		mustGetGame(t, s, id)
+	}
+	if rec := adminRequest(t, s, "POST", "/admin/broadcast", `{"text": "  "}`); rec.Code != 400 {
+		t.Errorf("got status %d broadcasting an empty notice, want 400", rec.Code)
+	}
+	before := make(map[string]Game)
+	for id, gh := range s.games {
+		before[id] = *gh.g
+	}
+	rec := adminRequest(t, s, "POST", "/admin/broadcast", `{"text": "Restarting in 5 minutes"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	for id, gh := range s.games {
+		msgs := gh.g.Messages
+		if len(msgs) == 0 || msgs[len(msgs)-1].Text != "Restarting in 5 minutes" || !msgs[len(msgs)-1].System() {
+			t.Errorf("%s: notice wasn't posted, got messages %+v", id, msgs)
+		}
+		// The notice reaches long-polling clients, but doesn't keep
+		// the game from expiring.
+		old := before[id]
+		if !gh.g.UpdatedAt.Equal(old.UpdatedAt) {
+			t.Errorf("%s: notice changed UpdatedAt from %s to %s", id, old.UpdatedAt, gh.g.UpdatedAt)
+		}
+		if gh.g.StateID() == old.StateID() {
+			t.Errorf("%s: notice didn't change the state ID", id)
+		}
+	}
+}
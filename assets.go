@@ -0,0 +1,140 @@
+package codenames
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// embedded holds the word lists and the built frontend. Run
+// frontend/build.sh before building the server to embed an
+// up-to-date frontend.
+//
+//go:embed assets/*.txt frontend/dist
+var embedded embed.FS
+
+// immutableCacheControl is sent with static files requested by
+// their content-hashed names, which never change.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// assets provides the word lists and static files served by the
+// server, either from the binary or, during development, from a
+// directory on disk laid out like the repository.
+type assets struct {
+	fsys   fs.FS
+	static fs.FS
+	dev    bool
+
+	hashed   map[string]string // static file name -> hashed name
+	unhashed map[string]string // hashed name -> static file name
+}
+
+// loadAssets loads the embedded assets, or those under dir if it's
+// not empty.
+func loadAssets(dir string) (*assets, error) {
+	if dir != "" {
+		return newAssets(os.DirFS(dir), true)
+	}
+	return newAssets(embedded, false)
+}
+
+func newAssets(fsys fs.FS, dev bool) (*assets, error) {
+	static, err := fs.Sub(fsys, "frontend/dist")
+	if err != nil {
+		return nil, err
+	}
+	a := &assets{
+		fsys:     fsys,
+		static:   static,
+		dev:      dev,
+		hashed:   make(map[string]string),
+		unhashed: make(map[string]string),
+	}
+	if dev {
+		// Files may change while the server is running, so
+		// they're served by name and never cached.
+		return a, nil
+	}
+	err = fs.WalkDir(static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(static, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		h := hashedName(name, hex.EncodeToString(sum[:4]))
+		a.hashed[name] = h
+		a.unhashed[h] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("hashing static files: %w", err)
+	}
+	return a, nil
+}
+
+// hashedName inserts hash before name's extension, turning
+// "app.js" into "app.<hash>.js".
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// words reads a word list with one word per line.
+func (a *assets) words(name string) ([]string, error) {
+	b, err := fs.ReadFile(a.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if w := strings.TrimSpace(sc.Text()); w != "" {
+			words = append(words, w)
+		}
+	}
+	return words, sc.Err()
+}
+
+// url returns the URL of the named static file, using its hashed
+// name if there is one.
+func (a *assets) url(name string) string {
+	if h, ok := a.hashed[name]; ok {
+		name = h
+	}
+	return "/static/" + name
+}
+
+// ServeHTTP serves static files under /static/. Files requested by
+// their hashed names may be cached forever; anything else must be
+// revalidated.
+func (a *assets) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/static/")
+	cacheControl := "no-cache"
+	if n, ok := a.unhashed[name]; ok {
+		name = n
+		cacheControl = immutableCacheControl
+	}
+	if !fs.ValidPath(name) {
+		http.NotFound(rw, req)
+		return
+	}
+	b, err := fs.ReadFile(a.static, name)
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	rw.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(rw, req, name, time.Time{}, bytes.NewReader(b))
+}
@@ -0,0 +1,91 @@
+package codenames
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAssetsStatic(t *testing.T) {
+	fsys := fstest.MapFS{
+		"frontend/dist/app.js":   {Data: []byte("console.log('hi');")},
+		"frontend/dist/game.css": {Data: []byte("body {}")},
+	}
+	a, err := newAssets(fsys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := a.url("app.js")
+	if !strings.HasPrefix(u, "/static/app.") || !strings.HasSuffix(u, ".js") || u == "/static/app.js" {
+		t.Fatalf("url(app.js) = %q, want a content-hashed name", u)
+	}
+	if got := a.url("missing.js"); got != "/static/missing.js" {
+		t.Errorf("url(missing.js) = %q", got)
+	}
+
+	testCases := []struct {
+		path         string
+		status       int
+		cacheControl string
+	}{
+		{u, 200, immutableCacheControl},
+		{"/static/app.js", 200, "no-cache"},
+		{"/static/missing.js", 404, ""},
+		{"/static/../go.mod", 404, ""},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, rec.Code, tc.status)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("%s: got Cache-Control %q, want %q", tc.path, got, tc.cacheControl)
+		}
+	}
+
+	// Changing a file changes its hashed name.
+	fsys["frontend/dist/app.js"] = &fstest.MapFile{Data: []byte("console.log('bye');")}
+	b, err := newAssets(fsys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.url("app.js") == u {
+		t.Errorf("url(app.js) didn't change with the file's contents")
+	}
+}
+
+func TestAssetsDev(t *testing.T) {
+	fsys := fstest.MapFS{"frontend/dist/app.js": {Data: []byte("x")}}
+	a, err := newAssets(fsys, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.url("app.js"); got != "/static/app.js" {
+		t.Errorf("url(app.js) = %q in development, want the plain name", got)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest("GET", "/static/app.js", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("got status %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestEmbeddedWords(t *testing.T) {
+	a, err := loadAssets("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"assets/original.txt", "assets/game-id-words.txt"} {
+		words, err := a.words(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(words) < 25 {
+			t.Errorf("%s: got %d words", name, len(words))
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package codenames
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBackupPolicy is the backup policy suggested for servers
+// that take scheduled backups. A zero Interval in a Backups' Policy
+// is replaced with DefaultBackupPolicy's.
+var DefaultBackupPolicy = BackupPolicy{
+	Interval:   time.Hour,
+	KeepHourly: 24,
+	KeepDaily:  7,
+}
+
+// BackupPolicy decides how often backups are taken and which are
+// kept. The newest backup is always kept.
+type BackupPolicy struct {
+	// Interval is the time between backups.
+	Interval time.Duration
+	// KeepHourly is the number of hours, counting back from the
+	// newest backup, whose newest backup is kept.
+	KeepHourly int
+	// KeepDaily is the number of days, counting back from the
+	// newest backup, whose newest backup is kept.
+	KeepDaily int
+}
+
+// keep reports which backups to keep, given their times, newest
+// first.
+func (bp BackupPolicy) keep(times []time.Time) []bool {
+	keep := make([]bool, len(times))
+	if len(times) > 0 {
+		keep[0] = true
+	}
+	mark := func(n int, period func(time.Time) time.Time) {
+		var last time.Time
+		for i, t := range times {
+			p := period(t)
+			if i > 0 && p.Equal(last) {
+				continue
+			}
+			if n == 0 {
+				return
+			}
+			keep[i] = true
+			last = p
+			n--
+		}
+	}
+	mark(bp.KeepHourly, func(t time.Time) time.Time {
+		return t.UTC().Truncate(time.Hour)
+	})
+	mark(bp.KeepDaily, func(t time.Time) time.Time {
+		y, m, d := t.UTC().Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	})
+	return keep
+}
+
+// BackupManifestName is the name of the manifest in each backup's
+// directory.
+const BackupManifestName = "manifest.json"
+
+// BackupManifest describes a backup.
+type BackupManifest struct {
+	// Backend names the kind of store that the backup is of.
+	Backend       string       `json:"backend"`
+	CreatedAt     time.Time    `json:"created_at"`
+	SchemaVersion int          `json:"schema_version"`
+	Files         []BackupFile `json:"files"`
+}
+
+// BackupFile describes a file in a backup.
+type BackupFile struct {
+	Name   string `json:"name"` // slash-separated path relative to the backup
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // hex-encoded
+}
+
+// A backuper writes a consistent copy of a store into a new
+// directory.
+type backuper interface {
+	Backup(dir string) error
+}
+
+// Backups takes scheduled backups of a store. Each backup is a
+// directory in Dir named for the time it was taken, holding a copy
+// of the store and a manifest.
+type Backups struct {
+	Dir     string
+	Store   Store
+	Backend string // recorded in each manifest
+	Policy  BackupPolicy
+	Logger  *Logger
+}
+
+// backupPrefix and backupTimeFormat make up the names of backup
+// directories, which sort in the order they were taken.
+const (
+	backupPrefix     = "backup-"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// A Backup is a backup found in a backup directory.
+type Backup struct {
+	Path string
+	Time time.Time
+}
+
+// ListBackups returns the backups in dir, newest first.
+func ListBackups(dir string) ([]Backup, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []Backup
+	for _, info := range infos {
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), backupPrefix) {
+			continue
+		}
+		t, err := time.Parse(backupTimeFormat, strings.TrimPrefix(info.Name(), backupPrefix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{Path: filepath.Join(dir, info.Name()), Time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+	return backups, nil
+}
+
+// Run takes a backup every Policy.Interval until ctx is done. The
+// first is taken an interval after the newest existing backup.
+func (b *Backups) Run(ctx context.Context) {
+	interval := b.Policy.Interval
+	if interval == 0 {
+		interval = DefaultBackupPolicy.Interval
+	}
+	next := interval
+	if backups, err := ListBackups(b.Dir); err == nil && len(backups) > 0 {
+		next = time.Until(backups[0].Time.Add(interval))
+	}
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if path, err := b.Take(time.Now()); err != nil {
+			b.Logger.Error("unable to back up the store", "err", err)
+		} else {
+			b.Logger.Info("backed up the store", "path", path)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Take takes a backup, named for now, and deletes the backups the
+// policy no longer keeps. It returns the new backup's path.
+func (b *Backups) Take(now time.Time) (string, error) {
+	bk, ok := b.Store.(backuper)
+	if !ok {
+		return "", fmt.Errorf("store %T doesn't support backups", b.Store)
+	}
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return "", err
+	}
+	name := backupPrefix + now.UTC().Format(backupTimeFormat)
+	path := filepath.Join(b.Dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("backup %s already exists", name)
+	}
+
+	// The backup is written under a temporary name, so that an
+	// incomplete backup is never mistaken for a complete one.
+	tmp := filepath.Join(b.Dir, "."+name+".tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := bk.Backup(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	m := BackupManifest{Backend: b.Backend, CreatedAt: now.UTC(), SchemaVersion: SchemaVersion}
+	if err := writeBackupManifest(tmp, m); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return path, b.rotate()
+}
+
+// writeBackupManifest describes the files in dir in m, and writes
+// it to the dir's manifest.
+func writeBackupManifest(dir string, m BackupManifest) error {
+	files, err := CheckpointPrefixes(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		m.Files = append(m.Files, BackupFile{Name: f.Name, Size: f.Size, SHA256: f.SHA256})
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, BackupManifestName))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotate deletes the backups that the policy doesn't keep, and any
+// left incomplete by a crash.
+func (b *Backups) rotate() error {
+	backups, err := ListBackups(b.Dir)
+	if err != nil {
+		return err
+	}
+	times := make([]time.Time, len(backups))
+	for i, bk := range backups {
+		times[i] = bk.Time
+	}
+	keep := b.Policy.keep(times)
+	for i, bk := range backups {
+		if keep[i] {
+			continue
+		}
+		if err := os.RemoveAll(bk.Path); err != nil {
+			return err
+		}
+		b.Logger.Info("deleted old backup", "path", bk.Path)
+	}
+
+	tmps, err := filepath.Glob(filepath.Join(b.Dir, "."+backupPrefix+"*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		if err := os.RemoveAll(tmp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateBackup reads a backup's manifest and checks that the
+// backup holds exactly the files it lists, with the listed sizes
+// and checksums.
+func ValidateBackup(path string) (BackupManifest, error) {
+	var m BackupManifest
+	b, err := ioutil.ReadFile(filepath.Join(path, BackupManifestName))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("parsing %s: %w", BackupManifestName, err)
+	}
+	if m.SchemaVersion > SchemaVersion {
+		return m, fmt.Errorf("backup has schema version %d, newer than this server's %d", m.SchemaVersion, SchemaVersion)
+	}
+
+	files, err := CheckpointPrefixes(path)
+	if err != nil {
+		return m, err
+	}
+	found := make(map[string]CheckpointPrefix, len(files))
+	for _, f := range files {
+		if f.Name != BackupManifestName {
+			found[f.Name] = f
+		}
+	}
+	for _, want := range m.Files {
+		got, ok := found[want.Name]
+		if !ok {
+			return m, fmt.Errorf("%s is missing", want.Name)
+		}
+		if got.Size != want.Size || got.SHA256 != want.SHA256 {
+			return m, fmt.Errorf("%s has %d bytes with SHA-256 %s, manifest says %d bytes with SHA-256 %s",
+				want.Name, got.Size, got.SHA256, want.Size, want.SHA256)
+		}
+		delete(found, want.Name)
+	}
+	for name := range found {
+		return m, fmt.Errorf("%s isn't in the manifest", name)
+	}
+	return m, nil
+}
+
+// RestoreBackup validates a backup and copies the files of its
+// store into dir, verifying each copy. It returns the backup's
+// manifest.
+func RestoreBackup(path, dir string) (BackupManifest, error) {
+	m, err := ValidateBackup(path)
+	if err != nil {
+		return m, fmt.Errorf("invalid backup: %w", err)
+	}
+	for _, f := range m.Files {
+		if !localCheckpointName(f.Name) {
+			return m, fmt.Errorf("backup file name %q isn't a local path", f.Name)
+		}
+		name := filepath.FromSlash(f.Name)
+		if err := copyBackupFile(filepath.Join(path, name), filepath.Join(dir, name), f); err != nil {
+			return m, fmt.Errorf("restoring %s: %w", f.Name, err)
+		}
+	}
+	return m, nil
+}
+
+func copyBackupFile(src, dst string, want BackupFile) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); n != want.Size || got != want.SHA256 {
+		return fmt.Errorf("copied %d bytes with SHA-256 %s, manifest says %d bytes with SHA-256 %s",
+			n, got, want.Size, want.SHA256)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
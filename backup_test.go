@@ -0,0 +1,118 @@
+package codenames
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestBackupPolicyKeep(t *testing.T) {
+	// Backups every 30 minutes for three days, newest first.
+	newest := time.Date(2021, 3, 14, 15, 30, 0, 0, time.UTC)
+	var times []time.Time
+	for at := newest; !at.Before(newest.Add(-72 * time.Hour)); at = at.Add(-30 * time.Minute) {
+		times = append(times, at)
+	}
+
+	keep := BackupPolicy{KeepHourly: 3, KeepDaily: 3}.keep(times)
+	var kept []time.Time
+	for i, k := range keep {
+		if k {
+			kept = append(kept, times[i])
+		}
+	}
+	want := []time.Time{
+		newest,                 // the newest backup of the 15:00 hour and of the 14th
+		newest.Add(-time.Hour), // 14:30
+		newest.Add(-2 * time.Hour),
+		time.Date(2021, 3, 13, 23, 30, 0, 0, time.UTC), // the newest of the 13th
+		time.Date(2021, 3, 12, 23, 30, 0, 0, time.UTC),
+	}
+	if len(kept) != len(want) {
+		t.Fatalf("kept %v, want %v", kept, want)
+	}
+	for i := range want {
+		if !kept[i].Equal(want[i]) {
+			t.Errorf("kept %v, want %v", kept, want)
+			break
+		}
+	}
+
+	if keep := (BackupPolicy{}).keep(times[:2]); !keep[0] || keep[1] {
+		t.Errorf("a policy that keeps nothing kept %v", keep)
+	}
+}
+
+func TestBackups(t *testing.T) {
+	ps := openTestStore(t)
+	g := newGame("foo", randomState(words), GameOptions{})
+	if err := ps.Save(g); err != nil {
+		t.Fatal(err)
+	}
+
+	b := Backups{
+		Dir:     t.TempDir(),
+		Store:   ps,
+		Backend: "pebble",
+		Policy:  BackupPolicy{KeepHourly: 2},
+	}
+	start := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	var latest string
+	for i := 0; i < 3; i++ {
+		var err error
+		if latest, err = b.Take(start.Add(time.Duration(i) * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := ListBackups(b.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].Path != latest {
+		t.Fatalf("after rotation, backups are %+v", backups)
+	}
+
+	m, err := ValidateBackup(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Backend != "pebble" || m.SchemaVersion != SchemaVersion || len(m.Files) == 0 {
+		t.Errorf("manifest is %+v", m)
+	}
+
+	dir := filepath.Join(t.TempDir(), "restored")
+	if _, err := RestoreBackup(latest, dir); err != nil {
+		t.Fatal(err)
+	}
+	db, err := pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := (&PebbleStore{DB: db}).Get("foo"); err != nil {
+		t.Errorf("restored store: %v", err)
+	}
+
+	// Damaged backups are rejected.
+	extra := filepath.Join(latest, "extra")
+	if err := ioutil.WriteFile(extra, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateBackup(latest); err == nil {
+		t.Error("backup with an extra file is valid")
+	}
+	if err := os.Remove(extra); err != nil {
+		t.Fatal(err)
+	}
+	damaged := filepath.Join(latest, filepath.FromSlash(m.Files[0].Name))
+	if err := ioutil.WriteFile(damaged, []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreBackup(latest, t.TempDir()); err == nil {
+		t.Error("restoring a damaged backup succeeded")
+	}
+}
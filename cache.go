@@ -0,0 +1,142 @@
+package codenames
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// The server holds recently used games in memory, in s.games, and
+// evicts the least recently used ones beyond s.MaxGamesInMemory.
+// Evicted games are loaded from the store again when they're next
+// requested. Except for lookup, the methods below require s.mu to
+// be held.
+
+// gameLoad is a load of a game from the store. Lookups of the game
+// while it's in progress wait for it rather than loading the game
+// again.
+type gameLoad struct {
+	done chan struct{} // closed once gh and err are set
+	gh   *GameHandle
+	err  error
+}
+
+// lookup returns the handle of the game with the given ID, loading
+// it from the store if it isn't in memory. If there's no such game,
+// it creates one with create, or returns ErrGameNotFound if create
+// is nil. Any other error means the game may exist but couldn't be
+// loaded, so it mustn't be recreated.
+//
+// The store is read without s.mu held, so that a slow load doesn't
+// hold up requests for other games. s.mu must not be held.
+func (s *Server) lookup(log *Logger, id string, create func() *Game) (*GameHandle, error) {
+	for {
+		s.mu.Lock()
+		if gh, ok := s.games[id]; ok {
+			s.lru.MoveToFront(gh.elem)
+			s.mu.Unlock()
+			return gh, nil
+		}
+		if l, ok := s.loads[id]; ok {
+			s.mu.Unlock()
+			<-l.done
+			if errors.Is(l.err, ErrGameNotFound) && create != nil {
+				// The load didn't create the game; look again,
+				// creating it this time.
+				continue
+			}
+			return l.gh, l.err
+		}
+		if s.loads == nil {
+			s.loads = make(map[string]*gameLoad)
+		}
+		l := &gameLoad{done: make(chan struct{})}
+		s.loads[id] = l
+		s.mu.Unlock()
+
+		g, err := s.store.Get(id)
+		if err == nil {
+			s.internWordSet(g)
+		}
+
+		// Games are only added while their loads are in progress
+		// by the load itself, so there's still no handle for id.
+		s.mu.Lock()
+		delete(s.loads, id)
+		switch {
+		case err == nil:
+			atomic.AddInt64(&s.metrics.gamesLoaded, 1)
+			l.gh = loadedHandle(g, s.store)
+			s.addLocked(l.gh)
+		case errors.Is(err, ErrGameNotFound) && create != nil:
+			l.gh = newHandle(log, create(), s.store)
+			s.addLocked(l.gh)
+		default:
+			l.err = err
+		}
+		s.mu.Unlock()
+		close(l.done)
+		return l.gh, l.err
+	}
+}
+
+// addLocked adds a game's handle to memory, replacing any existing
+// handle for the same game, and evicts games if there are too many.
+// Games with saves that aren't durable yet are kept until they are,
+// since loading one again in the meantime would load a stale copy;
+// until then, there may be more than s.MaxGamesInMemory games.
+func (s *Server) addLocked(gh *GameHandle) {
+	id := gh.g.ID
+	if old, ok := s.games[id]; ok {
+		s.lru.Remove(old.elem)
+	}
+	s.games[id] = gh
+	gh.elem = s.lru.PushFront(gh)
+
+	for e := s.lru.Back(); e != gh.elem && s.lru.Len() > s.MaxGamesInMemory; {
+		evicted := e.Value.(*GameHandle)
+		e = e.Prev()
+		evicted.mu.Lock()
+		saving := evicted.saving > 0
+		evicted.mu.Unlock()
+		if saving {
+			continue
+		}
+		s.removeLocked(evicted.g.ID)
+		// Wake any long-polling requests, so that they load the
+		// game again rather than waiting on a stale handle.
+		close(evicted.replaced)
+		atomic.AddInt64(&s.metrics.gamesEvicted, 1)
+	}
+}
+
+// removeLocked forgets a game's handle. The game remains in the
+// store.
+func (s *Server) removeLocked(id string) {
+	gh, ok := s.games[id]
+	if !ok {
+		return
+	}
+	s.lru.Remove(gh.elem)
+	delete(s.games, id)
+}
+
+// internWordSet shares a loaded game's word set with the other
+// games using it. Games saved before games recorded their word
+// set's ID are given one, so that they're saved by reference from
+// then on.
+func (s *Server) internWordSet(g *Game) {
+	var id wordSetID
+	if g.WordSetID == "" {
+		var ok bool
+		if id, ok = identifyWordSet(g.WordSet); !ok {
+			return
+		}
+		g.WordSetID = id.String()
+	} else {
+		var err error
+		if id, err = parseWordSetID(g.WordSetID); err != nil {
+			return
+		}
+	}
+	g.WordSet = s.wordSets.Intern(id, g.WordSet)
+}
@@ -0,0 +1,218 @@
+package codenames
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// delayedStore is a store whose queued saves aren't committed until
+// release is closed.
+type delayedStore struct {
+	Store
+	queued  chan struct{} // receives a value for each queued save
+	release chan struct{}
+}
+
+func (ds delayedStore) SaveAsync(g *Game) func() error {
+	v, err := encodeGame(g)
+	if err != nil {
+		return func() error { return err }
+	}
+	ds.queued <- struct{}{}
+	return func() error {
+		<-ds.release
+		g, _, err := decodeGame(v)
+		if err != nil {
+			return err
+		}
+		return ds.Store.Save(g)
+	}
+}
+
+// unreadableStore is a store whose games can't be read.
+type unreadableStore struct {
+	Store
+}
+
+func (unreadableStore) Get(string) (*Game, error) {
+	return nil, errors.New("disk on fire")
+}
+
+func TestLoadErrorKeepsGame(t *testing.T) {
+	ms := new(MemoryStore)
+	stored := newGame("foo", randomState(testWords), GameOptions{})
+	if err := ms.Save(stored); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.store = unreadableStore{ms}
+
+	body := `{"game_id": "foo"}`
+	for path, h := range map[string]http.HandlerFunc{
+		"/game-state": s.handleGameState,
+		"/guess":      s.handleGuess,
+		"/end-turn":   s.handleEndTurn,
+		"/next-game":  s.handleNextGame,
+		"/chat":       s.handleChat,
+	} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusInternalServerError)
+		}
+	}
+	if len(s.games) != 0 {
+		t.Errorf("%d games were created", len(s.games))
+	}
+	if g, err := ms.Get("foo"); err != nil || g.StateID() != stored.StateID() {
+		t.Errorf("the stored game was replaced: %v", err)
+	}
+	if _, err := s.getAutogeneratedID(); err == nil {
+		t.Error("generated a game ID without checking that it's free")
+	}
+}
+
+// slowStore is a store whose reads of one game wait until release
+// is closed.
+type slowStore struct {
+	Store
+	id      string
+	gets    *int32
+	release chan struct{}
+}
+
+func (ss slowStore) Get(id string) (*Game, error) {
+	if id == ss.id {
+		atomic.AddInt32(ss.gets, 1)
+		<-ss.release
+	}
+	return ss.Store.Get(id)
+}
+
+func TestLoadOutsideLock(t *testing.T) {
+	ms := new(MemoryStore)
+	if err := ms.Save(newGame("slow", randomState(testWords), GameOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	ss := slowStore{Store: ms, id: "slow", gets: new(int32), release: make(chan struct{})}
+	s.store = ss
+	mustGetGame(t, s, "fast")
+
+	// Lookups of the slow game share a single load...
+	handles := make(chan *GameHandle, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			gh, err := s.lookup(nil, "slow", nil)
+			if err != nil {
+				t.Error(err)
+			}
+			handles <- gh
+		}()
+	}
+	for atomic.LoadInt32(ss.gets) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// ...which doesn't hold up other games.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mustGetGame(t, s, "fast")
+		if _, err := s.getAutogeneratedID(); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("loading one game blocked requests for others")
+	}
+
+	close(ss.release)
+	if a, b := <-handles, <-handles; a == nil || a != b {
+		t.Errorf("concurrent lookups returned handles %p and %p", a, b)
+	}
+	if n := atomic.LoadInt32(ss.gets); n != 1 {
+		t.Errorf("the game was read %d times, want 1", n)
+	}
+}
+
+func TestEvictAndReload(t *testing.T) {
+	s := newTestServer()
+	s.store = openTestStore(t)
+	s.MaxGamesInMemory = 2
+
+	foo := mustGetGame(t, s, "foo")
+	foo.update(nil, func(g *Game) bool { return g.Guess(0) == nil })
+	mustGetGame(t, s, "bar")
+	mustGetGame(t, s, "foo") // foo is now more recently used than bar
+	mustGetGame(t, s, "baz")
+
+	if _, ok := s.games["bar"]; ok {
+		t.Error("least recently used game wasn't evicted")
+	}
+	if len(s.games) != 2 || s.lru.Len() != 2 {
+		t.Errorf("got %d games and %d LRU entries in memory, want 2", len(s.games), s.lru.Len())
+	}
+
+	// Evicting foo wakes its long-polling requests.
+	mustGetGame(t, s, "bar")
+	select {
+	case <-foo.replaced:
+	default:
+		t.Fatal("evicted game's handle wasn't marked replaced")
+	}
+
+	// foo is loaded from the store with its state intact.
+	reloaded := mustGetGame(t, s, "foo")
+	if reloaded == foo {
+		t.Fatal("evicted handle was reused")
+	}
+	if !reloaded.g.Revealed[0] {
+		t.Error("reloaded game lost its guess")
+	}
+	if got := s.metrics.gamesLoaded; got != 2 {
+		t.Errorf("got %d games loaded, want 2 (bar and foo)", got)
+	}
+}
+
+func TestNoEvictionDuringCommit(t *testing.T) {
+	s := newTestServer()
+	ds := delayedStore{Store: new(MemoryStore), queued: make(chan struct{}, 1), release: make(chan struct{})}
+	s.store = ds
+	s.MaxGamesInMemory = 1
+
+	foo := mustGetGame(t, s, "foo")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		foo.update(nil, func(g *Game) bool { return g.Guess(0) == nil })
+	}()
+	<-ds.queued
+
+	// foo's guess isn't durable, so it stays in memory rather than
+	// being loaded again without the guess.
+	mustGetGame(t, s, "bar")
+	if got := mustGetGame(t, s, "foo"); got != foo {
+		t.Fatal("game was evicted with a save in flight")
+	}
+	if len(s.games) != 2 {
+		t.Errorf("got %d games in memory, want 2", len(s.games))
+	}
+
+	close(ds.release)
+	<-done
+	mustGetGame(t, s, "baz")
+	if _, ok := s.games["foo"]; ok {
+		t.Error("game wasn't evicted once its save was durable")
+	}
+	if reloaded := mustGetGame(t, s, "foo"); !reloaded.g.Revealed[0] {
+		t.Error("reloaded game lost its guess")
+	}
+}
@@ -0,0 +1,195 @@
+package codenames
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxChatMessages bounds the number of messages kept in each
+	// of a room's chat channels. Older messages are dropped.
+	maxChatMessages   = 100
+	maxChatTextLength = 500
+	maxChatAuthorLen  = 32
+)
+
+type Channel string
+
+const (
+	ChannelAll       Channel = ""
+	ChannelSpymaster Channel = "spymaster"
+)
+
+// Message is a single chat message. Messages without an
+// author are system messages generated by the server.
+type Message struct {
+	Author string    `json:"author,omitempty"`
+	Team   Team      `json:"team"`
+	Text   string    `json:"text"`
+	At     time.Time `json:"at"`
+}
+
+func (m Message) System() bool {
+	return m.Author == ""
+}
+
+// Chat holds a room's chat channels. It's embedded in Game so
+// that it's persisted and delivered alongside the game state,
+// and it's carried over from game to game within a room.
+type Chat struct {
+	Messages          []Message `json:"messages,omitempty"`
+	SpymasterMessages []Message `json:"spymaster_messages,omitempty"`
+}
+
+func (c *Chat) channel(ch Channel) (*[]Message, error) {
+	switch ch {
+	case ChannelAll:
+		return &c.Messages, nil
+	case ChannelSpymaster:
+		return &c.SpymasterMessages, nil
+	default:
+		return nil, fmt.Errorf("unknown channel %q", ch)
+	}
+}
+
+func (c *Chat) post(ch Channel, m Message) error {
+	msgs, err := c.channel(ch)
+	if err != nil {
+		return err
+	}
+	// Always copy, so that views of the game sharing the old
+	// backing array aren't affected.
+	n := len(*msgs) + 1
+	if n > maxChatMessages {
+		n = maxChatMessages
+	}
+	next := make([]Message, 0, n)
+	next = append(next, (*msgs)[len(*msgs)-(n-1):]...)
+	*msgs = append(next, m)
+	return nil
+}
+
+// before returns a copy of the chat containing only the
+// messages posted at or before t.
+func (c Chat) before(t time.Time) Chat {
+	filter := func(msgs []Message) []Message {
+		var out []Message
+		for _, m := range msgs {
+			if !m.At.After(t) {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+	return Chat{
+		Messages:          filter(c.Messages),
+		SpymasterMessages: filter(c.SpymasterMessages),
+	}
+}
+
+// Say posts a message from a player to one of the game's
+// chat channels.
+func (g *Game) Say(ch Channel, author string, team Team, text string) error {
+	author = strings.TrimSpace(author)
+	text = strings.TrimSpace(text)
+	if author == "" {
+		return errors.New("missing author")
+	}
+	if text == "" {
+		return errors.New("empty message")
+	}
+	if utf8.RuneCountInString(author) > maxChatAuthorLen {
+		return errors.New("author name is too long")
+	}
+	if utf8.RuneCountInString(text) > maxChatTextLength {
+		return errors.New("message is too long")
+	}
+
+	now := time.Now()
+	err := g.Chat.post(ch, Message{Author: author, Team: team, Text: text, At: now})
+	if err != nil {
+		return err
+	}
+	g.UpdatedAt = now
+	return nil
+}
+
+// Notice posts a system message from the server's operators to the
+// game's public channel. Unlike players' messages, it doesn't update
+// the game, so that it doesn't keep idle games from expiring.
+func (g *Game) Notice(text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errors.New("empty message")
+	}
+	if utf8.RuneCountInString(text) > maxChatTextLength {
+		return errors.New("message is too long")
+	}
+	return g.Chat.post(ChannelAll, Message{
+		Team: Neutral,
+		Text: text,
+		At:   time.Now(),
+	})
+}
+
+// announce posts a system message to the game's public channel.
+func (g *Game) announce(team Team, format string, args ...interface{}) {
+	g.Chat.post(ChannelAll, Message{
+		Team: team,
+		Text: fmt.Sprintf(format, args...),
+		At:   g.UpdatedAt,
+	})
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// POST /chat
+func (s *Server) handleChat(rw http.ResponseWriter, req *http.Request) {
+	var request struct {
+		GameID         string  `json:"game_id"`
+		Channel        Channel `json:"channel"`
+		Author         string  `json:"author"`
+		Team           Team    `json:"team"`
+		Text           string  `json:"text"`
+		SpectatorToken string  `json:"spectator_token"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, "Error decoding", 400)
+		return
+	}
+	if request.SpectatorToken != "" {
+		http.Error(rw, errReadOnly, 403)
+		return
+	}
+	if !s.allowGame(rw, request.GameID) {
+		return
+	}
+
+	log := gameLogger(req, request.GameID)
+	gh, err := s.getGame(log, request.GameID)
+	if err != nil {
+		loadError(rw, log, err)
+		return
+	}
+
+	gh.update(log, func(g *Game) bool {
+		err = g.Say(request.Channel, request.Author, request.Team, request.Text)
+		return err == nil
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	writeGame(rw, gh)
+}
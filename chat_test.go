@@ -0,0 +1,46 @@
+package codenames
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChatBounded(t *testing.T) {
+	g := newGame("foo", randomState(testWords), GameOptions{})
+	for i := 0; i < maxChatMessages+10; i++ {
+		if err := g.Say(ChannelAll, "alice", Red, fmt.Sprintf("message %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(g.Messages) != maxChatMessages {
+		t.Fatalf("len(Messages) = %d, want %d", len(g.Messages), maxChatMessages)
+	}
+	if got, want := g.Messages[0].Text, "message 10"; got != want {
+		t.Errorf("oldest message = %q, want %q", got, want)
+	}
+	if err := g.Say(Channel("bogus"), "alice", Red, "hi"); err == nil {
+		t.Error("expected error posting to unknown channel")
+	}
+	if err := g.Say(ChannelSpymaster, "bob", Blue, "psst"); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.SpymasterMessages) != 1 {
+		t.Errorf("len(SpymasterMessages) = %d, want 1", len(g.SpymasterMessages))
+	}
+}
+
+func TestChatAnnouncesGuesses(t *testing.T) {
+	g := newGame("foo", randomState(testWords), GameOptions{})
+	team := g.currentTeam()
+	if err := g.Guess(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Messages) == 0 {
+		t.Fatal("no system message for guess")
+	}
+	m := g.Messages[0]
+	if !m.System() || m.Team != team || !strings.Contains(m.Text, g.Words[3]) {
+		t.Errorf("unexpected system message %+v", m)
+	}
+}
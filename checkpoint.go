@@ -0,0 +1,436 @@
+package codenames
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A checkpoint is a gzipped stream of gob-encoded records: a
+// CheckpointManifest, followed by the chunks of each file it lists,
+// in order. Files are sent in chunks so that neither end holds a
+// whole file in memory, and each one is verified against the
+// manifest's SHA-256 once it's received.
+
+// checkpointChunkSize is the largest amount of file data sent in a
+// single CheckpointChunk.
+const checkpointChunkSize = 1 << 20
+
+// CheckpointManifest lists the files in a checkpoint.
+type CheckpointManifest struct {
+	Files []CheckpointManifestFile
+}
+
+// CheckpointManifestFile describes a file in a checkpoint.
+type CheckpointManifestFile struct {
+	Name   string // slash-separated path relative to the checkpoint
+	Size   int64
+	SHA256 string // hex-encoded digest of the whole file
+	// Offset is where the file's chunks start. The receiver already
+	// has the bytes before it, from an interrupted transfer.
+	Offset int64
+}
+
+// CheckpointChunk is a piece of a checkpoint file.
+type CheckpointChunk struct {
+	Name   string
+	Offset int64
+	Data   []byte
+}
+
+// CheckpointFile is a whole file read from a checkpoint.
+type CheckpointFile struct {
+	Name string
+	Data []byte
+}
+
+// CheckpointPrefix describes the start of a checkpoint file that a
+// receiver already has. If the file in a new checkpoint starts with
+// the same bytes, they aren't sent again.
+type CheckpointPrefix struct {
+	Name   string
+	Size   int64
+	SHA256 string // hex-encoded digest of the first Size bytes
+}
+
+// String formats the prefix as "name:size:sha256", the form
+// accepted by ParseCheckpointPrefix.
+func (p CheckpointPrefix) String() string {
+	return p.Name + ":" + strconv.FormatInt(p.Size, 10) + ":" + p.SHA256
+}
+
+// ParseCheckpointPrefix parses a prefix formatted by
+// CheckpointPrefix.String.
+func ParseCheckpointPrefix(s string) (CheckpointPrefix, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return CheckpointPrefix{}, fmt.Errorf("malformed checkpoint prefix %q", s)
+	}
+	j := strings.LastIndexByte(s[:i], ':')
+	if j <= 0 {
+		return CheckpointPrefix{}, fmt.Errorf("malformed checkpoint prefix %q", s)
+	}
+	size, err := strconv.ParseInt(s[j+1:i], 10, 64)
+	if err != nil || size < 0 {
+		return CheckpointPrefix{}, fmt.Errorf("malformed checkpoint prefix %q", s)
+	}
+	return CheckpointPrefix{Name: s[:j], Size: size, SHA256: s[i+1:]}, nil
+}
+
+// checkpointSource is a file to include in a checkpoint.
+type checkpointSource struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// dirCheckpointSources returns the files under dir.
+func dirCheckpointSources(dir string) ([]checkpointSource, error) {
+	var sources []checkpointSource
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, checkpointSource{
+			name: filepath.ToSlash(rel),
+			open: func() (io.ReadCloser, error) { return os.Open(p) },
+		})
+		return nil
+	})
+	return sources, err
+}
+
+// bytesCheckpointSource returns a file with the given contents.
+func bytesCheckpointSource(name string, b []byte) checkpointSource {
+	return checkpointSource{
+		name: name,
+		open: func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil },
+	}
+}
+
+// writeCheckpoint writes a checkpoint of the given files to w,
+// leaving out the prefixes the receiver already has. The files
+// mustn't change while it's written.
+func writeCheckpoint(w io.Writer, log *Logger, sources []checkpointSource, have []CheckpointPrefix) error {
+	haveByName := make(map[string]CheckpointPrefix, len(have))
+	for _, p := range have {
+		haveByName[p.Name] = p
+	}
+	var m CheckpointManifest
+	for _, src := range sources {
+		mf, err := hashCheckpointFile(src, haveByName[src.name])
+		if err != nil {
+			return fmt.Errorf("hashing %s: %w", src.name, err)
+		}
+		m.Files = append(m.Files, mf)
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	enc := gob.NewEncoder(gzipWriter)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	buf := make([]byte, checkpointChunkSize)
+	for i, src := range sources {
+		mf := m.Files[i]
+		log.Info("checkpoint sending file", "file", mf.Name, "bytes", mf.Size-mf.Offset, "resumed_at", mf.Offset)
+		if err := sendCheckpointFile(enc, src, mf, buf); err != nil {
+			return fmt.Errorf("sending %s: %w", mf.Name, err)
+		}
+	}
+	return gzipWriter.Close()
+}
+
+// hashCheckpointFile describes a file for a checkpoint's manifest.
+// If the file starts with have, its chunks start after it.
+func hashCheckpointFile(src checkpointSource, have CheckpointPrefix) (CheckpointManifestFile, error) {
+	mf := CheckpointManifestFile{Name: src.name}
+	f, err := src.open()
+	if err != nil {
+		return mf, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if have.Size > 0 {
+		n, err := io.CopyN(h, f, have.Size)
+		if err != nil && err != io.EOF {
+			return mf, err
+		}
+		mf.Size = n
+		if n == have.Size && hex.EncodeToString(h.Sum(nil)) == have.SHA256 {
+			mf.Offset = n
+		}
+	}
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return mf, err
+	}
+	mf.Size += n
+	mf.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return mf, nil
+}
+
+// sendCheckpointFile encodes the chunks of a file, starting at
+// mf.Offset.
+func sendCheckpointFile(enc *gob.Encoder, src checkpointSource, mf CheckpointManifestFile, buf []byte) error {
+	f, err := src.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(ioutil.Discard, f, mf.Offset); err != nil {
+		return err
+	}
+	for off := mf.Offset; off < mf.Size; {
+		n := int64(len(buf))
+		if rem := mf.Size - off; rem < n {
+			n = rem
+		}
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			return err
+		}
+		if err := enc.Encode(CheckpointChunk{Name: mf.Name, Offset: off, Data: buf[:n]}); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// checkpointReader decodes the records of a checkpoint.
+type checkpointReader struct {
+	dec      *gob.Decoder
+	manifest CheckpointManifest
+}
+
+func newCheckpointReader(r io.Reader) (*checkpointReader, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	cr := &checkpointReader{dec: gob.NewDecoder(gzr)}
+	if err := cr.dec.Decode(&cr.manifest); err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	for _, mf := range cr.manifest.Files {
+		if !localCheckpointName(mf.Name) {
+			return nil, fmt.Errorf("checkpoint file name %q isn't a local path", mf.Name)
+		}
+		if mf.Offset < 0 || mf.Offset > mf.Size {
+			return nil, fmt.Errorf("checkpoint file %s has offset %d, size %d", mf.Name, mf.Offset, mf.Size)
+		}
+	}
+	return cr, nil
+}
+
+// localCheckpointName reports whether a file name from a manifest
+// stays within the directory it's received into.
+func localCheckpointName(name string) bool {
+	return name != "" && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && !strings.Contains(name, `\`)
+}
+
+// readFile passes the chunks of the next file, mf, to write.
+func (cr *checkpointReader) readFile(mf CheckpointManifestFile, write func([]byte) error) error {
+	for off := mf.Offset; off < mf.Size; {
+		var c CheckpointChunk
+		if err := cr.dec.Decode(&c); err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		if c.Name != mf.Name || c.Offset != off || int64(len(c.Data)) > mf.Size-off {
+			return fmt.Errorf("unexpected chunk of %s at offset %d, size %d", c.Name, c.Offset, len(c.Data))
+		}
+		if err := write(c.Data); err != nil {
+			return err
+		}
+		off += int64(len(c.Data))
+	}
+	return nil
+}
+
+// end checks that the checkpoint has no more records.
+func (cr *checkpointReader) end() error {
+	var c CheckpointChunk
+	if err := cr.dec.Decode(&c); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("unexpected chunk of %s after the last file", c.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// ReadCheckpointFiles reads the whole of a checkpoint into memory,
+// verifying each file's checksum. It's meant for small checkpoints
+// that weren't resumed.
+func ReadCheckpointFiles(r io.Reader) ([]CheckpointFile, error) {
+	cr, err := newCheckpointReader(r)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]CheckpointFile, 0, len(cr.manifest.Files))
+	for _, mf := range cr.manifest.Files {
+		if mf.Offset != 0 {
+			return nil, fmt.Errorf("checkpoint file %s was resumed", mf.Name)
+		}
+		var buf bytes.Buffer
+		err := cr.readFile(mf, func(b []byte) error {
+			_, err := buf.Write(b)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", mf.Name, err)
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		if got := hex.EncodeToString(sum[:]); got != mf.SHA256 {
+			return nil, fmt.Errorf("%s: SHA-256 is %s, manifest says %s", mf.Name, got, mf.SHA256)
+		}
+		files = append(files, CheckpointFile{Name: mf.Name, Data: buf.Bytes()})
+	}
+	return files, cr.end()
+}
+
+// CheckpointPrefixes describes the files under dir, left by an
+// interrupted ReceiveCheckpoint, so that the checkpoint's sender
+// can resume them. It returns no prefixes if dir doesn't exist.
+func CheckpointPrefixes(dir string) ([]CheckpointPrefix, error) {
+	var prefixes []CheckpointPrefix
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, CheckpointPrefix{
+			Name:   filepath.ToSlash(rel),
+			Size:   n,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+		return nil
+	})
+	return prefixes, err
+}
+
+// ReceiveCheckpoint writes the files in a checkpoint under dir,
+// verifying each one against the manifest, and returns the
+// manifest. Files under dir that aren't in the checkpoint are
+// removed. If the transfer is interrupted, the data received so far
+// is left in dir: passing CheckpointPrefixes(dir) to the sender of
+// the next checkpoint resumes it.
+func ReceiveCheckpoint(r io.Reader, dir string, log *Logger) (CheckpointManifest, error) {
+	cr, err := newCheckpointReader(r)
+	if err != nil {
+		return CheckpointManifest{}, err
+	}
+	if err := removeStaleCheckpointFiles(dir, cr.manifest); err != nil {
+		return cr.manifest, err
+	}
+	for _, mf := range cr.manifest.Files {
+		if err := receiveCheckpointFile(cr, dir, mf); err != nil {
+			return cr.manifest, fmt.Errorf("receiving %s: %w", mf.Name, err)
+		}
+		log.Info("received checkpoint file", "file", mf.Name, "bytes", mf.Size-mf.Offset, "resumed_at", mf.Offset)
+	}
+	return cr.manifest, cr.end()
+}
+
+// removeStaleCheckpointFiles removes the files under dir that
+// aren't in m.
+func removeStaleCheckpointFiles(dir string, m CheckpointManifest) error {
+	want := make(map[string]bool, len(m.Files))
+	for _, mf := range m.Files {
+		want[mf.Name] = true
+	}
+	have, err := CheckpointPrefixes(dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range have {
+		if want[p.Name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(p.Name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveCheckpointFile writes the next file in a checkpoint under
+// dir, keeping the first mf.Offset bytes of the file already there.
+// A file that doesn't match the manifest's checksum is removed, so
+// that it's sent in full next time.
+func receiveCheckpointFile(cr *checkpointReader, dir string, mf CheckpointManifestFile) error {
+	p := filepath.Join(dir, filepath.FromSlash(mf.Name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(mf.Offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(mf.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	err = cr.readFile(mf, func(b []byte) error {
+		_, err := f.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); n != mf.Size || got != mf.SHA256 {
+		f.Close()
+		os.Remove(p)
+		return fmt.Errorf("received %d bytes with SHA-256 %s, manifest says %d bytes with SHA-256 %s",
+			n, got, mf.Size, mf.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package codenames
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointPrefixString(t *testing.T) {
+	p := CheckpointPrefix{Name: "a:b/000001.sst", Size: 42, SHA256: "abcdef"}
+	got, err := ParseCheckpointPrefix(p.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != p {
+		t.Errorf("parsed %+v, want %+v", got, p)
+	}
+	for _, s := range []string{"", "foo", "foo:1", ":1:abc", "foo:-1:abc", "foo:x:abc"} {
+		if _, err := ParseCheckpointPrefix(s); err == nil {
+			t.Errorf("parsing %q succeeded", s)
+		}
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	big := make([]byte, 5*checkpointChunkSize/2+17)
+	rand.New(rand.NewSource(1)).Read(big)
+	files := map[string][]byte{
+		"big":       big,
+		"empty":     nil,
+		"sub/small": []byte("small"),
+	}
+	sources := []checkpointSource{
+		bytesCheckpointSource("big", big),
+		bytesCheckpointSource("empty", nil),
+		bytesCheckpointSource("sub/small", files["sub/small"]),
+	}
+	var full bytes.Buffer
+	if err := writeCheckpoint(&full, nil, sources, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the transfer halfway through the big file.
+	dir := t.TempDir()
+	interrupted := bytes.NewReader(full.Bytes()[:full.Len()/2])
+	if _, err := ReceiveCheckpoint(interrupted, dir, nil); err == nil {
+		t.Fatal("receiving a truncated checkpoint succeeded")
+	}
+	have, err := CheckpointPrefixes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 1 || have[0].Name != "big" || have[0].Size == 0 {
+		t.Fatalf("interrupted transfer left %+v", have)
+	}
+	// A file that's no longer in the checkpoint is removed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "stale"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var resumed bytes.Buffer
+	if err := writeCheckpoint(&resumed, nil, sources, have); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Len() >= full.Len()*3/4 {
+		t.Errorf("resumed checkpoint is %d bytes, full one %d", resumed.Len(), full.Len())
+	}
+	m, err := ReceiveCheckpoint(&resumed, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Files[0].Offset != have[0].Size {
+		t.Errorf("big file resumed at %d, have %d bytes", m.Files[0].Offset, have[0].Size)
+	}
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: received %d bytes that don't match", name, len(got))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stale")); !os.IsNotExist(err) {
+		t.Errorf("stale file wasn't removed: %v", err)
+	}
+
+	// A prefix that doesn't match is sent again.
+	if err := ioutil.WriteFile(filepath.Join(dir, "big"), []byte("different"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if have, err = CheckpointPrefixes(dir); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := writeCheckpoint(&again, nil, sources, have); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = ReceiveCheckpoint(&again, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.Files[0].Offset != 0 || m.Files[2].Offset != m.Files[2].Size {
+		t.Errorf("resumed at offsets %d and %d", m.Files[0].Offset, m.Files[2].Offset)
+	}
+}
+
+func TestCheckpointChecksum(t *testing.T) {
+	// The file changes between being hashed and sent.
+	var opened int
+	changing := checkpointSource{
+		name: "changing",
+		open: func() (io.ReadCloser, error) {
+			opened++
+			return ioutil.NopCloser(bytes.NewReader([]byte{byte(opened)})), nil
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeCheckpoint(&buf, nil, []checkpointSource{changing}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCheckpointFiles(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("reading a corrupt checkpoint succeeded")
+	}
+	dir := t.TempDir()
+	if _, err := ReceiveCheckpoint(bytes.NewReader(buf.Bytes()), dir, nil); err == nil {
+		t.Error("receiving a corrupt checkpoint succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "changing")); !os.IsNotExist(err) {
+		t.Errorf("corrupt file wasn't removed: %v", err)
+	}
+}
+
+func TestCheckpointNames(t *testing.T) {
+	for _, name := range []string{"../escape", "/abs", "a/../../b", "./a", `a\b`, ""} {
+		var buf bytes.Buffer
+		sources := []checkpointSource{bytesCheckpointSource(name, []byte("x"))}
+		if err := writeCheckpoint(&buf, nil, sources, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReceiveCheckpoint(&buf, t.TempDir(), nil); err == nil {
+			t.Errorf("receiving a file named %q succeeded", name)
+		}
+	}
+}
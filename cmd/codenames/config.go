@@ -0,0 +1,512 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jbowens/codenames"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds all of the server's configuration. Values are taken,
+// in increasing order of precedence, from the defaults, the YAML
+// config file, environment variables and command-line flags.
+type Config struct {
+	ListenAddr      string   `yaml:"listen_addr"`
+	PebbleDir       string   `yaml:"pebble_dir"`
+	BootstrapURL    string   `yaml:"bootstrap_url"`
+	FollowURL       string   `yaml:"follow_url,omitempty"`
+	TraceDir        string   `yaml:"trace_dir"`
+	AssetsDir       string   `yaml:"assets_dir"`
+	ShutdownTimeout duration `yaml:"shutdown_timeout"`
+
+	BootstrapPassword string `yaml:"bootstrap_password"`
+	PProfPassword     string `yaml:"pprof_password"`
+	AdminToken        string `yaml:"admin_token"`
+	SpectatorKey      string `yaml:"spectator_key"`
+
+	Store struct {
+		Backend    string `yaml:"backend"`
+		SQLitePath string `yaml:"sqlite_path"`
+	} `yaml:"store"`
+
+	Encryption struct {
+		KeyFile string `yaml:"key_file,omitempty"`
+		Key     string `yaml:"key,omitempty"`
+	} `yaml:"encryption"`
+
+	Backup struct {
+		Dir        string   `yaml:"dir"`
+		Interval   duration `yaml:"interval"`
+		KeepHourly int      `yaml:"keep_hourly"`
+		KeepDaily  int      `yaml:"keep_daily"`
+	} `yaml:"backup"`
+
+	S3 struct {
+		Endpoint        string   `yaml:"endpoint,omitempty"`
+		Region          string   `yaml:"region"`
+		Bucket          string   `yaml:"bucket,omitempty"`
+		Prefix          string   `yaml:"prefix,omitempty"`
+		AccessKeyID     string   `yaml:"access_key_id,omitempty"`
+		SecretAccessKey string   `yaml:"secret_access_key,omitempty"`
+		SessionToken    string   `yaml:"session_token,omitempty"`
+		UploadInterval  duration `yaml:"upload_interval"`
+		Keep            int      `yaml:"keep"`
+	} `yaml:"s3"`
+
+	TLS struct {
+		CertFile     string `yaml:"cert_file"`
+		KeyFile      string `yaml:"key_file"`
+		RedirectAddr string `yaml:"redirect_addr"`
+	} `yaml:"tls"`
+
+	Log struct {
+		Format string `yaml:"format"`
+		Level  string `yaml:"level"`
+	} `yaml:"log"`
+
+	RateLimits struct {
+		Client     string `yaml:"client"`
+		NextGame   string `yaml:"next_game"`
+		Game       string `yaml:"game"`
+		TrustProxy bool   `yaml:"trust_proxy"`
+	} `yaml:"rate_limits"`
+
+	Games struct {
+		PollTimeout    duration `yaml:"poll_timeout"`
+		MaxWordSetSize int      `yaml:"max_word_set_size"`
+		MaxInMemory    int      `yaml:"max_in_memory"`
+	} `yaml:"games"`
+
+	Page struct {
+		Title    string `yaml:"title"`
+		LogoURL  string `yaml:"logo_url,omitempty"`
+		Fonts    string `yaml:"fonts"`
+		FontsDir string `yaml:"fonts_dir,omitempty"`
+		Colors   struct {
+			Red  string `yaml:"red"`
+			Blue string `yaml:"blue"`
+		} `yaml:"colors"`
+		Analytics struct {
+			Provider  string `yaml:"provider"`
+			ID        string `yaml:"id,omitempty"`
+			ScriptURL string `yaml:"script_url,omitempty"`
+		} `yaml:"analytics"`
+	} `yaml:"page"`
+
+	Retention struct {
+		Idle     duration `yaml:"idle"`
+		Finished duration `yaml:"finished"`
+		Rooms    map[string]struct {
+			Pinned bool     `yaml:"pinned,omitempty"`
+			TTL    duration `yaml:"ttl,omitempty"`
+		} `yaml:"rooms,omitempty"`
+	} `yaml:"retention"`
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.ListenAddr = ":9091"
+	c.PebbleDir = filepath.Join(".", "db")
+	c.Store.Backend = storePebble
+	c.Store.SQLitePath = filepath.Join(".", "codenames.db")
+	c.Backup.Interval = duration(codenames.DefaultBackupPolicy.Interval)
+	c.Backup.KeepHourly = codenames.DefaultBackupPolicy.KeepHourly
+	c.Backup.KeepDaily = codenames.DefaultBackupPolicy.KeepDaily
+	c.S3.Region = "us-east-1"
+	c.S3.UploadInterval = duration(time.Hour)
+	c.S3.Keep = 24
+	c.ShutdownTimeout = duration(10 * time.Second)
+	c.Log.Format = string(codenames.LogFormatLogfmt)
+	c.Log.Level = codenames.LevelInfo.String()
+	c.RateLimits.Client = codenames.DefaultRateLimits.Client.String()
+	c.RateLimits.NextGame = codenames.DefaultRateLimits.NextGame.String()
+	c.RateLimits.Game = codenames.DefaultRateLimits.Game.String()
+	c.Games.PollTimeout = duration(codenames.DefaultPollTimeout)
+	c.Games.MaxWordSetSize = codenames.DefaultMaxWordSetSize
+	c.Games.MaxInMemory = codenames.DefaultMaxGamesInMemory
+	c.Page.Title = codenames.DefaultPage.Title
+	c.Page.Fonts = codenames.DefaultPage.Fonts
+	c.Page.Colors.Red = codenames.DefaultPage.Colors.Red
+	c.Page.Colors.Blue = codenames.DefaultPage.Colors.Blue
+	c.Page.Analytics.Provider = codenames.DefaultPage.Analytics.Provider
+	c.Retention.Idle = duration(codenames.DefaultRetention.Idle)
+	c.Retention.Finished = duration(codenames.DefaultRetention.Finished)
+	return c
+}
+
+// envVars maps environment variables to the config values they
+// override.
+var envVars = []struct {
+	name  string
+	field func(*Config) *string
+}{
+	{"PEBBLE_DIR", func(c *Config) *string { return &c.PebbleDir }},
+	{"SQLITE_PATH", func(c *Config) *string { return &c.Store.SQLitePath }},
+	{"ENCRYPTION_KEY", func(c *Config) *string { return &c.Encryption.Key }},
+	{"ENCRYPTION_KEY_FILE", func(c *Config) *string { return &c.Encryption.KeyFile }},
+	{"BACKUP_DIR", func(c *Config) *string { return &c.Backup.Dir }},
+	{"AWS_REGION", func(c *Config) *string { return &c.S3.Region }},
+	{"AWS_ACCESS_KEY_ID", func(c *Config) *string { return &c.S3.AccessKeyID }},
+	{"AWS_SECRET_ACCESS_KEY", func(c *Config) *string { return &c.S3.SecretAccessKey }},
+	{"AWS_SESSION_TOKEN", func(c *Config) *string { return &c.S3.SessionToken }},
+	{"BOOTSTRAPPW", func(c *Config) *string { return &c.BootstrapPassword }},
+	{"PPROFPW", func(c *Config) *string { return &c.PProfPassword }},
+	{"ADMINTOKEN", func(c *Config) *string { return &c.AdminToken }},
+	{"SPECTATORKEY", func(c *Config) *string { return &c.SpectatorKey }},
+	{"TRACE", func(c *Config) *string { return &c.TraceDir }},
+}
+
+// flagSet returns a flag set whose flags override c's values.
+func (c *Config) flagSet(name string, configPath *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(configPath, "config", *configPath,
+		"path to a YAML config file")
+	fs.StringVar(&c.ListenAddr, "listen-addr", c.ListenAddr,
+		"address for server to listen on")
+	fs.StringVar(&c.BootstrapURL, "bootstrap-url", c.BootstrapURL,
+		"URL of an existing codenames server, or s3://<bucket>/<prefix> of uploaded checkpoints, to bootstrap the DB from")
+	fs.StringVar(&c.FollowURL, "follow-url", c.FollowURL,
+		"URL of a primary codenames server to follow as a hot standby until promoted with SIGUSR1")
+	fs.StringVar(&c.PebbleDir, "pebble-dir", c.PebbleDir,
+		"directory to store the pebble db in")
+	fs.StringVar(&c.Store.Backend, "store", c.Store.Backend,
+		"storage backend for games: pebble or sqlite")
+	fs.StringVar(&c.Store.SQLitePath, "sqlite-path", c.Store.SQLitePath,
+		"path of the SQLite database, with -store=sqlite")
+	fs.StringVar(&c.Encryption.KeyFile, "encryption-key-file", c.Encryption.KeyFile,
+		"file of AES-256 keys to encrypt stored games with, the current key first; games aren't encrypted if empty")
+	fs.StringVar(&c.Backup.Dir, "backup-dir", c.Backup.Dir,
+		"directory to take scheduled backups of the store into; backups are disabled if empty")
+	fs.DurationVar((*time.Duration)(&c.Backup.Interval), "backup-interval", time.Duration(c.Backup.Interval),
+		"time between scheduled backups")
+	fs.IntVar(&c.Backup.KeepHourly, "backup-keep-hourly", c.Backup.KeepHourly,
+		"number of hours whose newest backup is kept")
+	fs.IntVar(&c.Backup.KeepDaily, "backup-keep-daily", c.Backup.KeepDaily,
+		"number of days whose newest backup is kept")
+	fs.StringVar(&c.S3.Endpoint, "s3-endpoint", c.S3.Endpoint,
+		"URL of an S3-compatible object store; AWS S3 in -s3-region if empty")
+	fs.StringVar(&c.S3.Region, "s3-region", c.S3.Region,
+		"region of the S3 bucket")
+	fs.StringVar(&c.S3.Bucket, "s3-bucket", c.S3.Bucket,
+		"S3 bucket to upload checkpoints of the store to; uploads are disabled if empty")
+	fs.StringVar(&c.S3.Prefix, "s3-prefix", c.S3.Prefix,
+		"prefix of the keys of uploaded checkpoints, such as codenames/")
+	fs.DurationVar((*time.Duration)(&c.S3.UploadInterval), "s3-upload-interval", time.Duration(c.S3.UploadInterval),
+		"time between checkpoint uploads")
+	fs.IntVar(&c.S3.Keep, "s3-keep", c.S3.Keep,
+		"number of uploaded checkpoints kept in the bucket")
+	fs.StringVar(&c.AssetsDir, "assets-dir", c.AssetsDir,
+		"serve word lists and static files from this directory instead of the binary, for development")
+	fs.DurationVar((*time.Duration)(&c.ShutdownTimeout), "shutdown-timeout", time.Duration(c.ShutdownTimeout),
+		"how long to wait for requests to drain and the DB to close on shutdown")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert-file", c.TLS.CertFile,
+		"PEM certificate file; enables HTTPS when set with -tls-key-file")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key-file", c.TLS.KeyFile,
+		"PEM private key file for -tls-cert-file")
+	fs.StringVar(&c.TLS.RedirectAddr, "tls-redirect-addr", c.TLS.RedirectAddr,
+		"address of a plain HTTP listener that redirects to HTTPS")
+	fs.StringVar(&c.RateLimits.Client, "rate-limit-client", c.RateLimits.Client,
+		"requests per second and burst allowed per client IP, as <rate>:<burst>")
+	fs.StringVar(&c.RateLimits.NextGame, "rate-limit-next-game", c.RateLimits.NextGame,
+		"/next-game requests per second and burst allowed per client IP, as <rate>:<burst>")
+	fs.StringVar(&c.RateLimits.Game, "rate-limit-game", c.RateLimits.Game,
+		"requests per second and burst allowed to modify a single game, as <rate>:<burst>")
+	fs.BoolVar(&c.RateLimits.TrustProxy, "trust-proxy", c.RateLimits.TrustProxy,
+		"identify clients by the X-Forwarded-For header when rate limiting")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format,
+		"format of log lines: logfmt or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level,
+		"minimum level of logged lines: debug, info, warn or error")
+	return fs
+}
+
+// loadConfig computes the effective configuration from the defaults,
+// the config file, the environment and the command-line arguments.
+// Commands define flags of their own with extraFlags.
+func loadConfig(name string, args []string, extraFlags ...func(*flag.FlagSet)) (Config, error) {
+	flagSet := func(c *Config, configPath *string) *flag.FlagSet {
+		fs := c.flagSet(name, configPath)
+		for _, f := range extraFlags {
+			f(fs)
+		}
+		return fs
+	}
+
+	// Parse the flags once to find the config file. They're parsed
+	// again after loading it, so that they take precedence.
+	configPath := os.Getenv("CODENAMES_CONFIG")
+	scratch := defaultConfig()
+	if err := flagSet(&scratch, &configPath).Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	c := defaultConfig()
+	if configPath != "" {
+		b, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := yaml.UnmarshalStrict(b, &c); err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %w", configPath, err)
+		}
+	}
+	for _, ev := range envVars {
+		if v, ok := os.LookupEnv(ev.name); ok && v != "" {
+			*ev.field(&c) = v
+		}
+	}
+	if err := flagSet(&c, &configPath).Parse(args); err != nil {
+		return Config{}, err
+	}
+	return c, c.validate()
+}
+
+func (c *Config) validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listen_addr is required")
+	}
+	switch c.Store.Backend {
+	case storePebble:
+		if c.PebbleDir == "" {
+			return errors.New("pebble_dir is required")
+		}
+	case storeSQLite:
+		if c.Store.SQLitePath == "" {
+			return errors.New("store.sqlite_path is required")
+		}
+	default:
+		return fmt.Errorf("unknown store.backend %q", c.Store.Backend)
+	}
+	if c.Encryption.KeyFile != "" || c.Encryption.Key != "" {
+		if c.Encryption.KeyFile != "" && c.Encryption.Key != "" {
+			return errors.New("encryption.key_file and encryption.key can't be set together")
+		}
+		if c.Store.Backend != storePebble {
+			return fmt.Errorf("encryption isn't supported by the %s store", c.Store.Backend)
+		}
+		if c.Encryption.Key != "" {
+			if _, err := codenames.ParseKeyring(c.Encryption.Key); err != nil {
+				return fmt.Errorf("encryption.key: %w", err)
+			}
+		}
+	}
+	if c.Backup.KeepHourly < 0 || c.Backup.KeepDaily < 0 {
+		return errors.New("backup.keep_hourly and backup.keep_daily must not be negative")
+	}
+	if c.FollowURL != "" {
+		if c.BootstrapURL != "" {
+			return errors.New("bootstrap_url and follow_url can't be set together")
+		}
+		if c.BootstrapPassword == "" {
+			return errors.New("follow_url requires bootstrap_password, the primary's")
+		}
+	}
+	if c.S3.Keep < 1 {
+		return errors.New("s3.keep must be positive")
+	}
+	if c.S3.Endpoint != "" {
+		if u, err := url.Parse(c.S3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("s3.endpoint %q isn't an http or https URL", c.S3.Endpoint)
+		}
+	}
+	if (c.S3.AccessKeyID == "") != (c.S3.SecretAccessKey == "") {
+		return errors.New("s3.access_key_id and s3.secret_access_key must be set together")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.RedirectAddr != "" && c.TLS.CertFile == "" {
+		return errors.New("tls.redirect_addr requires tls.cert_file and tls.key_file")
+	}
+	if _, err := c.logger(ioutil.Discard); err != nil {
+		return err
+	}
+	if _, err := c.rateLimits(); err != nil {
+		return err
+	}
+	for name, d := range map[string]duration{
+		"shutdown_timeout":   c.ShutdownTimeout,
+		"backup.interval":    c.Backup.Interval,
+		"s3.upload_interval": c.S3.UploadInterval,
+		"games.poll_timeout": c.Games.PollTimeout,
+		"retention.idle":     c.Retention.Idle,
+		"retention.finished": c.Retention.Finished,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if c.Games.MaxWordSetSize < 25 {
+		return errors.New("games.max_word_set_size must be at least 25")
+	}
+	if c.Games.MaxInMemory < 1 {
+		return errors.New("games.max_in_memory must be positive")
+	}
+	for id, room := range c.Retention.Rooms {
+		if room.TTL < 0 {
+			return fmt.Errorf("retention.rooms[%q].ttl must not be negative", id)
+		}
+	}
+	if err := c.page().Validate(); err != nil {
+		return fmt.Errorf("page: %w", err)
+	}
+	return nil
+}
+
+func (c *Config) page() codenames.PageOptions {
+	return codenames.PageOptions{
+		Title:    c.Page.Title,
+		LogoURL:  c.Page.LogoURL,
+		Fonts:    c.Page.Fonts,
+		FontsDir: c.Page.FontsDir,
+		Colors: codenames.ThemeColors{
+			Red:  c.Page.Colors.Red,
+			Blue: c.Page.Colors.Blue,
+		},
+		Analytics: codenames.Analytics{
+			Provider:  c.Page.Analytics.Provider,
+			ID:        c.Page.Analytics.ID,
+			ScriptURL: c.Page.Analytics.ScriptURL,
+		},
+	}
+}
+
+func (c *Config) retention() codenames.RetentionPolicy {
+	rp := codenames.RetentionPolicy{
+		Idle:     time.Duration(c.Retention.Idle),
+		Finished: time.Duration(c.Retention.Finished),
+		Rooms:    make(map[string]codenames.RoomRetention, len(c.Retention.Rooms)),
+	}
+	for id, room := range c.Retention.Rooms {
+		rp.Rooms[id] = codenames.RoomRetention{
+			Pinned: room.Pinned,
+			TTL:    time.Duration(room.TTL),
+		}
+	}
+	return rp
+}
+
+// keyring returns the keys to encrypt the store with, or nil if
+// encryption is disabled.
+func (c *Config) keyring() (*codenames.Keyring, error) {
+	switch {
+	case c.Encryption.KeyFile != "":
+		return codenames.ReadKeyring(c.Encryption.KeyFile)
+	case c.Encryption.Key != "":
+		return codenames.ParseKeyring(c.Encryption.Key)
+	}
+	return nil, nil
+}
+
+func (c *Config) backups(st codenames.Store, logger *codenames.Logger) *codenames.Backups {
+	return &codenames.Backups{
+		Dir:     c.Backup.Dir,
+		Store:   st,
+		Backend: c.Store.Backend,
+		Policy: codenames.BackupPolicy{
+			Interval:   time.Duration(c.Backup.Interval),
+			KeepHourly: c.Backup.KeepHourly,
+			KeepDaily:  c.Backup.KeepDaily,
+		},
+		Logger: logger.With("component", "backup"),
+	}
+}
+
+// s3Bucket returns the named bucket, in the configured object store
+// and with the configured credentials.
+func (c *Config) s3Bucket(name string) *codenames.S3Bucket {
+	endpoint := c.S3.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.S3.Region + ".amazonaws.com"
+	}
+	return &codenames.S3Bucket{
+		Endpoint:        endpoint,
+		Region:          c.S3.Region,
+		Bucket:          name,
+		AccessKeyID:     c.S3.AccessKeyID,
+		SecretAccessKey: c.S3.SecretAccessKey,
+		SessionToken:    c.S3.SessionToken,
+	}
+}
+
+func (c *Config) s3Uploads(st codenames.Store, logger *codenames.Logger) *codenames.S3Uploads {
+	return &codenames.S3Uploads{
+		Bucket:   c.s3Bucket(c.S3.Bucket),
+		Prefix:   c.S3.Prefix,
+		Store:    st,
+		Interval: time.Duration(c.S3.UploadInterval),
+		Keep:     c.S3.Keep,
+		Logger:   logger.With("component", "s3"),
+	}
+}
+
+func (c *Config) logger(w io.Writer) (*codenames.Logger, error) {
+	var format codenames.LogFormat
+	if err := format.Set(c.Log.Format); err != nil {
+		return nil, fmt.Errorf("log.format: %w", err)
+	}
+	var level codenames.Level
+	if err := level.Set(c.Log.Level); err != nil {
+		return nil, fmt.Errorf("log.level: %w", err)
+	}
+	return codenames.NewLogger(w, format, level), nil
+}
+
+func (c *Config) rateLimits() (codenames.RateLimits, error) {
+	rl := codenames.RateLimits{TrustProxy: c.RateLimits.TrustProxy}
+	if err := rl.Client.Set(c.RateLimits.Client); err != nil {
+		return rl, fmt.Errorf("rate_limits.client: %w", err)
+	}
+	if err := rl.NextGame.Set(c.RateLimits.NextGame); err != nil {
+		return rl, fmt.Errorf("rate_limits.next_game: %w", err)
+	}
+	if err := rl.Game.Set(c.RateLimits.Game); err != nil {
+		return rl, fmt.Errorf("rate_limits.game: %w", err)
+	}
+	return rl, nil
+}
+
+// print writes the configuration as YAML, with secrets redacted.
+func (c Config) print(w io.Writer) error {
+	for _, secret := range []*string{&c.BootstrapPassword, &c.PProfPassword, &c.AdminToken, &c.SpectatorKey,
+		&c.Encryption.Key, &c.S3.SecretAccessKey, &c.S3.SessionToken} {
+		if *secret != "" {
+			*secret = "<redacted>"
+		}
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// duration is a time.Duration that's represented in YAML as a
+// string like "1h30m".
+type duration time.Duration
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
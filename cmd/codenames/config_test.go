@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "codenames.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+listen_addr: ":8080"
+pebble_dir: /from/file
+games:
+  poll_timeout: 30s
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("PEBBLE_DIR", "/from/env")
+	defer os.Unsetenv("PEBBLE_DIR")
+
+	cfg, err := loadConfig("codenames", []string{"-config", path, "-listen-addr", ":7070"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":7070" {
+		t.Errorf("ListenAddr = %q, want the flag's value", cfg.ListenAddr)
+	}
+	if cfg.PebbleDir != "/from/env" {
+		t.Errorf("PebbleDir = %q, want the environment's value", cfg.PebbleDir)
+	}
+	if time.Duration(cfg.Games.PollTimeout) != 30*time.Second {
+		t.Errorf("Games.PollTimeout = %s, want the file's value", time.Duration(cfg.Games.PollTimeout))
+	}
+	if cfg.Games.MaxWordSetSize != defaultConfig().Games.MaxWordSetSize {
+		t.Errorf("Games.MaxWordSetSize = %d, want the default", cfg.Games.MaxWordSetSize)
+	}
+
+	if _, err := loadConfig("codenames", []string{"-rate-limit-game", "fast"}); err == nil {
+		t.Error("expected an invalid rate limit to fail validation")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jbowens/codenames"
+)
+
+// handoffTimeout bounds how long a follower being promoted waits
+// for its primary to hand off.
+const handoffTimeout = time.Minute
+
+// followPositionPath returns the path of the file in which a
+// follower records its position in the primary's change log.
+func followPositionPath(cfg Config) string {
+	return stagingPath(cfg, ".follow")
+}
+
+func newFollower(logger *codenames.Logger, cfg Config, st codenames.Store) *codenames.Follower {
+	return &codenames.Follower{
+		URL:          cfg.FollowURL,
+		Password:     cfg.BootstrapPassword,
+		Store:        st,
+		PositionFile: followPositionPath(cfg),
+		Logger:       logger.With("component", "follower"),
+	}
+}
+
+// runFollower follows the primary until the follower is promoted,
+// returning the opened store, or stopped, returning nil. The primary
+// keeps its change log in memory, so it loses the follower's position
+// when it restarts; the follower then deletes its store and
+// bootstraps again from a fresh checkpoint.
+func runFollower(logger *codenames.Logger, cfg Config) (store, error) {
+	for {
+		pos, err := prepareFollower(logger, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrapping from the primary: %w", err)
+		}
+		st, err := openStore(logger, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("opening db: %w", err)
+		}
+		promoted, err := follow(logger, cfg, st, pos)
+		if promoted {
+			return st, nil
+		}
+		if closeErr := st.Close(); closeErr != nil {
+			logger.Error("unable to close db", "err", closeErr)
+			if err == nil {
+				err = closeErr
+			}
+		}
+		if !errors.Is(err, codenames.ErrReplicationGap) {
+			return nil, err
+		}
+		logger.Warn("the primary no longer has this follower's position; bootstrapping again", "url", cfg.FollowURL)
+		// The store is deleted before the position, so that if
+		// this is interrupted, the next attempt finds the gap again
+		// rather than a store it can't bootstrap into.
+		if err := removeStore(cfg); err != nil {
+			return nil, fmt.Errorf("deleting the store: %w", err)
+		}
+		if err := os.Remove(followPositionPath(cfg)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// prepareFollower returns the position in the primary's change log
+// to follow from. If the store hasn't been bootstrapped from the
+// primary yet, it bootstraps it first.
+func prepareFollower(logger *codenames.Logger, cfg Config) (codenames.ReplicationPosition, error) {
+	pos, err := codenames.ReadReplicationPosition(followPositionPath(cfg))
+	if !os.IsNotExist(err) {
+		return pos, err
+	}
+
+	// The primary's position is read before its checkpoint is
+	// taken, so following from it applies any changes the
+	// checkpoint misses.
+	pos, err = newFollower(logger, cfg, nil).Head(context.Background())
+	if err != nil {
+		return pos, err
+	}
+	bootstrapCfg := cfg
+	bootstrapCfg.BootstrapURL = cfg.FollowURL
+	if err := bootstrapStore(logger, bootstrapCfg); err != nil {
+		return pos, err
+	}
+	logger.Info("bootstrapped from the primary", "url", cfg.FollowURL, "position", pos)
+	return pos, codenames.WriteReplicationPosition(followPositionPath(cfg), pos)
+}
+
+// follow applies the primary's changes to st, starting at pos, until
+// the follower is promoted with SIGUSR1 or stopped with SIGINT or
+// SIGTERM. It reports whether the follower was promoted.
+func follow(logger *codenames.Logger, cfg Config, st codenames.Store, pos codenames.ReplicationPosition) (bool, error) {
+	f := newFollower(logger, cfg, st)
+	f.Position = pos
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx) }()
+	logger.Info("following", "url", cfg.FollowURL, "position", pos)
+
+	select {
+	case err := <-done:
+		return false, err
+	case sig := <-sigs:
+		cancel()
+		if err := <-done; err != nil {
+			return false, err
+		}
+		if sig != syscall.SIGUSR1 {
+			logger.Info("stopped following", "signal", sig, "position", f.Position)
+			return false, nil
+		}
+	}
+
+	// The primary stops accepting changes to games and sends the
+	// last of them, so that none are lost in the cutover. If it's
+	// unreachable, the follower is promoted without them.
+	logger.Info("promoting; asking the primary to hand off", "url", cfg.FollowURL)
+	handoffCtx, handoffCancel := context.WithTimeout(context.Background(), handoffTimeout)
+	defer handoffCancel()
+	if final, err := f.Handoff(handoffCtx); err != nil {
+		logger.Warn("primary didn't hand off; promoting without its latest changes", "err", err, "position", f.Position)
+	} else {
+		logger.Info("primary handed off", "position", final)
+	}
+	if err := os.Remove(f.PositionFile); err != nil {
+		logger.Warn("unable to remove follower position", "path", f.PositionFile, "err", err)
+	}
+	return true, nil
+}
@@ -1,199 +1,561 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/gob"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"runtime/trace"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/cockroachdb/pebble"
 	"github.com/jbowens/codenames"
-	"github.com/pkg/errors"
 )
 
-const defaultListenAddr = ":9091"
-const expiryDur = -24 * time.Hour
-
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	var bootstrapURL string
-	var listenAddr string
-	flag.StringVar(&listenAddr, "listen-addr", defaultListenAddr,
-		"address for server to listen on")
-	flag.StringVar(&bootstrapURL, "bootstrap-url", "",
-		"URL of an existing codenames server to bootstrap the DB from")
-
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(configCommand(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "migrate" {
+		os.Exit(migrateCommand(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "restore" {
+		os.Exit(restoreCommand(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "rekey" {
+		os.Exit(rekeyCommand(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "check-index" {
+		os.Exit(checkIndexCommand(args[1:]))
+	}
 
-	// Open a Pebble DB to persist games to disk.
-	dir := os.Getenv("PEBBLE_DIR")
-	if dir == "" {
-		dir = filepath.Join(".", "db")
+	cfg, err := loadConfig(os.Args[0], args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		os.Exit(2)
 	}
-	err := os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "MkdirAll(%q): %s\n", dir, err)
-		os.Exit(1)
+	logger, _ := cfg.logger(os.Stderr)
+	rateLimits, _ := cfg.rateLimits()
+	shutdownTimeout := time.Duration(cfg.ShutdownTimeout)
+	retention := cfg.retention()
+	bootstrapURL := cfg.BootstrapURL
+
+	// Games are persisted to disk, in Pebble by default.
+	if cfg.Store.Backend == storePebble {
+		dir := cfg.PebbleDir
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			logger.Error("unable to create pebble directory", "dir", dir, "err", err)
+			os.Exit(1)
+		}
 	}
-	log.Printf("[STARTUP] Opening pebble db from directory: %s\n", dir)
 
 	if len(bootstrapURL) > 0 {
-		err := bootstrap(bootstrapURL, dir)
+		err := bootstrapStore(logger, cfg)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Bootstrapping from %q: %s\n", bootstrapURL, err)
+			logger.Error("unable to bootstrap", "url", bootstrapURL, "err", err)
 			os.Exit(1)
 		}
-		fmt.Printf("Bootstrapped from %q.\n", bootstrapURL)
+		logger.Info("bootstrapped", "url", bootstrapURL)
 		os.Exit(0)
 	}
 
-	var opts pebble.Options
-	opts.EventListener = pebble.MakeLoggingEventListener(nil)
-	opts.Experimental.DeleteRangeFlushDelay = 5 * time.Second
-	opts.FormatMajorVersion = pebble.FormatMarkedCompacted
-	opts.Levels = []pebble.LevelOptions{
-		{BlockSize: 256 << 10, BlockRestartInterval: 256},
-	}
-	db, err := pebble.Open(dir, &opts)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "pebble.Open: %s\n", err)
-		os.Exit(1)
+	// A follower bootstraps from its primary and applies its
+	// changes until it's promoted, then starts serving as the
+	// primary.
+	var st store
+	if cfg.FollowURL != "" {
+		st, err = runFollower(logger, cfg)
+		if err != nil {
+			logger.Error("unable to follow the primary", "url", cfg.FollowURL, "err", err)
+			os.Exit(1)
+		}
+		if st == nil {
+			os.Exit(0)
+		}
+		logger.Info("promoted to primary")
+	} else {
+		st, err = openStore(logger, cfg)
+		if err != nil {
+			logger.Error("unable to open db", "store", cfg.Store.Backend, "err", err)
+			os.Exit(1)
+		}
 	}
-	defer db.Close()
 
-	ps := &codenames.PebbleStore{DB: db}
+	// Background work is stopped by cancelling ctx on shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Delete any games created too long ago.
-	err = ps.DeleteExpired(time.Now().Add(expiryDur))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "PebbleStore.DeletedExpired: %s\n", err)
+	// Delete any games the retention policy has expired. The
+	// server expires games periodically from then on, and loads
+	// the rest from disk as they're requested.
+	_, err = st.DeleteExpired(retention, time.Now())
+	if errors.Is(err, codenames.ErrEncryptionKey) {
+		logger.Error("unable to decrypt the store; check encryption.key_file or ENCRYPTION_KEY", "err", err)
+		os.Exit(1)
+	} else if err != nil {
+		logger.Error("unable to delete expired games", "err", err)
 		os.Exit(1)
 	}
-	go deleteExpiredPeriodically(ps)
 
-	// Restore games from disk.
-	games, err := ps.Restore()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "PebbleStore.Restore: %s\n", err)
-		os.Exit(1)
+	// Pebble games are found through the ID index, so make sure
+	// it's intact. This also builds it for databases created
+	// before it existed. Superseded games are left alone.
+	if ps, ok := st.(*codenames.PebbleStore); ok {
+		report, err := ps.CheckIndex(true)
+		if err != nil {
+			logger.Error("unable to check game index", "err", err)
+			os.Exit(1)
+		}
+		if !report.IndexOK() {
+			logger.Warn("repaired game index", "games", report.Games, "missing", report.Missing,
+				"stale", report.Stale, "orphaned", report.Orphaned)
+		}
+		if report.Superseded > 0 {
+			logger.Warn("found superseded games; run `codenames check-index -delete-superseded` to delete them",
+				"superseded", report.Superseded)
+		}
+	}
+
+	// Backups and uploads are stopped before the DB is closed.
+	var backups sync.WaitGroup
+	if cfg.Backup.Dir != "" {
+		logger.Info("scheduled backups enabled", "dir", cfg.Backup.Dir, "interval", time.Duration(cfg.Backup.Interval))
+		backups.Add(1)
+		go func() {
+			defer backups.Done()
+			cfg.backups(st, logger).Run(ctx)
+		}()
+	}
+	if cfg.S3.Bucket != "" {
+		logger.Info("checkpoint uploads enabled", "bucket", cfg.S3.Bucket, "prefix", cfg.S3.Prefix,
+			"interval", time.Duration(cfg.S3.UploadInterval))
+		backups.Add(1)
+		go func() {
+			defer backups.Done()
+			cfg.s3Uploads(st, logger).Run(ctx)
+		}()
 	}
-	log.Printf("[STARTUP] Restored %d games from disk.\n", len(games))
 
-	if traceDir := os.Getenv("TRACE"); len(traceDir) > 0 {
-		log.Printf("[STARTUP] Traces enabled; storing most recent trace in %q", traceDir)
-		go tracePeriodically(traceDir)
+	if traceDir := cfg.TraceDir; len(traceDir) > 0 {
+		logger.Info("traces enabled", "dst", traceDir)
+		go tracePeriodically(ctx, logger, traceDir)
 	}
 
-	log.Printf("[STARTUP] Listening on addr %s\n", listenAddr)
+	logger.Info("listening", "addr", cfg.ListenAddr, "tls", cfg.TLS.CertFile != "")
 	server := &codenames.Server{
 		Server: http.Server{
-			Addr: listenAddr,
+			Addr: cfg.ListenAddr,
 		},
-		Store: ps,
+		Store:             st,
+		Logger:            logger,
+		RateLimits:        rateLimits,
+		BootstrapPassword: cfg.BootstrapPassword,
+		PProfPassword:     cfg.PProfPassword,
+		AdminToken:        cfg.AdminToken,
+		AssetsDir:         cfg.AssetsDir,
+		Page:              cfg.page(),
+		PollTimeout:       time.Duration(cfg.Games.PollTimeout),
+		MaxWordSetSize:    cfg.Games.MaxWordSetSize,
+		MaxGamesInMemory:  cfg.Games.MaxInMemory,
+		Retention:         retention,
+		TLSCertFile:       cfg.TLS.CertFile,
+		TLSKeyFile:        cfg.TLS.KeyFile,
+		RedirectAddr:      cfg.TLS.RedirectAddr,
 	}
-	if err := server.Start(games); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	if cfg.SpectatorKey != "" {
+		k := sha256.Sum256([]byte(cfg.SpectatorKey))
+		server.SpectatorKey = k[:]
 	}
+
+	if cfg.TLS.CertFile != "" {
+		// Reload the certificate on SIGHUP, as well as whenever
+		// its files change.
+		go func() {
+			hups := make(chan os.Signal, 1)
+			signal.Notify(hups, syscall.SIGHUP)
+			for range hups {
+				if err := server.ReloadCertificate(); err != nil {
+					logger.Error("unable to reload TLS certificate", "err", err)
+					continue
+				}
+				logger.Info("reloaded TLS certificate")
+			}
+		}()
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		logger.Info("shutting down", "signal", sig, "timeout", shutdownTimeout)
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer shutdownCancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("unable to drain requests", "err", err)
+		}
+		cancel()
+		backups.Wait()
+		if err != nil {
+			// Requests or background work may still be using the
+			// DB, so closing it could fail under them. Saves are
+			// durable once they're acknowledged, so nothing is
+			// lost by leaving it to the OS.
+			logger.Warn("not closing db, since it may still be in use")
+			return
+		}
+
+		// Flush and close the DB, within whatever remains of the
+		// deadline.
+		closed := make(chan error, 1)
+		go func() { closed <- st.Close() }()
+		select {
+		case err := <-closed:
+			if err != nil {
+				logger.Error("unable to close db", "err", err)
+			}
+		case <-shutdownCtx.Done():
+			logger.Error("timed out closing db")
+		}
+	}()
+
+	if err := server.Start(nil); err != nil && err != http.ErrServerClosed {
+		logger.Error("server exited", "err", err)
+		os.Exit(1)
+	}
+	<-shutdownDone
+	logger.Info("shut down")
+}
+
+// configCommand implements `codenames config print`, which prints
+// the effective configuration.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintf(os.Stderr, "usage: %s config print [flags]\n", os.Args[0])
+		return 2
+	}
+	cfg, err := loadConfig(os.Args[0]+" config print", args[1:])
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		return 2
+	}
+	if err := cfg.print(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		return 1
+	}
+	return 0
 }
 
-func bootstrap(bootstrapURL, dir string) error {
-	ls, err := ioutil.ReadDir(dir)
+// migrateCommand implements `codenames migrate`, which rewrites
+// games saved at older schema versions at the current version. The
+// server must not be running.
+func migrateCommand(args []string) int {
+	var dryRun bool
+	cfg, err := loadConfig(os.Args[0]+" migrate", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&dryRun, "dry-run", false,
+			"report the games that would be migrated without rewriting them")
+	})
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		return 2
+	}
+	logger, _ := cfg.logger(os.Stderr)
+	st, err := openStore(logger, cfg)
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "opening db: %s\n", err)
+		return 1
 	}
-	if len(ls) > 0 {
-		return fmt.Errorf("directory %q is not empty: aborting\n", dir)
+	defer st.Close()
+
+	report, err := st.Migrate(dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %s\n", err)
+		return 1
 	}
-	u, err := url.Parse(bootstrapURL)
+	fmt.Printf("%d games; current schema version is %d\n", report.Records, codenames.SchemaVersion)
+	versions := make([]int, 0, len(report.Outdated))
+	for v := range report.Outdated {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	for _, v := range versions {
+		fmt.Printf("%d games at schema version %d:\n", report.Outdated[v], v)
+		for _, m := range codenames.DescribeMigrations(v) {
+			fmt.Printf("  %s\n", m)
+		}
+	}
+	if dryRun {
+		fmt.Println("dry run: no games were rewritten")
+	} else {
+		fmt.Printf("migrated %d games\n", report.Migrated)
+	}
+	return 0
+}
+
+// rekeyCommand implements `codenames rekey`, which re-encrypts every
+// game and word set that isn't encrypted with the first configured
+// encryption key. The server must not be running.
+func rekeyCommand(args []string) int {
+	var dryRun bool
+	cfg, err := loadConfig(os.Args[0]+" rekey", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&dryRun, "dry-run", false,
+			"report the values that would be re-encrypted without rewriting them")
+	})
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		return 2
+	}
+	logger, _ := cfg.logger(os.Stderr)
+	st, err := openStore(logger, cfg)
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "opening db: %s\n", err)
+		return 1
 	}
-	u.Path = "/checkpoint"
-	req, err := http.NewRequest("GET", u.String(), nil)
+	defer st.Close()
+
+	ps, ok := st.(*codenames.PebbleStore)
+	if !ok || ps.Keys == nil {
+		fmt.Fprintln(os.Stderr, "rekey: no encryption key is configured")
+		return 2
+	}
+	report, err := ps.Rekey(dryRun)
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "rekey: %s\n", err)
+		return 1
 	}
-	req.SetBasicAuth("admin", os.Getenv("BOOTSTRAPPW"))
-	resp, err := http.DefaultClient.Do(req)
+	fmt.Printf("%d games and word sets; %d not encrypted with key %s\n",
+		report.Values, report.Rewritten, ps.Keys.KeyIDs()[0])
+	if dryRun {
+		fmt.Println("dry run: nothing was rewritten")
+	} else {
+		fmt.Printf("re-encrypted %d values\n", report.Rewritten)
+	}
+	return 0
+}
+
+// checkIndexCommand implements `codenames check-index`, which checks
+// and repairs a Pebble store's game index, and with
+// -delete-superseded deletes games replaced by newer ones with the
+// same ID. The server must not be running.
+func checkIndexCommand(args []string) int {
+	var deleteSuperseded bool
+	cfg, err := loadConfig(os.Args[0]+" check-index", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&deleteSuperseded, "delete-superseded", false,
+			"delete games replaced by a more recently created game with the same ID")
+	})
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		return 2
+	}
+	logger, _ := cfg.logger(os.Stderr)
+	st, err := openStore(logger, cfg)
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "opening db: %s\n", err)
+		return 1
 	}
-	defer resp.Body.Close()
+	defer st.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("checkpoint returned %s status code\n", resp.Status)
+	ps, ok := st.(*codenames.PebbleStore)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "check-index: only Pebble stores have a game index")
+		return 2
 	}
-	b, err := ioutil.ReadAll(resp.Body)
+	report, err := ps.CheckIndex(true)
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "check-index: %s\n", err)
+		return 1
 	}
-	r := bytes.NewReader(b)
-	gzr, err := gzip.NewReader(r)
+	fmt.Printf("%d games; repaired %d missing, %d stale and %d orphaned index entries\n",
+		report.Games, report.Missing, report.Stale, report.Orphaned)
+	fmt.Printf("%d superseded games\n", report.Superseded)
+	if !deleteSuperseded {
+		return 0
+	}
+	deleted, err := ps.DeleteSuperseded()
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "check-index: %s\n", err)
+		return 1
 	}
-	dec := gob.NewDecoder(gzr)
-	for {
-		var cf codenames.CheckpointFile
-		err := dec.Decode(&cf)
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	fmt.Printf("deleted %d superseded games\n", deleted)
+	return 0
+}
+
+// restoreCommand implements `codenames restore -from <backup>`,
+// which validates a backup taken with -backup-dir and restores it
+// into the configured store, which must be empty.
+func restoreCommand(args []string) int {
+	var from string
+	cfg, err := loadConfig(os.Args[0]+" restore", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&from, "from", "", "path of the backup to restore")
+	})
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		return 2
+	}
+	if from == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s restore -from <backup> [flags]\n", os.Args[0])
+		return 2
+	}
+	logger, _ := cfg.logger(os.Stderr)
+
+	m, err := codenames.ValidateBackup(from)
+	if err != nil {
+		logger.Error("invalid backup", "backup", from, "err", err)
+		return 1
+	}
+	if m.Backend != cfg.Store.Backend {
+		logger.Error("backup is of a different store", "backup", from, "backup_store", m.Backend, "store", cfg.Store.Backend)
+		return 1
+	}
+	if err := checkStoreEmpty(cfg); err != nil {
+		logger.Error("unable to restore", "err", err)
+		return 1
+	}
+	staging := stagingPath(cfg, ".restore")
+	if err := os.RemoveAll(staging); err != nil {
+		logger.Error("unable to restore", "err", err)
+		return 1
+	}
+	if _, err := codenames.RestoreBackup(from, staging); err != nil {
+		logger.Error("unable to restore", "backup", from, "err", err)
+		return 1
+	}
+	names := make([]string, len(m.Files))
+	for i, f := range m.Files {
+		names[i] = f.Name
+	}
+	if err := installStore(cfg, staging, names); err != nil {
+		logger.Error("unable to restore", "backup", from, "err", err)
+		return 1
+	}
+	logger.Info("restored backup", "backup", from, "created_at", m.CreatedAt, "files", len(m.Files))
+	return 0
+}
+
+// bootstrapAttempts is the number of times bootstrap requests a
+// checkpoint before giving up. Each attempt resumes from the files
+// received by the last one.
+const bootstrapAttempts = 5
+
+// bootstrap downloads a checkpoint from the server at bootstrapURL
+// into dir, returning its manifest. If dir holds the files of an
+// interrupted bootstrap, the download resumes from them.
+func bootstrap(logger *codenames.Logger, bootstrapURL, password, dir string) (codenames.CheckpointManifest, error) {
+	var m codenames.CheckpointManifest
+	err := withRetries(logger, func() (err error) {
+		m, err = downloadCheckpoint(logger, bootstrapURL, password, dir)
+		return err
+	})
+	return m, err
+}
+
+// withRetries calls download up to bootstrapAttempts times, until
+// it succeeds.
+func withRetries(logger *codenames.Logger, download func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := download()
+		if err == nil || attempt == bootstrapAttempts {
 			return err
 		}
-		err = ioutil.WriteFile(filepath.Join(dir, cf.Name), cf.Data, os.ModePerm)
-		if err != nil {
-			return errors.Wrapf(err, "writing %s", filepath.Base(cf.Name))
-		}
-		log.Printf("Downloaded %s (%d bytes)\n", cf.Name, len(cf.Data))
+		logger.Warn("checkpoint download failed; resuming", "attempt", attempt, "err", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
 	}
-	return nil
 }
 
-func deleteExpiredPeriodically(ps *codenames.PebbleStore) {
-	for range time.Tick(time.Hour) {
-		err := ps.DeleteExpired(time.Now().Add(expiryDur))
-		if err != nil {
-			log.Printf("PebbleStore.DeletedExpired: %s\n", err)
-		}
+func downloadCheckpoint(logger *codenames.Logger, bootstrapURL, password, dir string) (codenames.CheckpointManifest, error) {
+	have, err := codenames.CheckpointPrefixes(dir)
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
+	}
+	u, err := url.Parse(bootstrapURL)
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
 	}
+	u.Path = "/checkpoint"
+	q := url.Values{}
+	for _, p := range have {
+		q.Add("have", p.String())
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
+	}
+	req.SetBasicAuth("admin", password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return codenames.CheckpointManifest{}, fmt.Errorf("checkpoint returned %s status code", resp.Status)
+	}
+	return codenames.ReceiveCheckpoint(resp.Body, dir, logger)
 }
 
-func tracePeriodically(dst string) {
-	for range time.Tick(time.Minute) {
-		takeTrace(dst)
+func tracePeriodically(ctx context.Context, logger *codenames.Logger, dst string) {
+	logger = logger.With("component", "trace")
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			takeTrace(ctx, logger, dst)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func takeTrace(dst string) {
+func takeTrace(ctx context.Context, logger *codenames.Logger, dst string) {
 	f, err := ioutil.TempFile("", "trace")
 	if err != nil {
-		log.Printf("[TRACE] error creating temp file: %s", err)
+		logger.Error("unable to create temp file", "err", err)
 		return
 	}
 	defer f.Close()
 
 	err = trace.Start(f)
 	if err != nil {
-		log.Printf("[TRACE] error starting trace: %s", err)
+		logger.Error("unable to start trace", "err", err)
 		return
 	}
-	<-time.After(10 * time.Second)
+	select {
+	case <-time.After(10 * time.Second):
+	case <-ctx.Done():
+	}
 	trace.Stop()
 	err = os.Rename(f.Name(), dst)
 	if err != nil {
-		log.Printf("[TRACE] error renaming trace: %s", err)
+		logger.Error("unable to rename trace", "err", err)
 	}
 }
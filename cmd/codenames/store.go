@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jbowens/codenames"
+	"github.com/pkg/errors"
+)
+
+// Storage backends, selected by store.backend.
+const (
+	storePebble = "pebble"
+	storeSQLite = "sqlite"
+)
+
+// store is implemented by every storage backend.
+type store interface {
+	codenames.Store
+	DeleteExpired(rp codenames.RetentionPolicy, now time.Time) ([]string, error)
+	Migrate(dryRun bool) (codenames.MigrationReport, error)
+	Close() error
+}
+
+// openStore opens the configured storage backend.
+func openStore(logger *codenames.Logger, cfg Config) (store, error) {
+	if cfg.Store.Backend == storeSQLite {
+		logger.Info("opening sqlite db", "path", cfg.Store.SQLitePath)
+		return codenames.OpenSQLiteStore(cfg.Store.SQLitePath, logger)
+	}
+
+	keys, err := cfg.keyring()
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	dir := cfg.PebbleDir
+	logger.Info("opening pebble db", "dir", dir)
+	if keys != nil {
+		logger.Info("encrypting stored games", "keys", strings.Join(keys.KeyIDs(), ","))
+	}
+	var opts pebble.Options
+	opts.Logger = logger.PebbleLogger()
+	opts.EventListener = pebble.MakeLoggingEventListener(opts.Logger)
+	opts.Experimental.DeleteRangeFlushDelay = 5 * time.Second
+	opts.FormatMajorVersion = pebble.FormatMarkedCompacted
+	opts.Levels = []pebble.LevelOptions{
+		{BlockSize: 256 << 10, BlockRestartInterval: 256},
+	}
+	db, err := pebble.Open(dir, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &codenames.PebbleStore{DB: db, Logger: logger, Keys: keys}, nil
+}
+
+// bootstrapStore downloads a checkpoint of an existing server's
+// store into the configured storage backend, which must be empty.
+// Both servers must use the same backend. The checkpoint is
+// received into a staging directory beside the store and moved into
+// place once it's complete, so an interrupted bootstrap is resumed
+// by running it again.
+func bootstrapStore(logger *codenames.Logger, cfg Config) error {
+	if err := checkStoreEmpty(cfg); err != nil {
+		return err
+	}
+	staging := stagingPath(cfg, ".bootstrap")
+	var m codenames.CheckpointManifest
+	var err error
+	if strings.HasPrefix(cfg.BootstrapURL, "s3://") {
+		m, err = bootstrapS3(logger, cfg, staging)
+	} else {
+		m, err = bootstrap(logger, cfg.BootstrapURL, cfg.BootstrapPassword, staging)
+	}
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(m.Files))
+	for i, f := range m.Files {
+		names[i] = f.Name
+	}
+	return installStore(cfg, staging, names)
+}
+
+// bootstrapS3 downloads the newest checkpoint uploaded to the
+// s3://<bucket>/<prefix> bootstrap URL, and receives it into dir.
+// The checkpoint is downloaded to a file beside dir first, so an
+// interrupted download is resumed by running it again.
+func bootstrapS3(logger *codenames.Logger, cfg Config, dir string) (codenames.CheckpointManifest, error) {
+	u, err := url.Parse(cfg.BootstrapURL)
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
+	}
+	if u.Host == "" {
+		return codenames.CheckpointManifest{}, fmt.Errorf("bootstrap URL %q has no bucket", cfg.BootstrapURL)
+	}
+	ctx := context.Background()
+	bucket := cfg.s3Bucket(u.Host)
+	prefix := strings.TrimPrefix(u.Path, "/")
+	keys, err := codenames.ListS3Checkpoints(ctx, bucket, prefix)
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
+	}
+	if len(keys) == 0 {
+		return codenames.CheckpointManifest{}, fmt.Errorf("no checkpoints under %s", cfg.BootstrapURL)
+	}
+	key := keys[len(keys)-1]
+	logger.Info("downloading checkpoint", "bucket", u.Host, "key", key)
+
+	path := dir + ".ckpt"
+	err = withRetries(logger, func() error {
+		return codenames.DownloadS3Object(ctx, bucket, key, path)
+	})
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return codenames.CheckpointManifest{}, err
+	}
+	defer f.Close()
+	m, err := codenames.ReceiveCheckpoint(f, dir, logger)
+	if err != nil {
+		return m, err
+	}
+	f.Close()
+	return m, os.Remove(path)
+}
+
+// checkStoreEmpty returns an error if the configured store already
+// exists and isn't empty.
+func checkStoreEmpty(cfg Config) error {
+	if cfg.Store.Backend == storeSQLite {
+		path := cfg.Store.SQLitePath
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("database %q already exists: aborting", path)
+		}
+		return nil
+	}
+	dir := cfg.PebbleDir
+	ls, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(ls) > 0 {
+		return fmt.Errorf("directory %q is not empty: aborting", dir)
+	}
+	return nil
+}
+
+// removeStore deletes the configured store.
+func removeStore(cfg Config) error {
+	if cfg.Store.Backend == storeSQLite {
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			if err := os.Remove(cfg.Store.SQLitePath + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	return os.RemoveAll(cfg.PebbleDir)
+}
+
+// stagingPath returns the path of a directory beside the configured
+// store, for receiving a copy of a store into.
+func stagingPath(cfg Config, suffix string) string {
+	if cfg.Store.Backend == storeSQLite {
+		return cfg.Store.SQLitePath + suffix
+	}
+	return filepath.Clean(cfg.PebbleDir) + suffix
+}
+
+// installStore moves the named files of a store, received into the
+// staging directory, into place as the configured store, and
+// removes the staging directory.
+func installStore(cfg Config, staging string, names []string) error {
+	if cfg.Store.Backend == storeSQLite {
+		received := filepath.Join(staging, codenames.SQLiteCheckpointName)
+		if len(names) != 1 || names[0] != codenames.SQLiteCheckpointName || !isSQLiteDB(received) {
+			return errors.New("store isn't a SQLite database; is it from a server using -store=sqlite?")
+		}
+		if err := os.Rename(received, cfg.Store.SQLitePath); err != nil {
+			return err
+		}
+		return os.RemoveAll(staging)
+	}
+
+	for _, name := range names {
+		if name == codenames.SQLiteCheckpointName {
+			return errors.New("store is a SQLite database; is it from a server using -store=pebble?")
+		}
+	}
+	dir := cfg.PebbleDir
+	for _, name := range names {
+		name = filepath.FromSlash(name)
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "moving %s", name)
+		}
+	}
+	return os.RemoveAll(staging)
+}
+
+// isSQLiteDB reports whether the file at path starts with the
+// header of a SQLite database.
+func isSQLiteDB(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return string(header) == "SQLite format 3\x00"
+}
@@ -0,0 +1,190 @@
+package codenames
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// encryptedPrefix starts every encrypted value. Unencrypted values
+// start with a schema version header or a JSON value, so they're
+// never mistaken for encrypted ones.
+const encryptedPrefix = "enc1:"
+
+// keyIDLen is the length of the key ID following encryptedPrefix.
+const keyIDLen = 4
+
+// ErrEncryptionKey is returned, wrapped, when a stored value can't
+// be decrypted with the configured keys.
+var ErrEncryptionKey = errors.New("wrong encryption key")
+
+// Keyring holds the AES-256 keys a PebbleStore encrypts values
+// with. The first key encrypts new values, and every key decrypts,
+// so values encrypted with an old key remain readable until Rekey
+// re-encrypts them. A nil *Keyring leaves values unencrypted.
+type Keyring struct {
+	keys []keyringKey
+}
+
+type keyringKey struct {
+	id   [keyIDLen]byte // identifies the key in the values it encrypted
+	aead cipher.AEAD
+}
+
+// ParseKeyring parses a keyring from AES-256 keys, each 32 bytes
+// encoded in hex or base64 and separated by commas or newlines.
+// Blank lines and lines starting with # are ignored.
+func ParseKeyring(s string) (*Keyring, error) {
+	var kr Keyring
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			key, err := decodeKey(field)
+			if err != nil {
+				return nil, fmt.Errorf("encryption key %d: %w", len(kr.keys)+1, err)
+			}
+			k, err := newKeyringKey(key)
+			if err != nil {
+				return nil, err
+			}
+			kr.keys = append(kr.keys, k)
+		}
+	}
+	if len(kr.keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+	return &kr, nil
+}
+
+// ReadKeyring parses the keyring in the named file with
+// ParseKeyring.
+func ReadKeyring(path string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := ParseKeyring(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return kr, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	for _, decode := range []func(string) ([]byte, error){
+		hex.DecodeString,
+		base64.StdEncoding.DecodeString,
+		base64.RawStdEncoding.DecodeString,
+		base64.URLEncoding.DecodeString,
+		base64.RawURLEncoding.DecodeString,
+	} {
+		if key, err := decode(s); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	return nil, errors.New("not a 32-byte key in hex or base64")
+}
+
+func newKeyringKey(key []byte) (keyringKey, error) {
+	var k keyringKey
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return k, err
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		return k, err
+	}
+	sum := sha256.Sum256(key)
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// KeyIDs returns the hex IDs of the keys, starting with the one
+// that encrypts new values. The ID is a prefix of the key's
+// SHA-256, and is stored with every value the key encrypts.
+func (kr *Keyring) KeyIDs() []string {
+	if kr == nil {
+		return nil
+	}
+	ids := make([]string, len(kr.keys))
+	for i, k := range kr.keys {
+		ids[i] = hex.EncodeToString(k.id[:])
+	}
+	return ids
+}
+
+// seal encrypts value with the first key, authenticating ad with
+// it. It returns value unchanged if kr is nil.
+func (kr *Keyring) seal(value, ad []byte) []byte {
+	if kr == nil {
+		return value
+	}
+	k := kr.keys[0]
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		// crypto/rand doesn't fail on the platforms we support.
+		panic(err)
+	}
+	sealed := make([]byte, 0, len(encryptedPrefix)+keyIDLen+len(nonce)+len(value)+k.aead.Overhead())
+	sealed = append(sealed, encryptedPrefix...)
+	sealed = append(sealed, k.id[:]...)
+	sealed = append(sealed, nonce...)
+	return k.aead.Seal(sealed, nonce, value, ad)
+}
+
+// open decrypts a value sealed with ad by a key in kr. It returns
+// unencrypted values unchanged, so that stores written before
+// encryption was enabled remain readable.
+func (kr *Keyring) open(value, ad []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(encryptedPrefix)) {
+		return value, nil
+	}
+	rest := value[len(encryptedPrefix):]
+	if len(rest) < keyIDLen {
+		return nil, errors.New("truncated encrypted value")
+	}
+	id, rest := rest[:keyIDLen], rest[keyIDLen:]
+	if kr == nil {
+		return nil, fmt.Errorf("%w: value is encrypted with key %x, and no key is configured", ErrEncryptionKey, id)
+	}
+	for _, k := range kr.keys {
+		if !bytes.Equal(k.id[:], id) {
+			continue
+		}
+		if len(rest) < k.aead.NonceSize() {
+			return nil, errors.New("truncated encrypted value")
+		}
+		nonce, ciphertext := rest[:k.aead.NonceSize()], rest[k.aead.NonceSize():]
+		plaintext, err := k.aead.Open(nil, nonce, ciphertext, ad)
+		if err != nil {
+			return nil, fmt.Errorf("%w: value doesn't authenticate with key %x", ErrEncryptionKey, id)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("%w: value is encrypted with key %x, which isn't configured", ErrEncryptionKey, id)
+}
+
+// current reports whether value is encrypted with the key that
+// encrypts new values.
+func (kr *Keyring) current(value []byte) bool {
+	if kr == nil {
+		return !bytes.HasPrefix(value, []byte(encryptedPrefix))
+	}
+	return bytes.HasPrefix(value, []byte(encryptedPrefix)) &&
+		bytes.HasPrefix(value[len(encryptedPrefix):], kr.keys[0].id[:])
+}
@@ -0,0 +1,173 @@
+package codenames
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testKey returns a key of 32 copies of b, hex-encoded.
+func testKey(b byte) string {
+	return hex.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func testKeyring(t *testing.T, keys ...string) *Keyring {
+	t.Helper()
+	kr, err := ParseKeyring(strings.Join(keys, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestParseKeyring(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	kr, err := ParseKeyring("# the current key\n" + testKey(1) + "\n\n" + b64 + ", " + testKey(3) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := kr.KeyIDs()
+	if len(ids) != 3 || ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Errorf("key IDs = %v", ids)
+	}
+	if same := testKeyring(t, testKey(1)).KeyIDs(); same[0] != ids[0] {
+		t.Errorf("key ID %s, then %s", ids[0], same[0])
+	}
+	for _, s := range []string{"", "# none", "abcd", testKey(1) + ",zz", hex.EncodeToString(make([]byte, 16))} {
+		if _, err := ParseKeyring(s); err == nil {
+			t.Errorf("parsing %q succeeded", s)
+		}
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	ps := openTestStore(t)
+	ps.Keys = testKeyring(t, testKey(1))
+	id, custom, err := canonicalizeWords(words[:40])
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := randomState(custom)
+	state.WordSetID = id.String()
+	if err := ps.Save(newGame("custom", state, GameOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range randomGames(3) {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither games nor word sets are saved in the clear.
+	iter := ps.DB.NewIter(nil)
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		if bytes.HasPrefix(iter.Key(), []byte(gameIDsPrefix)) || bytes.Equal(iter.Key(), probeKey) {
+			continue
+		}
+		if !bytes.HasPrefix(iter.Value(), []byte(encryptedPrefix)) || bytes.Contains(iter.Value(), []byte(custom[0])) {
+			t.Errorf("%s is saved unencrypted", iter.Key())
+		}
+	}
+	iter.Close()
+
+	games, err := ps.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 4 || strings.Join(games["custom"].WordSet, " ") != strings.Join(custom, " ") {
+		t.Errorf("restored %d games, custom with words %v", len(games), games["custom"].WordSet)
+	}
+
+	// Reopening the store without the key, or with another, fails.
+	for _, keys := range []*Keyring{nil, testKeyring(t, testKey(2))} {
+		other := &PebbleStore{DB: ps.DB, Keys: keys}
+		if _, err := other.Restore(); !errors.Is(err, ErrEncryptionKey) {
+			t.Errorf("restoring with keys %v: %v", keys.KeyIDs(), err)
+		}
+		if _, err := other.Get("custom"); !errors.Is(err, ErrEncryptionKey) {
+			t.Errorf("getting a game with keys %v: %v", keys.KeyIDs(), err)
+		}
+	}
+
+	// A value is bound to its key.
+	v, closer, err := ps.DB.Get(mkkey(games["custom"].CreatedAt.Unix(), "custom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := mkkey(0, "moved")
+	if err := ps.DB.Set(moved, v, nil); err != nil {
+		t.Fatal(err)
+	}
+	closer.Close()
+	if _, err := ps.unmarshalGame(moved, v); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("decoding a moved value: %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	ps := openTestStore(t)
+	id, custom, err := canonicalizeWords(words[:40])
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := randomState(custom)
+	state.WordSetID = id.String()
+	if err := ps.Save(newGame("custom", state, GameOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range randomGames(3) {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ps.Rekey(false); err == nil {
+		t.Error("rekeyed without a key")
+	}
+
+	// Games saved before encryption was enabled remain readable,
+	// until Rekey encrypts them.
+	old := &PebbleStore{DB: ps.DB, Keys: testKeyring(t, testKey(1))}
+	if games, err := old.Restore(); err != nil || len(games) != 4 {
+		t.Fatalf("restoring unencrypted games: %d, %v", len(games), err)
+	}
+	report, err := old.Rekey(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != (RekeyReport{Values: 5, Rewritten: 5}) {
+		t.Errorf("dry run report = %+v", report)
+	}
+	if report, err = old.Rekey(false); err != nil || report.Rewritten != 5 {
+		t.Fatalf("rekey = %+v, %v", report, err)
+	}
+	if _, err := ps.Restore(); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("restoring rekeyed games without a key: %v", err)
+	}
+
+	// Rotating keys: the new key encrypts, the old one still
+	// decrypts, and once Rekey is done the old one is retired.
+	rotating := &PebbleStore{DB: ps.DB, Keys: testKeyring(t, testKey(2), testKey(1))}
+	if games, err := rotating.Restore(); err != nil || len(games) != 4 {
+		t.Fatalf("restoring while rotating keys: %d, %v", len(games), err)
+	}
+	if report, err = rotating.Rekey(false); err != nil || report.Rewritten != 5 {
+		t.Fatalf("rekey = %+v, %v", report, err)
+	}
+	if report, err = rotating.Rekey(false); err != nil || report.Rewritten != 0 {
+		t.Errorf("second rekey = %+v, %v", report, err)
+	}
+	rotated := &PebbleStore{DB: ps.DB, Keys: testKeyring(t, testKey(2))}
+	games, err := rotated.Restore()
+	if err != nil || len(games) != 4 {
+		t.Fatalf("restoring with the new key: %d, %v", len(games), err)
+	}
+	if strings.Join(games["custom"].WordSet, " ") != strings.Join(custom, " ") {
+		t.Errorf("custom game has words %v", games["custom"].WordSet)
+	}
+	if _, err := old.Restore(); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("restoring with the retired key: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package codenames
 
 import (
+	"errors"
 	"math/rand"
 	"net/http"
 	"path/filepath"
@@ -11,31 +12,49 @@ const tpl = `
 <!DOCTYPE html>
 <html>
     <head>
-        <title>Codenames - Play Online</title>
-        <script src="/static/app.js?v=0.02" type="text/javascript"></script>
+        <title>{{.Page.Title}} - Play Online</title>
+        <script src="{{static "app.js"}}" type="text/javascript"></script>
+        {{if eq .Page.Fonts "google"}}
         <link href="https://fonts.googleapis.com/css?family=Roboto" rel="stylesheet">
-        <link rel="stylesheet" type="text/css" href="/static/game.css" />
-        <link rel="stylesheet" type="text/css" href="/static/lobby.css" />
+        {{else if eq .Page.Fonts "self-hosted"}}
+        <link href="/fonts/fonts.css" rel="stylesheet">
+        {{end}}
+        <link rel="stylesheet" type="text/css" href="{{static "game.css"}}" />
+        <link rel="stylesheet" type="text/css" href="{{static "lobby.css"}}" />
+        <style nonce="{{.Nonce}}">
+            :root {
+                --red: {{.Page.Colors.Red}};
+                --blue: {{.Page.Colors.Blue}};
+            }
+        </style>
         <link rel="shortcut icon" type="image/png" id="favicon" href="data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAACXBIWXMAAAsTAAALEwEAmpwYAAAAAXNSR0IArs4c6QAAAARnQU1BAACxjwv8YQUAAAA8SURBVHgB7dHBDQAgCAPA1oVkBWdzPR84kW4AD0LCg36bXJqUcLL2eVY/EEwDFQBeEfPnqUpkLmigAvABK38Grs5TfaMAAAAASUVORK5CYII="/>
 
-        <script type="text/javascript">
+        <script type="text/javascript" nonce="{{.Nonce}}">
              {{if .SelectedGameID}}
              window.selectedGameID = "{{.SelectedGameID}}";
              {{end}}
+             {{if .SpectatorToken}}
+             window.spectatorToken = "{{.SpectatorToken}}";
+             {{end}}
              window.autogeneratedGameID = "{{.AutogeneratedGameID}}";
+             window.siteTitle = "{{.Page.Title}}";
+             {{if .Page.LogoURL}}
+             window.siteLogoURL = "{{.Page.LogoURL}}";
+             {{end}}
+        </script>
+        {{if eq .Page.Analytics.Provider "google"}}
+        <script async nonce="{{.Nonce}}" src="https://www.googletagmanager.com/gtag/js?id={{.Page.Analytics.ID}}"></script>
+        <script nonce="{{.Nonce}}">
+            window.dataLayer = window.dataLayer || [];
+            function gtag(){dataLayer.push(arguments);}
+            gtag('js', new Date());
+            gtag('config', '{{.Page.Analytics.ID}}');
         </script>
+        {{else if eq .Page.Analytics.Provider "plausible"}}
+        <script defer nonce="{{.Nonce}}" data-domain="{{.Page.Analytics.ID}}" src="{{.Page.Analytics.ScriptURL}}"></script>
+        {{end}}
     </head>
     <body>
-		<script>
-		  (function(i,s,o,g,r,a,m){i['GoogleAnalyticsObject']=r;i[r]=i[r]||function(){
-		  (i[r].q=i[r].q||[]).push(arguments)},i[r].l=1*new Date();a=s.createElement(o),
-		  m=s.getElementsByTagName(o)[0];a.async=1;a.src=g;m.parentNode.insertBefore(a,m)
-		  })(window,document,'script','https://www.google-analytics.com/analytics.js','ga');
-
-		  ga('create', 'UA-88084599-2', 'auto');
-		  ga('send', 'pageview');
-
-		</script>
 		<div id="app">
 		</div>
     </body>
@@ -45,6 +64,9 @@ const tpl = `
 type templateParameters struct {
 	SelectedGameID      string
 	AutogeneratedGameID string
+	SpectatorToken      string
+	Page                PageOptions
+	Nonce               string
 }
 
 func (s *Server) handleIndex(rw http.ResponseWriter, req *http.Request) {
@@ -54,23 +76,24 @@ func (s *Server) handleIndex(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	autogeneratedID := s.getAutogeneratedID()
+	autogeneratedID, err := s.getAutogeneratedID()
+	if err != nil {
+		logger(req).Error("unable to check whether a game ID is taken", "err", err)
+		http.Error(rw, "Unable to generate a game ID", 500)
+		return
+	}
 
-	err := s.tpl.Execute(rw, templateParameters{
+	s.renderPage(rw, templateParameters{
 		SelectedGameID:      id,
 		AutogeneratedGameID: autogeneratedID,
 	})
-	if err != nil {
-		http.Error(rw, "error rendering", http.StatusInternalServerError)
-	}
 }
 
-func (s *Server) getAutogeneratedID() string {
+// getAutogeneratedID returns a random game ID that isn't taken,
+// or an error if the store can't tell whether an ID is.
+func (s *Server) getAutogeneratedID() (string, error) {
 	const attemptsPerWordCount = 5
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	var words []string
 	autogeneratedID := ""
 	for i := 0; ; i++ {
@@ -83,9 +106,17 @@ func (s *Server) getAutogeneratedID() string {
 		}
 
 		autogeneratedID = strings.Join(words, "-")
-		if _, ok := s.games[autogeneratedID]; !ok {
-			break
+		s.mu.Lock()
+		_, ok := s.games[autogeneratedID]
+		s.mu.Unlock()
+		if ok {
+			continue
+		}
+		_, err := s.store.Get(autogeneratedID)
+		if errors.Is(err, ErrGameNotFound) {
+			return autogeneratedID, nil
+		} else if err != nil {
+			return "", err
 		}
 	}
-	return autogeneratedID
 }
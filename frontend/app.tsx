@@ -18,7 +18,9 @@ export class App extends React.Component {
 
   render() {
     let pane;
-    if (this.state.gameID) {
+    if (window.spectatorToken) {
+      pane = <Game spectatorToken={window.spectatorToken} />;
+    } else if (this.state.gameID) {
       pane = <Game gameID={this.state.gameID} />;
     } else {
       pane = <Lobby defaultGameID={window.autogeneratedGameID} />;
@@ -28,7 +30,13 @@ export class App extends React.Component {
       <div id="application">
         <div id="topbar">
           <h1>
-            <a href={'http://' + window.location.host}>Codenames</a>
+            <a href={'//' + window.location.host}>
+              {window.siteLogoURL ? (
+                <img src={window.siteLogoURL} alt={window.siteTitle} />
+              ) : (
+                window.siteTitle || 'Codenames'
+              )}
+            </a>
           </h1>
         </div>
         {pane}
@@ -1,4 +1,4 @@
 #!/bin/bash
 set -ex
-rm -rf ./dist
+find ./dist -mindepth 1 ! -name README.md -delete
 parcel build app.tsx game.css lobby.css
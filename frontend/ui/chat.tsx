@@ -0,0 +1,69 @@
+import * as React from 'react';
+import axios from 'axios';
+
+const Chat = ({ gameID, messages, channel, team, readOnly, onUpdate }) => {
+  const [author, setAuthor] = React.useState(
+    localStorage.getItem('chatAuthor') || ''
+  );
+  const [text, setText] = React.useState('');
+
+  const send = (e) => {
+    e.preventDefault();
+    if (!author.trim() || !text.trim()) {
+      return;
+    }
+    localStorage.setItem('chatAuthor', author);
+    axios
+      .post('/chat', {
+        game_id: gameID,
+        channel: channel,
+        author: author,
+        team: team,
+        text: text,
+      })
+      .then(({ data }) => {
+        setText('');
+        onUpdate(data);
+      });
+  };
+
+  return (
+    <div className={'chat' + (channel ? ' chat-' + channel : '')}>
+      <ul className="chat-messages" aria-live="polite">
+        {(messages || []).map((m, idx) => (
+          <li
+            key={idx}
+            className={
+              (m.author ? 'player-message ' : 'system-message ') + m.team
+            }
+          >
+            {m.author && <span className="chat-author">{m.author}: </span>}
+            {m.text}
+          </li>
+        ))}
+      </ul>
+      {!readOnly && (
+        <form className="chat-form" onSubmit={send}>
+          <input
+            type="text"
+            className="chat-author-input"
+            placeholder="Name"
+            aria-label="your name"
+            value={author}
+            onChange={(e) => setAuthor(e.target.value)}
+          />
+          <input
+            type="text"
+            className="chat-text-input"
+            placeholder={channel ? 'Message spymasters' : 'Message'}
+            aria-label="chat message"
+            value={text}
+            onChange={(e) => setText(e.target.value)}
+          />
+        </form>
+      )}
+    </div>
+  );
+};
+
+export default Chat;
@@ -2,6 +2,7 @@ import * as React from 'react';
 import axios from 'axios';
 import { Settings, SettingsButton, SettingsPanel } from '~/ui/settings';
 import Timer from '~/ui/timer';
+import Chat from '~/ui/chat';
 
 const defaultFavicon =
   'data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAACXBIWXMAAAsTAAALEwEAmpwYAAAAAXNSR0IArs4c6QAAAARnQU1BAACxjwv8YQUAAAA8SURBVHgB7dHBDQAgCAPA1oVkBWdzPR84kW4AD0LCg36bXJqUcLL2eVY/EEwDFQBeEfPnqUpkLmigAvABK38Grs5TfaMAAAAASUVORK5CYII=';
@@ -142,9 +143,12 @@ export class Game extends React.Component {
       state_id = this.state.game.state_id;
     }
 
+    const request = this.props.spectatorToken
+      ? { spectator_token: this.props.spectatorToken }
+      : { game_id: this.props.gameID };
     axios
       .post('/game-state', {
-        game_id: this.props.gameID,
+        ...request,
         state_id: state_id,
       })
       .then(({ data }) => {
@@ -170,6 +174,9 @@ export class Game extends React.Component {
 
   public guess(e, idx) {
     e.preventDefault();
+    if (this.props.spectatorToken) {
+      return; // spectators can't guess
+    }
     if (this.state.codemaster && !this.state.settings.spymasterMayGuess) {
       return; // ignore if player is the codemaster
     }
@@ -211,6 +218,9 @@ export class Game extends React.Component {
   }
 
   public endTurn() {
+    if (this.props.spectatorToken) {
+      return;
+    }
     axios
       .post('/end-turn', {
         game_id: this.state.game.id,
@@ -288,8 +298,14 @@ export class Game extends React.Component {
       status = this.currentTeam() + "'s turn";
     }
 
+    const spectating = !!this.props.spectatorToken;
+
     let endTurnButton;
-    if (!this.state.game.winning_team && !this.state.codemaster) {
+    if (
+      !this.state.game.winning_team &&
+      !this.state.codemaster &&
+      !spectating
+    ) {
       endTurnButton = (
         <div id="end-turn-cont">
           <button
@@ -309,7 +325,7 @@ export class Game extends React.Component {
     }
 
     let shareLink = null;
-    if (!this.state.settings.fullscreen) {
+    if (!this.state.settings.fullscreen && !spectating) {
       shareLink = (
         <div id="share">
           Send this link to friends:&nbsp;
@@ -413,18 +429,40 @@ export class Game extends React.Component {
           >
             Player
           </button>
-          <button
-            onClick={(e) => this.toggleRole(e, 'codemaster')}
-            className="codemaster"
-            role="radio"
-            aria-checked={this.state.codemaster}
-          >
-            Spymaster
-          </button>
-          <button onClick={(e) => this.nextGame(e)} id="next-game-btn">
-            Next game
-          </button>
+          {(!spectating || this.state.game.spymaster) && (
+            <button
+              onClick={(e) => this.toggleRole(e, 'codemaster')}
+              className="codemaster"
+              role="radio"
+              aria-checked={this.state.codemaster}
+            >
+              Spymaster
+            </button>
+          )}
+          {!spectating && (
+            <button onClick={(e) => this.nextGame(e)} id="next-game-btn">
+              Next game
+            </button>
+          )}
         </form>
+        <Chat
+          gameID={this.state.game.id}
+          messages={this.state.game.messages}
+          channel=""
+          team={this.currentTeam()}
+          readOnly={spectating}
+          onUpdate={(game) => this.setState({ game: game })}
+        />
+        {this.state.codemaster && (
+          <Chat
+            gameID={this.state.game.id}
+            messages={this.state.game.spymaster_messages}
+            channel="spymaster"
+            team={this.currentTeam()}
+            readOnly={spectating}
+            onUpdate={(game) => this.setState({ game: game })}
+          />
+        )}
         <div id="coffee">
           <a href="https://www.buymeacoffee.com/jbowens" target="_blank">
             Buy the developer a coffee.
@@ -49,17 +49,22 @@ func (t *Team) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	*t = parseTeam(s)
+	return nil
+}
+
+// parseTeam returns the team named s, as returned by Team.String.
+func parseTeam(s string) Team {
 	switch s {
 	case "red":
-		*t = Red
+		return Red
 	case "blue":
-		*t = Blue
+		return Blue
 	case "black":
-		*t = Black
+		return Black
 	default:
-		*t = Neutral
+		return Neutral
 	}
-	return nil
 }
 
 func (t Team) MarshalJSON() ([]byte, error) {
@@ -83,6 +88,9 @@ type GameState struct {
 	Round     int      `json:"round"`
 	Revealed  []bool   `json:"revealed"`
 	WordSet   []string `json:"word_set"`
+	// WordSetID identifies WordSet, if it was canonicalized by
+	// WordSets. Stores may save the set once under its ID.
+	WordSetID string `json:"word_set_id,omitempty"`
 }
 
 func (gs GameState) anyRevealed() bool {
@@ -125,7 +133,28 @@ type Game struct {
 	Words          []string  `json:"words"`
 	Layout         []Team    `json:"layout"`
 	RoundStartedAt time.Time `json:"round_started_at,omitempty"`
+	Events         []Event   `json:"events,omitempty"`
 	GameOptions
+	Chat
+}
+
+type EventType string
+
+const (
+	EventGuess   EventType = "guess"
+	EventEndTurn EventType = "end_turn"
+	EventEndGame EventType = "end_game"
+)
+
+// Event records a single change made to a game by its players.
+// A game's events are enough to replay it from its initial
+// state, which lets us compute views of the game as it was at
+// an earlier point in time.
+type Event struct {
+	Type  EventType `json:"type"`
+	Team  Team      `json:"team"`
+	Index int       `json:"index,omitempty"`
+	At    time.Time `json:"at"`
 }
 
 type GameOptions struct {
@@ -134,7 +163,19 @@ type GameOptions struct {
 }
 
 func (g *Game) StateID() string {
-	return fmt.Sprintf("%019d", g.UpdatedAt.UnixNano())
+	changedAt := g.UpdatedAt
+	// Notices are posted without updating the game.
+	for _, msgs := range [][]Message{g.Messages, g.SpymasterMessages} {
+		if n := len(msgs); n > 0 && msgs[n-1].At.After(changedAt) {
+			changedAt = msgs[n-1].At
+		}
+	}
+	return stateIDAt(changedAt)
+}
+
+// stateIDAt returns the state ID of a game last changed at t.
+func stateIDAt(t time.Time) string {
+	return fmt.Sprintf("%019d", t.UnixNano())
 }
 
 func (g *Game) checkWinningCondition() {
@@ -164,6 +205,15 @@ func (g *Game) checkWinningCondition() {
 }
 
 func (g *Game) NextTurn(currentTurn int) bool {
+	team := g.currentTeam()
+	if !g.nextTurn(currentTurn, time.Now()) {
+		return false
+	}
+	g.announce(team, "%s ended their turn", capitalize(team.String()))
+	return true
+}
+
+func (g *Game) nextTurn(currentTurn int, now time.Time) bool {
 	if g.WinningTeam != nil {
 		return false
 	}
@@ -172,20 +222,34 @@ func (g *Game) NextTurn(currentTurn int) bool {
 	if g.Round != currentTurn && currentTurn != 0 {
 		return false
 	}
-	g.UpdatedAt = time.Now()
+	g.Events = append(g.Events, Event{Type: EventEndTurn, Team: g.currentTeam(), At: now})
+	g.UpdatedAt = now
 	g.Round++
-	g.RoundStartedAt = time.Now()
+	g.RoundStartedAt = now
 	return true
 }
 
 func (g *Game) Guess(idx int) error {
+	team := g.currentTeam()
+	if err := g.guess(idx, time.Now()); err != nil {
+		return err
+	}
+	g.announce(team, "%s revealed %s", capitalize(team.String()), g.Words[idx])
+	if g.WinningTeam != nil {
+		g.announce(*g.WinningTeam, "%s wins!", capitalize(g.WinningTeam.String()))
+	}
+	return nil
+}
+
+func (g *Game) guess(idx int, now time.Time) error {
 	if idx > len(g.Layout) || idx < 0 {
 		return fmt.Errorf("index %d is invalid", idx)
 	}
 	if g.Revealed[idx] {
 		return errors.New("cell has already been revealed")
 	}
-	g.UpdatedAt = time.Now()
+	g.Events = append(g.Events, Event{Type: EventGuess, Team: g.currentTeam(), Index: idx, At: now})
+	g.UpdatedAt = now
 	g.Revealed[idx] = true
 
 	if g.Layout[idx] == Black {
@@ -197,11 +261,79 @@ func (g *Game) Guess(idx int) error {
 	g.checkWinningCondition()
 	if g.Layout[idx] != g.currentTeam() {
 		g.Round = g.Round + 1
-		g.RoundStartedAt = time.Now()
+		g.RoundStartedAt = now
 	}
 	return nil
 }
 
+// End ends the game early, declaring winner the winning team. It
+// returns false if the game has already been won.
+func (g *Game) End(winner Team) bool {
+	if !g.end(winner, time.Now()) {
+		return false
+	}
+	g.announce(winner, "The game was ended. %s wins!", capitalize(winner.String()))
+	return true
+}
+
+func (g *Game) end(winner Team, now time.Time) bool {
+	if g.WinningTeam != nil {
+		return false
+	}
+	g.Events = append(g.Events, Event{Type: EventEndGame, Team: winner, At: now})
+	g.UpdatedAt = now
+	g.WinningTeam = &winner
+	return true
+}
+
+// viewAt returns a copy of the game as it was at time t,
+// computed by replaying the game's events up to t.
+func (g *Game) viewAt(t time.Time) *Game {
+	v := *g
+	v.Revealed = make([]bool, len(g.Revealed))
+	v.Round = 0
+	v.WinningTeam = nil
+	v.UpdatedAt = g.CreatedAt
+	v.RoundStartedAt = g.CreatedAt
+	v.Events = make([]Event, 0, len(g.Events))
+	v.Chat = g.Chat.before(t)
+	for _, e := range g.Events {
+		if e.At.After(t) {
+			break
+		}
+		switch e.Type {
+		case EventGuess:
+			v.guess(e.Index, e.At)
+		case EventEndTurn:
+			v.nextTurn(v.Round, e.At)
+		case EventEndGame:
+			v.end(e.Team, e.At)
+		}
+	}
+	return &v
+}
+
+// replayable reports whether replaying the game's events reproduces
+// its current state. Games saved before events were recorded
+// aren't, if they were under way at the time.
+func (g *Game) replayable() bool {
+	t := g.CreatedAt
+	if n := len(g.Events); n > 0 {
+		t = g.Events[n-1].At
+	}
+	v := g.viewAt(t)
+	if v.Round != g.Round || (v.WinningTeam == nil) != (g.WinningTeam == nil) ||
+		v.WinningTeam != nil && *v.WinningTeam != *g.WinningTeam {
+		return false
+	}
+	for i, revealed := range g.Revealed {
+		if v.Revealed[i] != revealed {
+			return false
+		}
+	}
+	return true
+}
+
 func (g *Game) currentTeam() Team {
 	if g.Round%2 == 0 {
 		return g.StartingTeam
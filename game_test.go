@@ -2,9 +2,12 @@ package codenames
 
 import (
 	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/jbowens/dictionary"
+	"github.com/kr/pretty"
 )
 
 var testWords []string
@@ -56,3 +59,42 @@ func TestGameShuffle(t *testing.T) {
 		currState = nextGameState(currState)
 	}
 }
+
+func TestGameViewAt(t *testing.T) {
+	g := newGame("foo", randomState(testWords), GameOptions{})
+	start := g.CreatedAt
+
+	// Reveal one of the starting team's words, then end the turn.
+	var idx int
+	for i, team := range g.Layout {
+		if team == g.StartingTeam {
+			idx = i
+			break
+		}
+	}
+	if err := g.guess(idx, start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !g.nextTurn(g.Round, start.Add(2*time.Minute)) {
+		t.Fatal("unable to end turn")
+	}
+
+	v := g.viewAt(start.Add(30 * time.Second))
+	if v.anyRevealed() || v.Round != 0 || len(v.Events) != 0 {
+		t.Errorf("view before any events: revealed=%v round=%d events=%d", v.Revealed, v.Round, len(v.Events))
+	}
+	if v.StateID() == g.StateID() {
+		t.Errorf("view before any events has current state ID %s", v.StateID())
+	}
+
+	v = g.viewAt(start.Add(90 * time.Second))
+	if !v.Revealed[idx] || v.Round != 0 || len(v.Events) != 1 {
+		t.Errorf("view after guess: revealed=%v round=%d events=%d", v.Revealed, v.Round, len(v.Events))
+	}
+
+	v = g.viewAt(start.Add(time.Hour))
+	if !reflect.DeepEqual(v.GameState, g.GameState) || v.StateID() != g.StateID() {
+		t.Errorf("view after all events doesn't match game: %s, %s",
+			pretty.Sprint(v.GameState), pretty.Sprint(g.GameState))
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/jbowens/codenames
 
-go 1.13
+go 1.16
 
 require (
 	github.com/certifi/gocertifi v0.0.0-20200211180108-c7c1fbc02894 // indirect
@@ -13,4 +13,6 @@ require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/pkg/errors v0.9.1
 	golang.org/x/exp v0.0.0-20201229011636-eab1b5eb1a03 // indirect
+	gopkg.in/yaml.v2 v2.4.0
+	modernc.org/sqlite v1.21.0
 )
@@ -0,0 +1,93 @@
+package codenames
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// probeTimeout bounds how long a readiness check waits for the
+// Store to respond.
+const probeTimeout = 5 * time.Second
+
+// prober is implemented by stores that can check that they're
+// able to write and read back data, such as *PebbleStore.
+type prober interface {
+	Probe() error
+}
+
+type check struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readyResponse struct {
+	Ready  bool             `json:"ready"`
+	Checks map[string]check `json:"checks"`
+}
+
+// handleHealthz reports that the process is alive. It doesn't
+// touch any shared state, so it keeps responding while the server
+// is busy.
+func (s *Server) handleHealthz(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, check{OK: true})
+}
+
+// handleReadyz reports whether the server is able to serve games:
+// it isn't shutting down, its assets are loaded and its Store
+// accepts a probe write and read.
+func (s *Server) handleReadyz(rw http.ResponseWriter, req *http.Request) {
+	resp := readyResponse{Ready: true, Checks: map[string]check{}}
+	record := func(name string, err error) {
+		c := check{OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			resp.Ready = false
+		}
+		resp.Checks[name] = c
+	}
+
+	select {
+	case <-s.shuttingDown():
+		record("shutdown", errShuttingDown)
+	default:
+		record("shutdown", nil)
+	}
+	record("assets", s.checkAssets())
+	record("store", s.probeStore())
+
+	if !resp.Ready {
+		logger(req).Warn("not ready", "checks", resp.Checks)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(rw, resp)
+}
+
+var errShuttingDown = errors.New("server is shutting down")
+
+func (s *Server) checkAssets() error {
+	if s.tpl == nil || s.assets == nil || len(s.defaultWords) == 0 {
+		return errors.New("templates or word lists not loaded")
+	}
+	_, err := fs.Stat(s.assets.static, "app.js")
+	return err
+}
+
+// probeStore checks that the store can write and read back data,
+// if it supports doing so.
+func (s *Server) probeStore() error {
+	p, ok := s.Store.(prober)
+	if !ok {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- p.Probe() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(probeTimeout):
+		return errors.New("timed out probing store")
+	}
+}
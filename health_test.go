@@ -0,0 +1,61 @@
+package codenames
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type probeStore struct {
+	discardStore
+	err error
+}
+
+func (ps probeStore) Probe() error { return ps.err }
+
+func readyz(t *testing.T, s *Server) (int, readyResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	var resp readyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, resp
+}
+
+func TestReadyz(t *testing.T) {
+	s := newTestServer()
+	s.Store = probeStore{}
+	if _, resp := readyz(t, s); !resp.Checks["store"].OK || !resp.Checks["shutdown"].OK {
+		t.Errorf("got checks %+v, want store and shutdown ok", resp.Checks)
+	}
+
+	s.Store = probeStore{err: errors.New("disk full")}
+	code, resp := readyz(t, s)
+	if code != http.StatusServiceUnavailable || resp.Ready {
+		t.Errorf("got status %d, ready %t with a failing store", code, resp.Ready)
+	}
+	if c := resp.Checks["store"]; c.OK || c.Error != "disk full" {
+		t.Errorf("got store check %+v", c)
+	}
+
+	s.Store = probeStore{}
+	s.Shutdown(context.Background())
+	code, resp = readyz(t, s)
+	if code != http.StatusServiceUnavailable || resp.Checks["shutdown"].OK {
+		t.Errorf("got status %d, checks %+v while shutting down", code, resp.Checks)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	s := newTestServer()
+	rec := httptest.NewRecorder()
+	s.handleHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,225 @@
+package codenames
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	gamesPrefix    = "/games/"
+	gameIDsPrefix  = "/game-ids/"
+	wordSetsPrefix = "/wordsets/"
+)
+
+// indexKey returns the key of the index entry for a game ID. Its
+// value is the game's primary key.
+func indexKey(id string) []byte {
+	return []byte(gameIDsPrefix + strconv.Quote(id))
+}
+
+// parseKey returns the game ID from a primary key, formatted by
+// mkkey as `/games/<created at>/<quoted id>`.
+func parseKey(k []byte) (string, error) {
+	const idOffset = len(gamesPrefix) + 19 + 1
+	if len(k) <= idOffset || !bytes.HasPrefix(k, []byte(gamesPrefix)) {
+		return "", fmt.Errorf("malformed game key %q", k)
+	}
+	return strconv.Unquote(string(k[idOffset:]))
+}
+
+// lookup returns the primary key of the game with the given ID.
+func (ps *PebbleStore) lookup(id string) ([]byte, error) {
+	v, closer, err := ps.DB.Get(indexKey(id))
+	if err == pebble.ErrNotFound {
+		return nil, ErrGameNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("db.Get: %w", err)
+	}
+	defer closer.Close()
+	return append([]byte(nil), v...), nil
+}
+
+// deleteLocked adds the deletion of the game stored under primary
+// key k to b, along with its index entry if the entry points to k.
+// ps.indexMu must be held until b is committed.
+func (ps *PebbleStore) deleteLocked(b *pebble.Batch, id string, k []byte) error {
+	if err := b.Delete(k, nil); err != nil {
+		return err
+	}
+	target, err := ps.lookup(id)
+	if err == ErrGameNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if bytes.Equal(target, k) {
+		return b.Delete(indexKey(id), nil)
+	}
+	return nil
+}
+
+// IndexReport describes the problems found by CheckIndex.
+type IndexReport struct {
+	// Games is the number of distinct game IDs stored.
+	Games int
+	// Missing counts games without an index entry.
+	Missing int
+	// Stale counts index entries that point to an older game
+	// with the same ID than the most recently created one.
+	Stale int
+	// Orphaned counts index entries that point to no game.
+	Orphaned int
+	// Superseded counts games that have been replaced by a more
+	// recently created game with the same ID, and so can't be
+	// found through the index. CheckIndex only reports them;
+	// DeleteSuperseded deletes them.
+	Superseded int
+}
+
+// OK returns true if no problems were found.
+func (r IndexReport) OK() bool {
+	return r.IndexOK() && r.Superseded == 0
+}
+
+// IndexOK returns true if the index itself has no problems.
+func (r IndexReport) IndexOK() bool {
+	return r.Missing == 0 && r.Stale == 0 && r.Orphaned == 0
+}
+
+// CheckIndex verifies that the `/game-ids/` index points every game
+// ID at the most recently created game with that ID, and that it
+// has no entries for games that don't exist. If repair is true, it
+// fixes the index entries. It never deletes games.
+func (ps *PebbleStore) CheckIndex(repair bool) (IndexReport, error) {
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+
+	var report IndexReport
+	b := ps.DB.NewBatch()
+	defer b.Close()
+
+	// Primary keys sort by creation time, so the last key seen for
+	// each ID is the most recent.
+	latest := make(map[string][]byte)
+	iter := ps.DB.NewIter(gamesIterOptions())
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		k := append([]byte(nil), iter.Key()...)
+		id, err := parseKey(k)
+		if err != nil {
+			iter.Close()
+			return report, err
+		}
+		if _, ok := latest[id]; ok {
+			report.Superseded++
+		}
+		latest[id] = k
+	}
+	if err := iter.Error(); err != nil {
+		iter.Close()
+		return report, fmt.Errorf("games iter: %w", err)
+	}
+	iter.Close()
+	report.Games = len(latest)
+
+	indexed := make(map[string]bool, len(latest))
+	iter = ps.DB.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(gameIDsPrefix),
+		UpperBound: prefixEnd([]byte(gameIDsPrefix)),
+	})
+	defer iter.Close()
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		id, err := strconv.Unquote(string(iter.Key()[len(gameIDsPrefix):]))
+		if err != nil {
+			return report, fmt.Errorf("malformed index key %q", iter.Key())
+		}
+		k, ok := latest[id]
+		switch {
+		case !ok:
+			report.Orphaned++
+			err = b.Delete(iter.Key(), nil)
+		case !bytes.Equal(iter.Value(), k):
+			report.Stale++
+			err = b.Set(iter.Key(), k, nil)
+		}
+		if err != nil {
+			return report, err
+		}
+		indexed[id] = true
+	}
+	if err := iter.Error(); err != nil {
+		return report, fmt.Errorf("index iter: %w", err)
+	}
+	for id, k := range latest {
+		if !indexed[id] {
+			report.Missing++
+			if err := b.Set(indexKey(id), k, nil); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if !repair || b.Empty() {
+		return report, nil
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return report, fmt.Errorf("batch.Commit: %w", err)
+	}
+	return report, nil
+}
+
+// DeleteSuperseded deletes every game that has been replaced by a
+// more recently created game with the same ID, and returns how many
+// it deleted. The index never points at superseded games, but they
+// may be all that's left of a game an older server lost track of,
+// so they're only deleted when an operator asks.
+func (ps *PebbleStore) DeleteSuperseded() (int, error) {
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	var deleted int
+	latest := make(map[string][]byte)
+	iter := ps.DB.NewIter(gamesIterOptions())
+	defer iter.Close()
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		k := append([]byte(nil), iter.Key()...)
+		id, err := parseKey(k)
+		if err != nil {
+			return 0, err
+		}
+		if prev, ok := latest[id]; ok {
+			if err := b.Delete(prev, nil); err != nil {
+				return 0, err
+			}
+			deleted++
+		}
+		latest[id] = k
+	}
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("games iter: %w", err)
+	}
+	if b.Empty() {
+		return 0, nil
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return 0, fmt.Errorf("batch.Commit: %w", err)
+	}
+	return deleted, nil
+}
+
+// prefixEnd returns the smallest key that's greater than every key
+// with the given prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
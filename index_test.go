@@ -0,0 +1,107 @@
+package codenames
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIndexMaintained(t *testing.T) {
+	ps := openTestStore(t)
+	g := newGame("foo", randomState(words), GameOptions{})
+	if err := ps.Save(g); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the game with a new one, then deleting the old
+	// one, leaves the new one findable.
+	next := newGame("foo", nextGameState(g.GameState), GameOptions{})
+	next.CreatedAt = g.CreatedAt.Add(time.Minute)
+	if err := ps.Save(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Delete(g); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ps.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(next.CreatedAt) {
+		t.Errorf("Get returned the game created at %s, want %s", got.CreatedAt, next.CreatedAt)
+	}
+
+	// Deleting by ID alone removes both the game and its entry.
+	if err := ps.Delete(&Game{ID: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.Get("foo"); err != ErrGameNotFound {
+		t.Errorf("Get after Delete returned %v, want ErrGameNotFound", err)
+	}
+	if report, err := ps.CheckIndex(false); err != nil || !report.OK() || report.Games != 0 {
+		t.Errorf("CheckIndex = %+v, %v; want an empty, consistent index", report, err)
+	}
+}
+
+func TestCheckIndexRepairs(t *testing.T) {
+	ps := openTestStore(t)
+	games := randomGames(3)
+	for _, g := range games {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := make([]string, 0, len(games))
+	for id := range games {
+		ids = append(ids, id)
+	}
+
+	// Corrupt the index: drop one entry, orphan another and
+	// supersede a game with a newer one that isn't indexed.
+	if err := ps.DB.Delete(indexKey(ids[0]), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.DB.Set(indexKey("ghost"), mkkey(0, "ghost"), nil); err != nil {
+		t.Fatal(err)
+	}
+	newer := *games[ids[1]]
+	newer.CreatedAt = newer.CreatedAt.Add(time.Hour)
+	k, v, err := ps.gameKV(&newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.DB.Set(k, v, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := IndexReport{Games: 3, Missing: 1, Stale: 1, Orphaned: 1, Superseded: 1}
+	report, err := ps.CheckIndex(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != want {
+		t.Errorf("CheckIndex(false) = %+v, want %+v", report, want)
+	}
+	if report, err = ps.CheckIndex(true); err != nil || report != want {
+		t.Errorf("CheckIndex(true) = %+v, %v; want %+v", report, err, want)
+	}
+	// Repairing the index doesn't delete the superseded game.
+	want = IndexReport{Games: 3, Superseded: 1}
+	if report, err = ps.CheckIndex(false); err != nil || report != want {
+		t.Errorf("after repair, CheckIndex = %+v, %v; want %+v", report, err, want)
+	}
+	if n, err := ps.DeleteSuperseded(); err != nil || n != 1 {
+		t.Errorf("DeleteSuperseded = %d, %v; want 1", n, err)
+	}
+	if report, err = ps.CheckIndex(false); err != nil || !report.OK() {
+		t.Errorf("after deleting superseded games, CheckIndex = %+v, %v; want no problems", report, err)
+	}
+
+	for _, id := range ids {
+		if _, err := ps.Get(id); err != nil {
+			t.Errorf("Get(%q) after repair: %s", id, err)
+		}
+	}
+	if got, _ := ps.Get(ids[1]); got == nil || !got.CreatedAt.Equal(newer.CreatedAt) {
+		t.Errorf("Get(%q) didn't return the newest game", ids[1])
+	}
+}
@@ -0,0 +1,287 @@
+package codenames
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// Set implements flag.Value.
+func (l *Level) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "debug":
+		*l = LevelDebug
+	case "info":
+		*l = LevelInfo
+	case "warn", "warning":
+		*l = LevelWarn
+	case "error":
+		*l = LevelError
+	default:
+		return fmt.Errorf("unknown log level %q", s)
+	}
+	return nil
+}
+
+// LogFormat selects how log lines are encoded.
+type LogFormat string
+
+const (
+	LogFormatLogfmt LogFormat = "logfmt"
+	LogFormatJSON   LogFormat = "json"
+)
+
+func (f LogFormat) String() string {
+	return string(f)
+}
+
+// Set implements flag.Value.
+func (f *LogFormat) Set(s string) error {
+	switch LogFormat(s) {
+	case LogFormatLogfmt, LogFormatJSON:
+		*f = LogFormat(s)
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q", s)
+	}
+}
+
+type logOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format LogFormat
+	level  Level
+}
+
+// Logger writes structured, leveled log lines. Each line has a
+// message and a list of alternating keys and values. Loggers
+// derived with With share their parent's output.
+//
+// A nil *Logger logs to stderr at LevelInfo.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+var defaultLogger = NewLogger(os.Stderr, LogFormatLogfmt, LevelInfo)
+
+// NewLogger constructs a Logger that writes lines at or above
+// level to w.
+func NewLogger(w io.Writer, format LogFormat, level Level) *Logger {
+	return &Logger{out: &logOutput{w: w, format: format, level: level}}
+}
+
+// With returns a Logger that includes the given key-value pairs
+// in every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		l = defaultLogger
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	if level < l.out.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	switch l.out.format {
+	case LogFormatJSON:
+		buf.WriteByte('{')
+		for i := 0; i < len(fields); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(fmt.Sprint(fields[i]))
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(jsonValue(fields[i+1]))
+		}
+		buf.WriteByte('}')
+	default:
+		for i := 0; i < len(fields); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(fmt.Sprint(fields[i]))
+			buf.WriteByte('=')
+			buf.WriteString(logfmtValue(fields[i+1]))
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func jsonValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case error:
+		b, _ := json.Marshal(v.Error())
+		return b
+	case fmt.Stringer:
+		b, _ := json.Marshal(v.String())
+		return b
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// StdLogger returns a *log.Logger that writes each line it's
+// given to l at the provided level, for use with packages like
+// net/http that log through the standard library.
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(stdWriter{l: l, level: level}, "", 0)
+}
+
+type stdWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (sw stdWriter) Write(p []byte) (int, error) {
+	sw.l.log(sw.level, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// PebbleLogger adapts the logger to the pebble.Logger interface.
+func (l *Logger) PebbleLogger() PebbleLogger {
+	return PebbleLogger{l.With("component", "pebble")}
+}
+
+// PebbleLogger implements the pebble.Logger interface on top of a
+// Logger.
+type PebbleLogger struct {
+	l *Logger
+}
+
+func (pl PebbleLogger) Infof(format string, args ...interface{}) {
+	pl.l.Info(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func (pl PebbleLogger) Fatalf(format string, args ...interface{}) {
+	pl.l.Error(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// requestLogger holds the logger for a single request. Handlers
+// add fields to it as they learn more about the request, so that
+// the access log line includes them too.
+type requestLogger struct {
+	l *Logger
+}
+
+func withLogger(req *http.Request, l *Logger) (*http.Request, *requestLogger) {
+	rl := &requestLogger{l: l}
+	return req.WithContext(context.WithValue(req.Context(), loggerKey{}, rl)), rl
+}
+
+// logger returns the request-scoped logger for req.
+func logger(req *http.Request) *Logger {
+	if rl, ok := req.Context().Value(loggerKey{}).(*requestLogger); ok {
+		return rl.l
+	}
+	return defaultLogger
+}
+
+// gameLogger attaches a game ID to the request's logger, and
+// returns the result.
+func gameLogger(req *http.Request, gameID string) *Logger {
+	rl, ok := req.Context().Value(loggerKey{}).(*requestLogger)
+	if !ok {
+		return defaultLogger.With("game_id", gameID)
+	}
+	rl.l = rl.l.With("game_id", gameID)
+	return rl.l
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// statusRecorder records the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
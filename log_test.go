@@ -0,0 +1,47 @@
+package codenames
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LogFormatLogfmt, LevelInfo).With("request_id", "abc")
+	l.Debug("hidden")
+	l.Info("saved game", "game_id", "foo bar", "err", errors.New(`bad "thing"`))
+
+	line := strings.TrimSpace(buf.String())
+	if strings.Contains(line, "hidden") {
+		t.Errorf("debug line logged at info level: %s", line)
+	}
+	want := `level=info msg="saved game" request_id=abc game_id="foo bar" err="bad \"thing\""`
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got %s, want suffix %s", line, want)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LogFormatJSON, LevelDebug)
+	l.With("route", "/guess").Warn("oops", "status", 400, "team", Red)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %s", buf.String(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"level":  "warn",
+		"msg":    "oops",
+		"route":  "/guess",
+		"status": 400.0,
+		"team":   "red",
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %v, want %v", k, got[k], want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package codenames
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryCheckpointName is the name of the single file in a
+// MemoryStore's checkpoint: its games, as a JSON array.
+const MemoryCheckpointName = "games.json"
+
+// MemoryStore is a Store that keeps games in memory, for embedding
+// the server without a database and for tests. Games are stored as
+// JSON, like the persistent stores do, so later changes to a saved
+// game aren't seen by the store. The zero value is an empty store.
+type MemoryStore struct {
+	mu    sync.Mutex
+	games map[string]memoryGame
+}
+
+type memoryGame struct {
+	createdAt time.Time
+	updatedAt time.Time
+	finished  bool
+	data      []byte
+}
+
+func (mg memoryGame) game() (*Game, error) {
+	var g Game
+	if err := json.Unmarshal(mg.data, &g); err != nil {
+		return nil, fmt.Errorf("Unmarshal game: %w", err)
+	}
+	return &g, nil
+}
+
+// Get returns the game with the given ID, or ErrGameNotFound.
+func (ms *MemoryStore) Get(id string) (*Game, error) {
+	ms.mu.Lock()
+	mg, ok := ms.games[id]
+	ms.mu.Unlock()
+	if !ok {
+		return nil, ErrGameNotFound
+	}
+	return mg.game()
+}
+
+// List returns up to limit games in the order they were created,
+// starting after cursor. The returned cursor is passed to the next
+// call to continue the listing; it's empty once there are no more
+// games.
+func (ms *MemoryStore) List(cursor string, limit int) ([]*Game, string, error) {
+	// The cursor is the creation time, in nanoseconds, and ID of
+	// the last game listed, separated by a space.
+	var after memoryListKey
+	if cursor != "" {
+		i := strings.IndexByte(cursor, ' ')
+		if i < 0 {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		nanos, err := strconv.ParseInt(cursor[:i], 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		after = memoryListKey{nanos, cursor[i+1:]}
+	}
+
+	ms.mu.Lock()
+	var keys []memoryListKey
+	for id, mg := range ms.games {
+		if k := (memoryListKey{mg.createdAt.UnixNano(), id}); cursor == "" || after.less(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	more := len(keys) > limit
+	if more {
+		keys = keys[:limit]
+	}
+	games := make([]*Game, 0, len(keys))
+	for _, k := range keys {
+		g, err := ms.games[k.id].game()
+		if err != nil {
+			ms.mu.Unlock()
+			return nil, "", err
+		}
+		games = append(games, g)
+	}
+	ms.mu.Unlock()
+
+	if !more {
+		return games, "", nil
+	}
+	last := keys[len(keys)-1]
+	return games, strconv.FormatInt(last.createdNanos, 10) + " " + last.id, nil
+}
+
+type memoryListKey struct {
+	createdNanos int64
+	id           string
+}
+
+func (k memoryListKey) less(o memoryListKey) bool {
+	if k.createdNanos != o.createdNanos {
+		return k.createdNanos < o.createdNanos
+	}
+	return k.id < o.id
+}
+
+// Save saves a copy of the game, replacing any game with the same
+// ID.
+func (ms *MemoryStore) Save(g *Game) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("marshaling game: %w", err)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.games == nil {
+		ms.games = make(map[string]memoryGame)
+	}
+	ms.games[g.ID] = memoryGame{
+		createdAt: g.CreatedAt,
+		updatedAt: g.UpdatedAt,
+		finished:  g.WinningTeam != nil,
+		data:      data,
+	}
+	return nil
+}
+
+// Delete removes a game. A newer game with the same ID is left
+// alone, unless g.CreatedAt is zero, in which case the game is found
+// by its ID alone.
+func (ms *MemoryStore) Delete(g *Game) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mg, ok := ms.games[g.ID]
+	if ok && (g.CreatedAt.IsZero() || mg.createdAt.Equal(g.CreatedAt)) {
+		delete(ms.games, g.ID)
+	}
+	return nil
+}
+
+// Restore returns all of the games in the store.
+func (ms *MemoryStore) Restore() (map[string]*Game, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	games := make(map[string]*Game, len(ms.games))
+	for id, mg := range ms.games {
+		g, err := mg.game()
+		if err != nil {
+			return nil, err
+		}
+		games[id] = g
+	}
+	return games, nil
+}
+
+// DeleteExpired deletes all games that the retention policy has
+// expired as of `now`. It returns the IDs of the deleted games.
+func (ms *MemoryStore) DeleteExpired(rp RetentionPolicy, now time.Time) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var expired []string
+	for id, mg := range ms.games {
+		if rp.expired(id, mg.updatedAt, mg.finished, now) {
+			delete(ms.games, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired, nil
+}
+
+// Checkpoint writes all of the games in the store in the same
+// format as the persistent stores' checkpoints. ReadCheckpoint
+// loads it into another MemoryStore.
+func (ms *MemoryStore) Checkpoint(w io.Writer, have []CheckpointPrefix) error {
+	ms.mu.Lock()
+	games := make([]json.RawMessage, 0, len(ms.games))
+	for _, mg := range ms.games {
+		games = append(games, mg.data)
+	}
+	ms.mu.Unlock()
+
+	b, err := json.Marshal(games)
+	if err != nil {
+		return err
+	}
+	sources := []checkpointSource{bytesCheckpointSource(MemoryCheckpointName, b)}
+	return writeCheckpoint(w, nil, sources, have)
+}
+
+// ReadCheckpoint saves the games in a checkpoint written by a
+// MemoryStore.
+func (ms *MemoryStore) ReadCheckpoint(r io.Reader) error {
+	files, err := ReadCheckpointFiles(r)
+	if err != nil {
+		return err
+	}
+	for _, cf := range files {
+		if cf.Name != MemoryCheckpointName {
+			return fmt.Errorf("unexpected checkpoint file %q", cf.Name)
+		}
+		var games []*Game
+		if err := json.Unmarshal(cf.Data, &games); err != nil {
+			return fmt.Errorf("Unmarshal games: %w", err)
+		}
+		for _, g := range games {
+			if err := ms.Save(g); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
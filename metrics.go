@@ -0,0 +1,250 @@
+package codenames
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	requestLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15, 20}
+	storeLatencyBuckets   = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+)
+
+// metrics holds the server's instrumentation. It's exported in the
+// Prometheus text exposition format by the /metrics endpoint.
+type metrics struct {
+	guesses    int64 // atomic access
+	turns      int64 // atomic access
+	waiters    int64 // atomic access
+	saveErrors int64 // atomic access
+
+	gamesLoaded  int64 // atomic access
+	gamesEvicted int64 // atomic access
+
+	saveLatency *histogram
+
+	mu             sync.Mutex
+	requestLatency map[string]*histogram // keyed by route
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		saveLatency:    newHistogram(storeLatencyBuckets),
+		requestLatency: make(map[string]*histogram),
+	}
+}
+
+func (m *metrics) observeRequest(route string, d time.Duration) {
+	m.mu.Lock()
+	h, ok := m.requestLatency[route]
+	if !ok {
+		h = newHistogram(requestLatencyBuckets)
+		m.requestLatency[route] = h
+	}
+	m.mu.Unlock()
+	h.observe(d.Seconds())
+}
+
+// histogram is a cumulative histogram with fixed buckets.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // counts[i] counts observations <= bounds[i]
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// instrumentedStore wraps a Store, recording the latency and
+// errors of saves.
+type instrumentedStore struct {
+	Store
+	m *metrics
+}
+
+func (is instrumentedStore) Save(g *Game) error {
+	return is.SaveAsync(g)()
+}
+
+// SaveAsync records the latency of a save up to the point it's
+// durable.
+func (is instrumentedStore) SaveAsync(g *Game) func() error {
+	start := time.Now()
+	wait := saveAsync(is.Store, g)
+	return func() error {
+		err := wait()
+		is.m.saveLatency.observe(time.Since(start).Seconds())
+		if err != nil {
+			atomic.AddInt64(&is.m.saveErrors, 1)
+		}
+		return err
+	}
+}
+
+func (is instrumentedStore) DeleteExpired(rp RetentionPolicy, now time.Time) ([]string, error) {
+	if e, ok := is.Store.(expirer); ok {
+		return e.DeleteExpired(rp, now)
+	}
+	return nil, nil
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition
+// format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single sample. Labels are given as alternating
+// names and values.
+func (mw metricsWriter) sample(name string, v float64, labels ...string) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteByte(' ')
+	mw.w.WriteString(formatFloat(v))
+	mw.w.WriteByte('\n')
+}
+
+func (mw metricsWriter) metric(name, typ, help string, v float64) {
+	mw.header(name, typ, help)
+	mw.sample(name, v)
+}
+
+func (mw metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	withLE := func(le string) []string {
+		return append(append([]string(nil), labels...), "le", le)
+	}
+	for i, b := range h.bounds {
+		mw.sample(name+"_bucket", float64(h.counts[i]), withLE(formatFloat(b))...)
+	}
+	mw.sample(name+"_bucket", float64(h.count), withLE("+Inf")...)
+	mw.sample(name+"_sum", h.sum, labels...)
+	mw.sample(name+"_count", float64(h.count), labels...)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// metricsWriterTo is implemented by stores that export their own
+// metrics, such as *PebbleStore.
+type metricsWriterTo interface {
+	writeMetrics(mw metricsWriter)
+}
+
+// GET /metrics
+func (s *Server) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricsWriter{w: bufio.NewWriter(rw)}
+	defer mw.w.Flush()
+
+	s.mu.Lock()
+	activeGames := len(s.games)
+	s.mu.Unlock()
+
+	mw.metric("codenames_games_active", "gauge",
+		"Number of games held in memory.", float64(activeGames))
+	mw.metric("codenames_games_loaded_total", "counter",
+		"Number of games loaded into memory from the store.", float64(atomic.LoadInt64(&s.metrics.gamesLoaded)))
+	mw.metric("codenames_games_evicted_total", "counter",
+		"Number of games evicted from memory to bound its size.", float64(atomic.LoadInt64(&s.metrics.gamesEvicted)))
+	mw.metric("codenames_guesses_total", "counter",
+		"Number of guesses made.", float64(atomic.LoadInt64(&s.metrics.guesses)))
+	mw.metric("codenames_turns_total", "counter",
+		"Number of turns ended by players.", float64(atomic.LoadInt64(&s.metrics.turns)))
+	mw.metric("codenames_long_poll_waiters", "gauge",
+		"Number of /game-state requests waiting for an update.", float64(atomic.LoadInt64(&s.metrics.waiters)))
+	mw.metric("codenames_requests_total", "counter",
+		"Number of HTTP requests received.", float64(atomic.LoadInt64(&s.statTotalRequests)))
+	mw.metric("codenames_requests_in_flight", "gauge",
+		"Number of HTTP requests being served.", float64(atomic.LoadInt64(&s.statOpenRequests)))
+
+	mw.header("codenames_requests_rate_limited_total", "counter", "Number of HTTP requests rejected by a rate limit.")
+	mw.sample("codenames_requests_rate_limited_total", float64(atomic.LoadInt64(&s.statRateLimitedClient)), "limit", "client")
+	mw.sample("codenames_requests_rate_limited_total", float64(atomic.LoadInt64(&s.statRateLimitedGame)), "limit", "game")
+
+	s.metrics.mu.Lock()
+	latencies := make(map[string]*histogram, len(s.metrics.requestLatency))
+	routes := make([]string, 0, len(s.metrics.requestLatency))
+	for route, h := range s.metrics.requestLatency {
+		latencies[route] = h
+		routes = append(routes, route)
+	}
+	s.metrics.mu.Unlock()
+	sort.Strings(routes)
+	mw.header("codenames_request_duration_seconds", "histogram", "Latency of HTTP requests by route.")
+	for _, route := range routes {
+		mw.histogram("codenames_request_duration_seconds", latencies[route], "route", route)
+	}
+
+	mw.header("codenames_store_save_duration_seconds", "histogram", "Latency of saving a game to the store.")
+	mw.histogram("codenames_store_save_duration_seconds", s.metrics.saveLatency)
+	mw.metric("codenames_store_save_errors_total", "counter",
+		"Number of failed attempts to save a game to the store.", float64(atomic.LoadInt64(&s.metrics.saveErrors)))
+
+	if mwt, ok := s.Store.(metricsWriterTo); ok {
+		mwt.writeMetrics(mw)
+	}
+}
+
+// routeOf returns the registered pattern that handles req, for use
+// as a low-cardinality metrics label.
+func (s *Server) routeOf(req *http.Request) string {
+	_, pattern := s.mux.Handler(req)
+	if pattern == "" {
+		return "unmatched"
+	}
+	return pattern
+}
@@ -0,0 +1,37 @@
+package codenames
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(5)
+
+	var buf bytes.Buffer
+	mw := metricsWriter{w: bufio.NewWriter(&buf)}
+	mw.metric("foo_total", "counter", "Foos.", 3)
+	mw.header("bar_seconds", "histogram", "Bars.")
+	mw.histogram("bar_seconds", h, "route", `/a"b`)
+	mw.w.Flush()
+
+	want := `# HELP foo_total Foos.
+# TYPE foo_total counter
+foo_total 3
+# HELP bar_seconds Bars.
+# TYPE bar_seconds histogram
+bar_seconds_bucket{route="/a\"b",le="0.1"} 1
+bar_seconds_bucket{route="/a\"b",le="1"} 2
+bar_seconds_bucket{route="/a\"b",le="+Inf"} 3
+bar_seconds_sum{route="/a\"b"} 5.55
+bar_seconds_count{route="/a\"b"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, strings.TrimSpace(want))
+	}
+}
@@ -0,0 +1,249 @@
+package codenames
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Analytics providers supported by the page template.
+const (
+	AnalyticsNone      = "none"
+	AnalyticsGoogle    = "google"
+	AnalyticsPlausible = "plausible"
+)
+
+// Font sources supported by the page template.
+const (
+	// FontsGoogle loads Roboto from Google Fonts.
+	FontsGoogle = "google"
+	// FontsSelfHosted serves fonts.css, and the fonts it refers
+	// to, from PageOptions.FontsDir under /fonts/.
+	FontsSelfHosted = "self-hosted"
+	// FontsSystem uses the fonts installed on the player's device.
+	FontsSystem = "system"
+)
+
+const defaultPlausibleScript = "https://plausible.io/js/script.js"
+
+// DefaultPage is the page configuration used for any option left
+// unset in a Server's Page.
+var DefaultPage = PageOptions{
+	Title: "Codenames",
+	Fonts: FontsGoogle,
+	Colors: ThemeColors{
+		Red:  "#d13030",
+		Blue: "#4183cc",
+	},
+	Analytics: Analytics{Provider: AnalyticsNone},
+}
+
+// PageOptions configures the HTML page that hosts the app.
+type PageOptions struct {
+	// Title is the site's name, shown in the top bar and the
+	// browser's title bar.
+	Title string
+	// LogoURL, if set, is an image shown in the top bar in place
+	// of the title.
+	LogoURL string
+	// Colors are the teams' theme colors.
+	Colors ThemeColors
+	// Fonts is one of FontsGoogle, FontsSelfHosted or
+	// FontsSystem.
+	Fonts string
+	// FontsDir is the directory served under /fonts/ when Fonts
+	// is FontsSelfHosted. It must contain a fonts.css stylesheet.
+	FontsDir string
+	// Analytics configures the analytics provider, if any.
+	Analytics Analytics
+}
+
+// ThemeColors are CSS colors, as hex codes like "#d13030" or
+// color names.
+type ThemeColors struct {
+	Red  string
+	Blue string
+}
+
+// Analytics configures page view tracking.
+type Analytics struct {
+	// Provider is one of AnalyticsNone, AnalyticsGoogle or
+	// AnalyticsPlausible.
+	Provider string
+	// ID is the Google Analytics measurement ID, or the domain
+	// registered with Plausible.
+	ID string
+	// ScriptURL overrides the URL of the Plausible script, for
+	// self-hosted Plausible instances.
+	ScriptURL string
+}
+
+var cssColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+func (po PageOptions) withDefaults() PageOptions {
+	if po.Title == "" {
+		po.Title = DefaultPage.Title
+	}
+	if po.Fonts == "" {
+		po.Fonts = DefaultPage.Fonts
+	}
+	if po.Colors.Red == "" {
+		po.Colors.Red = DefaultPage.Colors.Red
+	}
+	if po.Colors.Blue == "" {
+		po.Colors.Blue = DefaultPage.Colors.Blue
+	}
+	if po.Analytics.Provider == "" {
+		po.Analytics.Provider = DefaultPage.Analytics.Provider
+	}
+	if po.Analytics.Provider == AnalyticsPlausible && po.Analytics.ScriptURL == "" {
+		po.Analytics.ScriptURL = defaultPlausibleScript
+	}
+	return po
+}
+
+// Validate checks the page options, with unset options taken
+// from DefaultPage.
+func (po PageOptions) Validate() error {
+	po = po.withDefaults()
+	for team, c := range map[string]string{"red": po.Colors.Red, "blue": po.Colors.Blue} {
+		if !cssColor.MatchString(c) {
+			return fmt.Errorf("invalid %s color %q", team, c)
+		}
+	}
+	switch po.Fonts {
+	case FontsGoogle, FontsSystem:
+	case FontsSelfHosted:
+		if po.FontsDir == "" {
+			return fmt.Errorf("self-hosted fonts require a fonts directory")
+		}
+	default:
+		return fmt.Errorf("unknown fonts source %q", po.Fonts)
+	}
+	switch po.Analytics.Provider {
+	case AnalyticsNone:
+	case AnalyticsGoogle, AnalyticsPlausible:
+		if po.Analytics.ID == "" {
+			return fmt.Errorf("%s analytics requires an ID", po.Analytics.Provider)
+		}
+	default:
+		return fmt.Errorf("unknown analytics provider %q", po.Analytics.Provider)
+	}
+	if po.Analytics.Provider == AnalyticsPlausible {
+		if _, err := origin(po.Analytics.ScriptURL); err != nil {
+			return fmt.Errorf("analytics script URL: %w", err)
+		}
+	}
+	if po.LogoURL != "" {
+		if _, err := url.Parse(po.LogoURL); err != nil {
+			return fmt.Errorf("logo URL: %w", err)
+		}
+	}
+	return nil
+}
+
+// origin returns the scheme and host of an absolute URL.
+func origin(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("%q isn't an absolute http(s) URL", rawURL)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// contentSecurityPolicy returns a Content-Security-Policy allowing
+// only the page's own resources, inline elements carrying nonce
+// and the third-party origins required by the enabled options.
+// The placeholder {nonce} stands in for each request's nonce.
+func (po PageOptions) contentSecurityPolicy() string {
+	src := map[string][]string{
+		"default-src":     {"'self'"},
+		"script-src":      {"'self'", "'nonce-{nonce}'"},
+		"style-src":       {"'self'", "'nonce-{nonce}'"},
+		"font-src":        {"'self'"},
+		"img-src":         {"'self'", "data:"},
+		"connect-src":     {"'self'"},
+		"object-src":      {"'none'"},
+		"base-uri":        {"'none'"},
+		"form-action":     {"'self'"},
+		"frame-ancestors": {"'none'"},
+	}
+	add := func(directive string, sources ...string) {
+		src[directive] = append(src[directive], sources...)
+	}
+
+	if po.Fonts == FontsGoogle {
+		add("style-src", "https://fonts.googleapis.com")
+		add("font-src", "https://fonts.gstatic.com")
+	}
+	switch po.Analytics.Provider {
+	case AnalyticsGoogle:
+		add("script-src", "https://www.googletagmanager.com")
+		add("img-src", "https://www.google-analytics.com", "https://www.googletagmanager.com")
+		add("connect-src", "https://www.google-analytics.com", "https://*.google-analytics.com",
+			"https://*.analytics.google.com", "https://*.googletagmanager.com")
+	case AnalyticsPlausible:
+		o, _ := origin(po.Analytics.ScriptURL)
+		add("script-src", o)
+		add("connect-src", o)
+	}
+	if o, err := origin(po.LogoURL); err == nil {
+		add("img-src", o)
+	}
+
+	var b strings.Builder
+	for _, directive := range []string{
+		"default-src", "script-src", "style-src", "font-src", "img-src",
+		"connect-src", "object-src", "base-uri", "form-action", "frame-ancestors",
+	} {
+		if b.Len() > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(directive)
+		b.WriteByte(' ')
+		b.WriteString(strings.Join(src[directive], " "))
+	}
+	return b.String()
+}
+
+// initPage validates the server's page options and prepares the
+// page template. s.assets must already be loaded.
+func (s *Server) initPage() error {
+	s.Page = s.Page.withDefaults()
+	if err := s.Page.Validate(); err != nil {
+		return fmt.Errorf("page: %w", err)
+	}
+	s.csp = s.Page.contentSecurityPolicy()
+
+	var err error
+	s.tpl, err = template.New("index").Funcs(template.FuncMap{
+		"static": s.assets.url,
+	}).Parse(tpl)
+	return err
+}
+
+// renderPage renders the page template with a fresh nonce, sending
+// the matching Content-Security-Policy.
+func (s *Server) renderPage(rw http.ResponseWriter, params templateParameters) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		http.Error(rw, "error rendering", http.StatusInternalServerError)
+		return
+	}
+	params.Nonce = base64.RawURLEncoding.EncodeToString(b[:])
+	params.Page = s.Page
+
+	rw.Header().Set("Content-Security-Policy", strings.Replace(s.csp, "{nonce}", params.Nonce, -1))
+	err := s.tpl.Execute(rw, params)
+	if err != nil {
+		http.Error(rw, "error rendering", http.StatusInternalServerError)
+	}
+}
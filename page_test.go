@@ -0,0 +1,110 @@
+package codenames
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newPageTestServer(t *testing.T, po PageOptions) *Server {
+	t.Helper()
+	s := newTestServer()
+	s.Page = po
+	var err error
+	s.assets, err = newAssets(fstest.MapFS{"frontend/dist/app.js": {Data: []byte("x")}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.initPage(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func renderTestPage(s *Server) (body, csp string) {
+	rec := httptest.NewRecorder()
+	s.renderPage(rec, templateParameters{SelectedGameID: "foo"})
+	return rec.Body.String(), rec.Header().Get("Content-Security-Policy")
+}
+
+func TestPageDefaults(t *testing.T) {
+	s := newPageTestServer(t, PageOptions{})
+	body, csp := renderTestPage(s)
+
+	for _, want := range []string{"<title>Codenames - Play Online</title>", "fonts.googleapis.com", "--red: #d13030"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page doesn't contain %q", want)
+		}
+	}
+	for _, unwanted := range []string{"googletagmanager", "plausible", "google-analytics"} {
+		if strings.Contains(body, unwanted) || strings.Contains(csp, unwanted) {
+			t.Errorf("page or CSP contains %q with analytics disabled", unwanted)
+		}
+	}
+
+	// Every inline script and style carries the nonce allowed by
+	// the policy.
+	m := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(csp)
+	if m == nil {
+		t.Fatalf("CSP %q has no nonce", csp)
+	}
+	inline := regexp.MustCompile(`<(script|style)[^>]*>`).FindAllString(body, -1)
+	for _, tag := range inline {
+		if strings.Contains(tag, "src=") {
+			continue
+		}
+		if !strings.Contains(tag, `nonce="`+m[1]+`"`) {
+			t.Errorf("inline element %s doesn't carry the nonce", tag)
+		}
+	}
+	if _, csp2 := renderTestPage(s); csp2 == csp {
+		t.Error("nonce was reused across requests")
+	}
+}
+
+func TestPageOptions(t *testing.T) {
+	s := newPageTestServer(t, PageOptions{
+		Title:   "Horsepaste",
+		LogoURL: "https://cdn.example.com/logo.png",
+		Fonts:   FontsSystem,
+		Colors:  ThemeColors{Red: "crimson", Blue: "#00f"},
+		Analytics: Analytics{
+			Provider: AnalyticsPlausible,
+			ID:       "example.com",
+		},
+	})
+	body, csp := renderTestPage(s)
+	for _, want := range []string{"<title>Horsepaste - Play Online</title>", "--red: crimson", `data-domain="example.com"`, "plausible.io/js/script.js"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page doesn't contain %q", want)
+		}
+	}
+	if strings.Contains(body, "fonts.googleapis.com") || strings.Contains(csp, "fonts.g") {
+		t.Error("Google Fonts loaded with system fonts configured")
+	}
+	for _, want := range []string{"script-src 'self' 'nonce-", "https://plausible.io", "img-src 'self' data: https://cdn.example.com"} {
+		if !strings.Contains(csp, want) {
+			t.Errorf("CSP %q doesn't contain %q", csp, want)
+		}
+	}
+}
+
+func TestPageValidate(t *testing.T) {
+	for _, po := range []PageOptions{
+		{Colors: ThemeColors{Red: "red; background: url(x)"}},
+		{Fonts: "comic-sans"},
+		{Fonts: FontsSelfHosted},
+		{Analytics: Analytics{Provider: AnalyticsGoogle}},
+		{Analytics: Analytics{Provider: "matomo", ID: "1"}},
+		{Analytics: Analytics{Provider: AnalyticsPlausible, ID: "example.com", ScriptURL: "/script.js"}},
+	} {
+		if err := po.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded, want an error", po)
+		}
+	}
+	if err := (PageOptions{}).Validate(); err != nil {
+		t.Errorf("Validate of the defaults: %s", err)
+	}
+}
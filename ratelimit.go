@@ -0,0 +1,209 @@
+package codenames
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit configures a token bucket that refills at Rate
+// tokens per second and holds at most Burst tokens. The zero
+// value imposes no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (rl RateLimit) enabled() bool {
+	return rl.Rate > 0
+}
+
+// String implements flag.Value, formatting the limit as
+// "<rate>:<burst>".
+func (rl *RateLimit) String() string {
+	return strconv.FormatFloat(rl.Rate, 'f', -1, 64) + ":" + strconv.Itoa(rl.Burst)
+}
+
+// Set implements flag.Value, parsing a limit formatted as
+// "<rate>:<burst>". A rate of zero disables the limit.
+func (rl *RateLimit) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("rate limit %q must be formatted as <rate>:<burst>", s)
+	}
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid rate %q", parts[0])
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst < 1 {
+		return fmt.Errorf("invalid burst %q", parts[1])
+	}
+	rl.Rate, rl.Burst = rate, burst
+	return nil
+}
+
+// RateLimits configures the limits the server applies to
+// incoming requests.
+type RateLimits struct {
+	// Client limits all requests from a single client IP.
+	Client RateLimit
+	// NextGame additionally limits /next-game requests from a
+	// single client IP, which may carry thousands of words.
+	NextGame RateLimit
+	// Game limits requests that modify a single game.
+	Game RateLimit
+	// TrustProxy identifies clients by the X-Forwarded-For
+	// header instead of the connection's remote address. Only
+	// enable it behind a proxy that sets the header.
+	TrustProxy bool
+}
+
+// DefaultRateLimits are generous enough for a room full of
+// players sharing a single IP address, but stop a broken
+// client from flooding the server.
+var DefaultRateLimits = RateLimits{
+	Client:   RateLimit{Rate: 20, Burst: 100},
+	NextGame: RateLimit{Rate: 0.2, Burst: 5},
+	Game:     RateLimit{Rate: 10, Burst: 50},
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter maintains a token bucket per key.
+type limiter struct {
+	limit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newLimiter(rl RateLimit) *limiter {
+	return &limiter{limit: rl, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket for key. If the bucket is
+// empty, it returns false and how long until a token is available.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil || !l.limit.enabled() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets buckets that have refilled completely, since
+// they're indistinguishable from new buckets.
+func (l *limiter) sweep(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (s *Server) initRateLimits() {
+	s.clientLimiter = newLimiter(s.RateLimits.Client)
+	s.nextGameLimiter = newLimiter(s.RateLimits.NextGame)
+	s.gameLimiter = newLimiter(s.RateLimits.Game)
+}
+
+func (s *Server) sweepRateLimits() {
+	now := time.Now()
+	s.clientLimiter.sweep(now)
+	s.nextGameLimiter.sweep(now)
+	s.gameLimiter.sweep(now)
+}
+
+// clientIP returns the IP address that identifies the client
+// making the request.
+func (s *Server) clientIP(req *http.Request) string {
+	if s.RateLimits.TrustProxy {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// unlimitedRoutes are used by probes, monitoring and followers
+// rather than players, so the per-client limits don't apply to
+// them. Behind a proxy, they may all come from the same address as
+// every player.
+var unlimitedRoutes = map[string]bool{
+	"/healthz":      true,
+	"/readyz":       true,
+	"/metrics":      true,
+	"/checkpoint":   true,
+	"/replication/": true,
+}
+
+// allowClient applies the per-client limits to the request. If the
+// request is rejected, it writes a 429 response and returns false.
+func (s *Server) allowClient(rw http.ResponseWriter, req *http.Request) bool {
+	ip := s.clientIP(req)
+	now := time.Now()
+	ok, wait := s.clientLimiter.allow(ip, now)
+	if ok && req.URL.Path == "/next-game" {
+		ok, wait = s.nextGameLimiter.allow(ip, now)
+	}
+	if !ok {
+		atomic.AddInt64(&s.statRateLimitedClient, 1)
+		tooManyRequests(rw, wait)
+	}
+	return ok
+}
+
+// allowGame applies the per-game limit to a request that modifies
+// the game. If the request is rejected, it writes a 429 response
+// and returns false.
+func (s *Server) allowGame(rw http.ResponseWriter, gameID string) bool {
+	ok, wait := s.gameLimiter.allow(gameID, time.Now())
+	if !ok {
+		atomic.AddInt64(&s.statRateLimitedGame, 1)
+		tooManyRequests(rw, wait)
+	}
+	return ok
+}
+
+func tooManyRequests(rw http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+}
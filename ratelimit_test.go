@@ -0,0 +1,82 @@
+package codenames
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d within burst was rejected", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("request beyond burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %s, want 500ms", wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("request for a different key was rejected")
+	}
+	if ok, _ := l.allow("a", now.Add(wait)); !ok {
+		t.Error("request after waiting was rejected")
+	}
+
+	l.sweep(now.Add(time.Minute))
+	if len(l.buckets) != 0 {
+		t.Errorf("sweep left %d full buckets", len(l.buckets))
+	}
+}
+
+func TestRateLimitFlag(t *testing.T) {
+	var rl RateLimit
+	if err := rl.Set("0.5:10"); err != nil {
+		t.Fatal(err)
+	}
+	if rl != (RateLimit{Rate: 0.5, Burst: 10}) {
+		t.Errorf("Set parsed %+v", rl)
+	}
+	if got := rl.String(); got != "0.5:10" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, bad := range []string{"", "1", "x:1", "1:0", "-1:1"} {
+		if err := rl.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestOperationalRoutesUnlimited(t *testing.T) {
+	s := newTestServer()
+	s.RateLimits.Client = RateLimit{Rate: 1, Burst: 1}
+	s.initRateLimits()
+	s.mux = http.NewServeMux()
+	ok := func(http.ResponseWriter, *http.Request) {}
+	s.mux.HandleFunc("/healthz", ok)
+	s.mux.HandleFunc("/", ok)
+
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	if code := status("/"); code != http.StatusOK {
+		t.Fatalf("first request: got status %d", code)
+	}
+	if code := status("/"); code != http.StatusTooManyRequests {
+		t.Errorf("request beyond the limit: got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	for i := 0; i < 3; i++ {
+		if code := status("/healthz"); code != http.StatusOK {
+			t.Errorf("health check %d: got status %d", i, code)
+		}
+	}
+}
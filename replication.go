@@ -0,0 +1,580 @@
+package codenames
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication keeps a follower's store up to date with a primary's.
+// The primary numbers the changes it makes to its store, recording
+// the ID of each game saved or deleted in a change log once the
+// change is durable. A follower bootstraps from a checkpoint, then
+// repeatedly asks for the changes after the last one it applied,
+// receiving the current state of each changed game. Since changes
+// carry state rather than operations, applying one again is
+// harmless: a follower that reads the log's position before taking
+// a checkpoint can start following from that position.
+//
+// The change log is held in memory, so a follower that falls
+// further behind than the log holds, or whose primary restarts, has
+// to bootstrap again.
+
+const (
+	// replicationLogSize bounds the number of changes a primary's
+	// change log holds. It holds at least half as many.
+	replicationLogSize = 100000
+	// replicationBatchSize bounds the number of changes sent in
+	// response to a single request.
+	replicationBatchSize = 1000
+	// replicationIdleDelay is how long a Follower waits after
+	// finding no changes before asking again.
+	replicationIdleDelay = time.Second
+	// replicationMaxBackoff bounds how long a Follower waits
+	// before retrying after failing to reach the primary.
+	replicationMaxBackoff = 30 * time.Second
+)
+
+// ErrReplicationGap is returned when a primary no longer has the
+// changes after a follower's position, because the follower fell
+// too far behind or the primary restarted.
+var ErrReplicationGap = errors.New("primary no longer has the changes after this position; bootstrap again")
+
+var errHandedOff = errors.New("server has handed off to a follower")
+
+// ReplicationPosition is a position in a primary's change log.
+type ReplicationPosition struct {
+	// Log identifies the change log. A primary starts a new one
+	// each time it starts.
+	Log string `json:"log"`
+	// Seq is the number of changes before the position.
+	Seq uint64 `json:"seq"`
+}
+
+// String formats p as "<log>:<seq>".
+func (p ReplicationPosition) String() string {
+	return p.Log + ":" + strconv.FormatUint(p.Seq, 10)
+}
+
+// ParseReplicationPosition parses a position formatted by String.
+func ParseReplicationPosition(s string) (ReplicationPosition, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return ReplicationPosition{}, fmt.Errorf("malformed replication position %q", s)
+	}
+	seq, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return ReplicationPosition{}, fmt.Errorf("malformed replication position %q", s)
+	}
+	return ReplicationPosition{Log: s[:i], Seq: seq}, nil
+}
+
+// ReplicationBatch is a primary's response to a request for
+// changes.
+type ReplicationBatch struct {
+	// Position is the position after the batch's changes.
+	Position      ReplicationPosition `json:"position"`
+	SchemaVersion int                 `json:"schema_version"`
+	Changes       []ReplicatedChange  `json:"changes"`
+}
+
+// ReplicatedChange is the current state of a changed game.
+type ReplicatedChange struct {
+	ID string `json:"id"`
+	// Game is the game's JSON at the batch's schema version. It's
+	// omitted if the game has been deleted.
+	Game json.RawMessage `json:"game,omitempty"`
+}
+
+// changeLog records the IDs of the games a primary changes. It also
+// tracks the requests that may change games, so that the primary
+// can stop accepting them and hand off to a follower.
+type changeLog struct {
+	id   string
+	size int
+
+	mu      sync.Mutex
+	ids     []string      // the changes after first
+	first   uint64        // the seq of the position before ids[0]
+	changed chan struct{} // closed when a change is recorded
+
+	writes    int           // requests in flight that may change games
+	handedOff bool          // whether new requests are refused
+	idle      chan struct{} // closed when writes drops to zero after handing off
+}
+
+func newChangeLog(size int) *changeLog {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return &changeLog{
+		id:      hex.EncodeToString(id),
+		size:    size,
+		changed: make(chan struct{}),
+	}
+}
+
+// head returns the position after the latest change.
+func (cl *changeLog) head() ReplicationPosition {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.headLocked()
+}
+
+func (cl *changeLog) headLocked() ReplicationPosition {
+	return ReplicationPosition{Log: cl.id, Seq: cl.first + uint64(len(cl.ids))}
+}
+
+// record appends a change to the game with the given ID.
+func (cl *changeLog) record(id string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.ids = append(cl.ids, id)
+	if len(cl.ids) > cl.size {
+		// Drop the older half at once, so that trimming the log
+		// costs a constant amount per change.
+		n := len(cl.ids) - cl.size/2
+		cl.ids = append([]string(nil), cl.ids[n:]...)
+		cl.first += uint64(n)
+	}
+	close(cl.changed)
+	cl.changed = make(chan struct{})
+}
+
+// since returns the IDs of up to limit changes after pos, and the
+// position after them. It also returns a channel that's closed when
+// the next change is recorded. It returns ErrReplicationGap if the
+// log doesn't hold the changes after pos.
+func (cl *changeLog) since(pos ReplicationPosition, limit int) ([]string, ReplicationPosition, <-chan struct{}, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if pos.Log != cl.id || pos.Seq < cl.first || pos.Seq > cl.headLocked().Seq {
+		return nil, pos, nil, ErrReplicationGap
+	}
+	ids := cl.ids[pos.Seq-cl.first:]
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	next := ReplicationPosition{Log: cl.id, Seq: pos.Seq + uint64(len(ids))}
+	return append([]string(nil), ids...), next, cl.changed, nil
+}
+
+// beginWrite reports whether a request that may change games can
+// proceed, which it can until the primary hands off. If it can,
+// the request calls endWrite once it's done.
+func (cl *changeLog) beginWrite() bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.handedOff {
+		return false
+	}
+	cl.writes++
+	return true
+}
+
+func (cl *changeLog) endWrite() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.writes--
+	if cl.writes == 0 && cl.idle != nil {
+		close(cl.idle)
+		cl.idle = nil
+	}
+}
+
+// handOff refuses new requests that may change games, and waits
+// for those in flight to finish.
+func (cl *changeLog) handOff(ctx context.Context) error {
+	cl.mu.Lock()
+	cl.handedOff = true
+	if cl.writes == 0 {
+		cl.mu.Unlock()
+		return nil
+	}
+	if cl.idle == nil {
+		cl.idle = make(chan struct{})
+	}
+	idle := cl.idle
+	cl.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// replicatedStore wraps a Store, recording each save and delete in
+// a change log once it's durable.
+type replicatedStore struct {
+	Store
+	changes *changeLog
+}
+
+func (rs replicatedStore) Save(g *Game) error {
+	return rs.SaveAsync(g)()
+}
+
+func (rs replicatedStore) SaveAsync(g *Game) func() error {
+	id := g.ID
+	wait := saveAsync(rs.Store, g)
+	return func() error {
+		err := wait()
+		if err == nil {
+			rs.changes.record(id)
+		}
+		return err
+	}
+}
+
+func (rs replicatedStore) Delete(g *Game) error {
+	err := rs.Store.Delete(g)
+	if err == nil {
+		rs.changes.record(g.ID)
+	}
+	return err
+}
+
+// DeleteExpired records each game the retention policy deleted, so
+// that followers delete it too.
+func (rs replicatedStore) DeleteExpired(rp RetentionPolicy, now time.Time) ([]string, error) {
+	e, ok := rs.Store.(expirer)
+	if !ok {
+		return nil, nil
+	}
+	ids, err := e.DeleteExpired(rp, now)
+	for _, id := range ids {
+		rs.changes.record(id)
+	}
+	return ids, err
+}
+
+// writeRoutes are the routes whose requests may change games. A
+// primary refuses them once it has handed off to a follower.
+var writeRoutes = map[string]bool{
+	"/next-game":  true,
+	"/end-turn":   true,
+	"/guess":      true,
+	"/game-state": true, // creates games that don't exist yet
+	"/chat":       true,
+	"/admin/":     true,
+}
+
+// handleReplication serves a primary's change log to followers:
+//
+//	GET  /replication/position                   the position after the latest change
+//	GET  /replication/changes?after=<pos>[&wait=1] the changes after a position
+//	POST /replication/handoff                    stop accepting changes to games
+//
+// With wait=1, a request for changes waits up to PollTimeout for
+// the next change if there are none yet. A handoff waits for the
+// requests in flight to finish, then responds with the final
+// position; the primary refuses requests that may change games
+// from then on.
+func (s *Server) handleReplication(rw http.ResponseWriter, req *http.Request) {
+	switch path := strings.TrimPrefix(req.URL.Path, "/replication"); {
+	case path == "/position" && req.Method == "GET":
+		writeJSON(rw, s.changes.head())
+	case path == "/changes" && req.Method == "GET":
+		s.handleReplicationChanges(rw, req)
+	case path == "/handoff" && req.Method == "POST":
+		// Wake long polls, which may change games, so that
+		// they finish promptly.
+		s.startShutdown()
+		if err := s.changes.handOff(req.Context()); err != nil {
+			http.Error(rw, "unable to hand off: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		head := s.changes.head()
+		s.Logger.Warn("handed off to a follower; no longer accepting changes to games", "position", head)
+		writeJSON(rw, head)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (s *Server) handleReplicationChanges(rw http.ResponseWriter, req *http.Request) {
+	after, err := ParseReplicationPosition(req.URL.Query().Get("after"))
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	wait := req.URL.Query().Get("wait") == "1"
+
+	timeout := time.NewTimer(s.PollTimeout)
+	defer timeout.Stop()
+	var ids []string
+	var next ReplicationPosition
+	for {
+		var changed <-chan struct{}
+		ids, next, changed, err = s.changes.since(after, replicationBatchSize)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusGone)
+			return
+		}
+		if len(ids) > 0 || !wait {
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.shuttingDown():
+		case <-timeout.C:
+		case <-changed:
+			continue
+		}
+		break
+	}
+
+	// Each changed game is sent once, in its current state.
+	batch := ReplicationBatch{Position: next, SchemaVersion: SchemaVersion, Changes: []ReplicatedChange{}}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		c := ReplicatedChange{ID: id}
+		g, err := s.Store.Get(id)
+		if err != nil && err != ErrGameNotFound {
+			logger(req).Error("unable to load changed game", "game_id", id, "err", err)
+			http.Error(rw, "unable to load changed game", 500)
+			return
+		}
+		if g != nil {
+			if c.Game, err = json.Marshal(g); err != nil {
+				http.Error(rw, "unable to marshal changed game", 500)
+				return
+			}
+		}
+		batch.Changes = append(batch.Changes, c)
+	}
+	writeJSON(rw, batch)
+}
+
+// Follower keeps a store up to date with a primary's, by applying
+// the changes in the primary's change log.
+type Follower struct {
+	URL      string // the primary's base URL
+	Password string // the primary's BootstrapPassword
+	Store    Store
+	// Position is the position in the primary's change log after
+	// the last change applied to Store.
+	Position ReplicationPosition
+	// PositionFile, if set, is where Position is saved after each
+	// batch of changes is applied.
+	PositionFile string
+	Logger       *Logger
+
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// Head returns the position after the primary's latest change. A
+// follower bootstrapped from a checkpoint taken after Head returns
+// can follow from its position.
+func (f *Follower) Head(ctx context.Context) (ReplicationPosition, error) {
+	var pos ReplicationPosition
+	err := f.do(ctx, "GET", "/replication/position", &pos)
+	return pos, err
+}
+
+// Run applies the primary's changes as they're made, until ctx is
+// done. It keeps retrying while the primary is unreachable, and
+// returns ErrReplicationGap if the primary no longer has the
+// changes after Position.
+func (f *Follower) Run(ctx context.Context) error {
+	backoff := replicationIdleDelay
+	for {
+		n, err := f.poll(ctx, true)
+		delay := time.Duration(0)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, ErrReplicationGap):
+			return err
+		case err != nil:
+			f.Logger.Warn("unable to fetch changes from the primary; retrying", "err", err, "retry_in", backoff)
+			delay = backoff
+			if backoff *= 2; backoff > replicationMaxBackoff {
+				backoff = replicationMaxBackoff
+			}
+		case n == 0:
+			delay = replicationIdleDelay
+			backoff = replicationIdleDelay
+		default:
+			backoff = replicationIdleDelay
+		}
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// Handoff asks the primary to stop accepting changes to games, then
+// applies the changes it made before stopping. It returns the
+// primary's final position.
+func (f *Follower) Handoff(ctx context.Context) (ReplicationPosition, error) {
+	var final ReplicationPosition
+	if err := f.do(ctx, "POST", "/replication/handoff", &final); err != nil {
+		return final, err
+	}
+	if final.Log != f.Position.Log || final.Seq < f.Position.Seq {
+		return final, ErrReplicationGap
+	}
+	for f.Position.Seq < final.Seq {
+		if _, err := f.poll(ctx, false); err != nil {
+			return final, err
+		}
+	}
+	return final, nil
+}
+
+// poll fetches and applies a batch of changes, returning how many
+// games changed. If wait is true, the primary waits for changes if
+// there are none yet.
+func (f *Follower) poll(ctx context.Context, wait bool) (int, error) {
+	path := "/replication/changes?after=" + url.QueryEscape(f.Position.String())
+	if wait {
+		path += "&wait=1"
+	}
+	var batch ReplicationBatch
+	if err := f.do(ctx, "GET", path, &batch); err != nil {
+		return 0, err
+	}
+	if batch.Position.Log != f.Position.Log || batch.Position.Seq < f.Position.Seq {
+		return 0, fmt.Errorf("primary responded with position %s after %s", batch.Position, f.Position)
+	}
+	if err := f.apply(batch); err != nil {
+		return 0, err
+	}
+	f.Position = batch.Position
+	if f.PositionFile != "" {
+		if err := WriteReplicationPosition(f.PositionFile, f.Position); err != nil {
+			return 0, err
+		}
+	}
+	if len(batch.Changes) > 0 {
+		f.Logger.Debug("applied changes", "games", len(batch.Changes), "position", f.Position)
+	}
+	return len(batch.Changes), nil
+}
+
+// apply makes the follower's store match the state of each game in
+// the batch, waiting for the changes to be durable.
+func (f *Follower) apply(batch ReplicationBatch) error {
+	var waits []func() error
+	for _, c := range batch.Changes {
+		var g *Game
+		if c.Game != nil {
+			var err error
+			if g, err = decodeGameVersion(batch.SchemaVersion, c.Game); err != nil {
+				return fmt.Errorf("game %q: %w", c.ID, err)
+			}
+		}
+		// A game replaced by a new one with the same ID is
+		// deleted first, as it was on the primary.
+		old, err := f.Store.Get(c.ID)
+		if err != nil && err != ErrGameNotFound {
+			return err
+		}
+		if old != nil && (g == nil || !old.CreatedAt.Equal(g.CreatedAt)) {
+			if err := f.Store.Delete(old); err != nil {
+				return err
+			}
+		}
+		if g != nil {
+			waits = append(waits, saveAsync(f.Store, g))
+		}
+	}
+	for _, wait := range waits {
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do makes a request to the primary, decoding its JSON response
+// into v.
+func (f *Follower) do(ctx context.Context, method, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(f.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("admin", f.Password)
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusGone:
+		return ErrReplicationGap
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// ReadReplicationPosition reads a position saved by a Follower.
+func ReadReplicationPosition(path string) (ReplicationPosition, error) {
+	var pos ReplicationPosition
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return pos, err
+	}
+	if err := json.Unmarshal(b, &pos); err != nil {
+		return pos, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return pos, nil
+}
+
+// WriteReplicationPosition saves a position to the file at path,
+// replacing it atomically.
+func WriteReplicationPosition(path string, pos ReplicationPosition) error {
+	b, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
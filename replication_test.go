@@ -0,0 +1,207 @@
+package codenames
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReplicationPositionString(t *testing.T) {
+	p := ReplicationPosition{Log: "0123abcd", Seq: 42}
+	got, err := ParseReplicationPosition(p.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != p {
+		t.Errorf("parsed %+v, want %+v", got, p)
+	}
+	for _, s := range []string{"", "abc", ":1", "abc:", "abc:-1", "abc:x"} {
+		if _, err := ParseReplicationPosition(s); err == nil {
+			t.Errorf("parsing %q succeeded", s)
+		}
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	cl := newChangeLog(4)
+	start := cl.head()
+	for _, id := range []string{"a", "b", "c"} {
+		cl.record(id)
+	}
+	ids, next, _, err := cl.since(start, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) || next.Seq != start.Seq+2 {
+		t.Errorf("since(%v) = %v, %v", start, ids, next)
+	}
+
+	// The log is trimmed once it holds more than its size.
+	cl.record("d")
+	cl.record("e")
+	if _, _, _, err := cl.since(start, 10); err != ErrReplicationGap {
+		t.Errorf("since a trimmed position: %v", err)
+	}
+	if _, _, _, err := cl.since(ReplicationPosition{Log: "other"}, 10); err != ErrReplicationGap {
+		t.Errorf("since another log's position: %v", err)
+	}
+	head := cl.head()
+	ids, _, changed, err := cl.since(head, 10)
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("since the head = %v, %v", ids, err)
+	}
+	cl.record("f")
+	select {
+	case <-changed:
+	default:
+		t.Error("recording a change didn't close the channel")
+	}
+}
+
+func TestChangeLogHandOff(t *testing.T) {
+	cl := newChangeLog(10)
+	if !cl.beginWrite() {
+		t.Fatal("write refused before handing off")
+	}
+	done := make(chan error, 1)
+	go func() { done <- cl.handOff(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("handed off with a write in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if cl.beginWrite() {
+		t.Error("write allowed while handing off")
+	}
+	cl.endWrite()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handoff didn't finish after the write")
+	}
+}
+
+// newTestPrimary returns a server that records changes to st, and an
+// HTTP server serving its change log.
+func newTestPrimary(t *testing.T, st Store) (*Server, *httptest.Server) {
+	s := newTestServer()
+	s.Store = st
+	s.PollTimeout = 50 * time.Millisecond
+	s.changes = newChangeLog(replicationLogSize)
+	s.store = instrumentedStore{Store: replicatedStore{Store: st, changes: s.changes}, m: s.metrics}
+	srv := httptest.NewServer(basicAuth(http.HandlerFunc(s.handleReplication), "secret", "admin"))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	primary := new(MemoryStore)
+	s, srv := newTestPrimary(t, primary)
+	mustGetGame(t, s, "replaced")
+
+	f := &Follower{
+		URL:          srv.URL,
+		Password:     "secret",
+		Store:        openTestStore(t),
+		PositionFile: filepath.Join(t.TempDir(), "position"),
+	}
+	pos, err := f.Head(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Position = pos
+	// Bootstrap the follower, as a checkpoint taken now would.
+	g, err := primary.Get("replaced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Store.Save(g); err != nil {
+		t.Fatal(err)
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- f.Run(runCtx) }()
+
+	gh := mustGetGame(t, s, "guessed")
+	gh.update(nil, func(g *Game) bool { return g.Guess(0) == nil })
+	s.mu.Lock()
+	s.nextGameLocked(nil, s.games["replaced"], GameOptions{})
+	s.mu.Unlock()
+	if err := s.store.Delete(mustGetGame(t, s, "deleted").g); err != nil {
+		t.Fatal(err)
+	}
+	// Games the retention policy expires are deleted on the
+	// follower too.
+	mustGetGame(t, s, "expired")
+	s.Retention.Rooms = map[string]RoomRetention{"expired": {TTL: time.Nanosecond}}
+	time.Sleep(time.Millisecond)
+	s.expireGames()
+
+	// Wait for the follower to catch up.
+	head := s.changes.head()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if saved, _ := ReadReplicationPosition(f.PositionFile); saved == head {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made after the follower stopped are applied when the
+	// primary hands off.
+	mustGetGame(t, s, "late")
+	final, err := f.Handoff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Position != final || final != s.changes.head() {
+		t.Errorf("after handing off, follower is at %v, primary at %v", f.Position, s.changes.head())
+	}
+	if s.changes.beginWrite() {
+		t.Error("primary accepts writes after handing off")
+	}
+	if saved, err := ReadReplicationPosition(f.PositionFile); err != nil || saved != final {
+		t.Errorf("saved position %v, %v; want %v", saved, err, final)
+	}
+
+	want, _, err := primary.List("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := f.Store.List("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := func(games []*Game) map[string]string {
+		m := make(map[string]string, len(games))
+		for _, g := range games {
+			m[g.ID] = g.CreatedAt.UTC().String() + " " + g.StateID()
+		}
+		return m
+	}
+	if !reflect.DeepEqual(state(got), state(want)) {
+		t.Errorf("follower has games %v, primary %v", state(got), state(want))
+	}
+	if len(got) != 3 {
+		t.Errorf("follower has %d games, want 3", len(got))
+	}
+
+	// A follower whose position the primary doesn't have stops.
+	stale := &Follower{URL: srv.URL, Password: "secret", Store: new(MemoryStore), Position: ReplicationPosition{Log: "other"}}
+	if err := stale.Run(ctx); !errors.Is(err, ErrReplicationGap) {
+		t.Errorf("following from another log's position: %v", err)
+	}
+}
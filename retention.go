@@ -0,0 +1,111 @@
+package codenames
+
+import (
+	"time"
+)
+
+// DefaultRetention is the retention policy used for any duration
+// left unset in a Server's Retention.
+var DefaultRetention = RetentionPolicy{
+	Idle:     24 * time.Hour,
+	Finished: 3 * time.Hour,
+}
+
+// RetentionPolicy decides when a game may be forgotten. It's keyed
+// on the time of the game's last update, so games that are still
+// being played are never expired, and it's applied both to the
+// games held in memory and to those persisted in the Store.
+type RetentionPolicy struct {
+	// Idle is how long a game in progress is kept after its last
+	// update.
+	Idle time.Duration
+	// Finished is how long a finished game is kept after its
+	// last update.
+	Finished time.Duration
+	// Rooms overrides the policy for individual rooms, keyed by
+	// game ID.
+	Rooms map[string]RoomRetention
+}
+
+// RoomRetention overrides the retention policy for a single room.
+type RoomRetention struct {
+	// Pinned rooms are never expired.
+	Pinned bool
+	// TTL, if nonzero, is how long the room's game is kept after
+	// its last update, whether or not it's finished.
+	TTL time.Duration
+}
+
+func (rp RetentionPolicy) withDefaults() RetentionPolicy {
+	if rp.Idle == 0 {
+		rp.Idle = DefaultRetention.Idle
+	}
+	if rp.Finished == 0 {
+		rp.Finished = DefaultRetention.Finished
+	}
+	return rp
+}
+
+// Expired returns true if the policy allows g to be forgotten at
+// time now.
+func (rp RetentionPolicy) Expired(g *Game, now time.Time) bool {
+	return rp.expired(g.ID, g.UpdatedAt, g.WinningTeam != nil, now)
+}
+
+func (rp RetentionPolicy) expired(id string, updatedAt time.Time, finished bool, now time.Time) bool {
+	rp = rp.withDefaults()
+	ttl := rp.Idle
+	if finished {
+		ttl = rp.Finished
+	}
+	if room, ok := rp.Rooms[id]; ok {
+		if room.Pinned {
+			return false
+		}
+		if room.TTL > 0 {
+			ttl = room.TTL
+		}
+	}
+	return updatedAt.Add(ttl).Before(now)
+}
+
+// expirer is implemented by stores that can delete the games a
+// retention policy has expired, such as *PebbleStore. It returns
+// the IDs of the games it deleted.
+type expirer interface {
+	DeleteExpired(rp RetentionPolicy, now time.Time) ([]string, error)
+}
+
+// expireGames forgets all the games the server's retention policy
+// has expired, both in memory and in the store.
+func (s *Server) expireGames() {
+	now := time.Now()
+
+	var removed []*GameHandle
+	s.mu.Lock()
+	for id, gh := range s.games {
+		gh.mu.Lock()
+		// Like eviction, expiry keeps games with saves in flight,
+		// which would otherwise be saved again after they're
+		// forgotten.
+		if gh.saving == 0 && s.Retention.Expired(gh.g, now) {
+			s.removeLocked(id)
+			removed = append(removed, gh)
+			s.Logger.Info("removed expired game", "game_id", id, "finished", gh.g.WinningTeam != nil)
+		}
+		gh.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	if e, ok := s.store.(expirer); ok {
+		if _, err := e.DeleteExpired(s.Retention, now); err != nil {
+			s.Logger.Error("unable to delete expired games from the store", "err", err)
+		}
+	}
+
+	// Wake any long-polling requests once the games are gone from
+	// the store too, so that they don't load them again.
+	for _, gh := range removed {
+		close(gh.replaced)
+	}
+}
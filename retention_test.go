@@ -0,0 +1,72 @@
+package codenames
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Now()
+	rp := RetentionPolicy{
+		Idle:     24 * time.Hour,
+		Finished: time.Hour,
+		Rooms: map[string]RoomRetention{
+			"pinned": {Pinned: true},
+			"short":  {TTL: time.Minute},
+		},
+	}
+	red := Red
+
+	testCases := []struct {
+		id       string
+		age      time.Duration
+		finished bool
+		want     bool
+	}{
+		{"foo", 2 * time.Hour, false, false},
+		{"foo", 25 * time.Hour, false, true},
+		{"foo", 2 * time.Hour, true, true},
+		{"foo", 30 * time.Minute, true, false},
+		{"pinned", 1000 * time.Hour, true, false},
+		{"short", 2 * time.Minute, false, true},
+	}
+	for _, tc := range testCases {
+		g := &Game{ID: tc.id, UpdatedAt: now.Add(-tc.age)}
+		if tc.finished {
+			g.WinningTeam = &red
+		}
+		if got := rp.Expired(g, now); got != tc.want {
+			t.Errorf("Expired(%s, age %s, finished %t) = %t, want %t", tc.id, tc.age, tc.finished, got, tc.want)
+		}
+	}
+}
+
+func TestExpireGames(t *testing.T) {
+	s := newTestServer()
+	s.Retention = DefaultRetention
+	s.store = new(MemoryStore)
+	handles := make(map[string]*GameHandle)
+	for _, id := range []string{"active", "idle", "saving"} {
+		gh := mustGetGame(t, s, id)
+		if id != "active" {
+			gh.g.UpdatedAt = time.Now().Add(-365 * 24 * time.Hour)
+		}
+		handles[id] = gh
+	}
+	handles["saving"].saving++
+
+	s.expireGames()
+	if _, ok := s.games["idle"]; ok {
+		t.Error("expired game is still in memory")
+	}
+	select {
+	case <-handles["idle"].replaced:
+	default:
+		t.Error("expired game's long polls weren't woken")
+	}
+	for _, id := range []string{"active", "saving"} {
+		if s.games[id] != handles[id] {
+			t.Errorf("game %q was removed from memory", id)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package codenames
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Bucket is a bucket in an S3-compatible object store, such as
+// AWS S3 or MinIO. Objects are addressed path-style, as
+// <Endpoint>/<Bucket>/<key>, and requests are signed with AWS
+// Signature Version 4 if AccessKeyID is set.
+type S3Bucket struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // for temporary credentials; optional
+
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// S3Error is an error response from an S3-compatible object store.
+type S3Error struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3 %s %q: %d %s: %s", e.Method, e.Key, e.StatusCode, e.Code, e.Message)
+}
+
+// emptySHA256 is the hex-encoded SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3MetaSHA256 is the metadata header holding the SHA-256 of each
+// object uploaded by Put.
+const s3MetaSHA256 = "X-Amz-Meta-Sha256"
+
+// Put uploads the contents of f, which has the given size and
+// hex-encoded SHA-256, as the object with the given key.
+func (b *S3Bucket) Put(ctx context.Context, key string, f io.ReadSeeker, size int64, sha string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := b.newRequest(ctx, "PUT", key, nil, ioutil.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(s3MetaSHA256, sha)
+	resp, err := b.do(req, key, sha)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Get returns the contents of the object with the given key,
+// starting at offset, and the SHA-256 recorded when it was put.
+func (b *S3Bucket) Get(ctx context.Context, key string, offset int64) (body io.ReadCloser, sha string, err error) {
+	req, err := b.newRequest(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := b.do(req, key, emptySHA256)
+	if err != nil {
+		return nil, "", err
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("s3 GET %q: range request returned %s", key, resp.Status)
+	}
+	return resp.Body, resp.Header.Get(s3MetaSHA256), nil
+}
+
+// Stat returns the size of the object with the given key and the
+// SHA-256 recorded when it was put.
+func (b *S3Bucket) Stat(ctx context.Context, key string) (size int64, sha string, err error) {
+	req, err := b.newRequest(ctx, "HEAD", key, nil, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := b.do(req, key, emptySHA256)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, resp.Header.Get(s3MetaSHA256), nil
+}
+
+// Delete deletes the object with the given key.
+func (b *S3Bucket) Delete(ctx context.Context, key string) error {
+	req, err := b.newRequest(ctx, "DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, key, emptySHA256)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List returns the keys of the objects whose keys start with
+// prefix, in lexical order.
+func (b *S3Bucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := b.newRequest(ctx, "GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.do(req, prefix, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %q: %w", prefix, err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			sort.Strings(keys)
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b *S3Bucket) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	p := "/" + b.Bucket
+	if key != "" {
+		p += "/" + key
+	}
+	u := strings.TrimSuffix(b.Endpoint, "/") + s3Escape(p, false)
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+	return http.NewRequestWithContext(ctx, method, u, body)
+}
+
+// do signs and sends a request whose payload has the given SHA-256,
+// returning an *S3Error for unsuccessful responses.
+func (b *S3Bucket) do(req *http.Request, key, payloadSHA string) (*http.Response, error) {
+	if b.AccessKeyID != "" {
+		b.sign(req, payloadSHA, time.Now())
+	}
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &S3Error{Method: req.Method, Key: key, StatusCode: resp.StatusCode}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+// The host, Content-MD5, Content-Type, Date and Range headers are
+// signed, along with every x-amz-* header.
+func (b *S3Bucket) sign(req *http.Request, payloadSHA string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadSHA)
+	if b.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		switch {
+		case name == "content-md5", name == "content-type", name == "date", name == "range",
+			strings.HasPrefix(name, "x-amz-"):
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadSHA,
+	}, "\n")
+	date := amzDate[:8]
+	scope := date + "/" + b.Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretAccessKey), date)
+	key = hmacSHA256(key, b.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes every byte of s except the unreserved
+// characters, and slashes unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && !encodeSlash {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3Query encodes a query string in the canonical form signed by
+// Signature Version 4.
+func s3Query(q url.Values) string {
+	var params []string
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// S3Uploads uploads checkpoints of a store to an S3-compatible
+// bucket on a schedule. Each checkpoint is an object named
+// <Prefix>checkpoint-<time>, in the format written by the store's
+// Checkpoint method and read by ReceiveCheckpoint.
+type S3Uploads struct {
+	Bucket   *S3Bucket
+	Prefix   string
+	Store    Store
+	Interval time.Duration
+	Keep     int // the number of checkpoints kept in the bucket
+	Logger   *Logger
+}
+
+// s3CheckpointPrefix starts the names of uploaded checkpoints,
+// which sort in the order they were uploaded.
+const s3CheckpointPrefix = "checkpoint-"
+
+// Run uploads a checkpoint every Interval until ctx is done.
+func (u *S3Uploads) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if key, err := u.Upload(ctx, time.Now()); err != nil {
+			u.Logger.Error("unable to upload checkpoint", "bucket", u.Bucket.Bucket, "err", err)
+		} else {
+			u.Logger.Info("uploaded checkpoint", "bucket", u.Bucket.Bucket, "key", key)
+		}
+	}
+}
+
+// Upload uploads a checkpoint named for now, and deletes the
+// uploaded checkpoints beyond the newest Keep. It returns the new
+// checkpoint's key.
+func (u *S3Uploads) Upload(ctx context.Context, now time.Time) (string, error) {
+	// The checkpoint is spooled to a file first, so that its size
+	// and checksum are known before it's uploaded.
+	f, err := ioutil.TempFile("", "codenames-checkpoint-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+	if err := u.Store.Checkpoint(cw, nil); err != nil {
+		return "", fmt.Errorf("checkpoint: %w", err)
+	}
+
+	key := u.Prefix + s3CheckpointPrefix + now.UTC().Format(backupTimeFormat)
+	if err := u.Bucket.Put(ctx, key, f, cw.n, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return "", err
+	}
+
+	keys, err := ListS3Checkpoints(ctx, u.Bucket, u.Prefix)
+	if err != nil {
+		return key, err
+	}
+	keep := u.Keep
+	if keep < 1 {
+		keep = 1
+	}
+	for i := 0; i+keep < len(keys); i++ {
+		if err := u.Bucket.Delete(ctx, keys[i]); err != nil {
+			return key, err
+		}
+		u.Logger.Info("deleted old checkpoint", "bucket", u.Bucket.Bucket, "key", keys[i])
+	}
+	return key, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// ListS3Checkpoints returns the keys of the checkpoints uploaded
+// under prefix, oldest first.
+func ListS3Checkpoints(ctx context.Context, b *S3Bucket, prefix string) ([]string, error) {
+	keys, err := b.List(ctx, prefix+s3CheckpointPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoints []string
+	for _, k := range keys {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(k, prefix+s3CheckpointPrefix)); err == nil {
+			checkpoints = append(checkpoints, k)
+		}
+	}
+	return checkpoints, nil
+}
+
+// DownloadS3Object downloads the object with the given key to path,
+// verifying its SHA-256. If path holds the start of the object from
+// an interrupted download, the download resumes after it.
+func DownloadS3Object(ctx context.Context, b *S3Bucket, key, path string) error {
+	size, sha, err := b.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		// The file isn't a prefix of this object.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if offset < size {
+		body, _, err := b.Get(ctx, key, offset)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if sha == "" {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("downloaded %s has SHA-256 %s, uploaded with %s", key, got, sha)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package codenames
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// SchemaVersion is the version of the game record format written by
+// this version of the server. Records are the JSON encoding of a
+// Game, preceded by a header like "v2:". Records written before the
+// header was introduced are version 1.
+//
+// Bump SchemaVersion, and register a migration from the previous
+// version, with any change to Game, GameState or GameOptions that
+// older records wouldn't decode into correctly.
+const SchemaVersion = 2
+
+// A migration upgrades a game record, decoded as generic JSON, from
+// the version it's registered under to the next version.
+type migration struct {
+	description string
+	migrate     func(rec map[string]interface{}) error
+}
+
+// migrations maps each schema version to the migration from it to
+// the next version.
+var migrations = map[int]migration{
+	1: {
+		description: "record the IDs of canonical word sets, so they're saved once by reference",
+		migrate:     recordWordSetID,
+	},
+}
+
+func recordWordSetID(rec map[string]interface{}) error {
+	if _, ok := rec["word_set_id"]; ok {
+		return nil
+	}
+	raw, _ := rec["word_set"].([]interface{})
+	words := make([]string, 0, len(raw))
+	for _, w := range raw {
+		s, ok := w.(string)
+		if !ok {
+			return fmt.Errorf("word set contains %T", w)
+		}
+		words = append(words, s)
+	}
+	if id, ok := identifyWordSet(words); ok {
+		rec["word_set_id"] = id.String()
+	}
+	return nil
+}
+
+// encodeGame encodes a game as a record of the current schema
+// version.
+func encodeGame(g *Game) ([]byte, error) {
+	b, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	header := "v" + strconv.Itoa(SchemaVersion) + ":"
+	return append([]byte(header), b...), nil
+}
+
+// recordVersion splits a record into its schema version and JSON.
+func recordVersion(record []byte) (int, []byte, error) {
+	if !bytes.HasPrefix(record, []byte("v")) {
+		return 1, record, nil
+	}
+	i := bytes.IndexByte(record, ':')
+	if i < 0 {
+		return 0, nil, fmt.Errorf("malformed record header %.10q", record)
+	}
+	v, err := strconv.Atoi(string(record[1:i]))
+	if err != nil || v < 2 {
+		return 0, nil, fmt.Errorf("malformed record header %q", record[:i+1])
+	}
+	return v, record[i+1:], nil
+}
+
+// decodeGame decodes a record of any schema version up to the
+// current one, migrating it as necessary. It also returns the
+// record's version.
+func decodeGame(record []byte) (*Game, int, error) {
+	v, body, err := recordVersion(record)
+	if err != nil {
+		return nil, 0, err
+	}
+	g, err := decodeGameVersion(v, body)
+	return g, v, err
+}
+
+// decodeGameVersion decodes a game's JSON, written at schema version
+// v, migrating it as necessary.
+func decodeGameVersion(v int, body []byte) (*Game, error) {
+	if v > SchemaVersion {
+		return nil, fmt.Errorf("record has schema version %d, newer than this server's %d", v, SchemaVersion)
+	}
+	if v < SchemaVersion {
+		var err error
+		if body, err = migrateRecord(v, body); err != nil {
+			return nil, err
+		}
+	}
+	var g Game
+	if err := json.Unmarshal(body, &g); err != nil {
+		return nil, fmt.Errorf("Unmarshal game: %w", err)
+	}
+	return &g, nil
+}
+
+// migrateRecord applies the migrations from version v to the
+// current version to a record's JSON.
+func migrateRecord(v int, body []byte) ([]byte, error) {
+	// Decode numbers as json.Number, so that 64-bit seeds survive
+	// the round trip.
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var rec map[string]interface{}
+	if err := dec.Decode(&rec); err != nil {
+		return nil, fmt.Errorf("Unmarshal record: %w", err)
+	}
+	for ; v < SchemaVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return nil, fmt.Errorf("no migration from schema version %d", v)
+		}
+		if err := m.migrate(rec); err != nil {
+			return nil, fmt.Errorf("migrating from schema version %d: %w", v, err)
+		}
+	}
+	return json.Marshal(rec)
+}
+
+// MigrationReport describes the game records found by a store's
+// Migrate method.
+type MigrationReport struct {
+	// Records is the number of game records.
+	Records int
+	// Outdated counts the records written at each older schema
+	// version.
+	Outdated map[int]int
+	// Migrated is the number of records rewritten at the current
+	// version.
+	Migrated int
+}
+
+// DescribeMigrations describes the migrations applied to records
+// of the given schema version, in the order they're applied.
+func DescribeMigrations(version int) []string {
+	var descriptions []string
+	for v := version; v < SchemaVersion; v++ {
+		descriptions = append(descriptions, fmt.Sprintf("v%d to v%d: %s", v, v+1, migrations[v].description))
+	}
+	return descriptions
+}
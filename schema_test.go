@@ -0,0 +1,115 @@
+package codenames
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// legacyRecord returns a game encoded as it was before records were
+// versioned.
+func legacyRecord(t *testing.T, g *Game) []byte {
+	t.Helper()
+	b, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeLegacyRecord(t *testing.T) {
+	_, canonical, err := canonicalizeWords(testWords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := randomState(canonical)
+	state.Seed = math.MaxInt64 - 1
+	g := newGame("foo", state, GameOptions{})
+
+	got, v, err := decodeGame(legacyRecord(t, g))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Errorf("legacy record has version %d, want 1", v)
+	}
+	if got.Seed != g.Seed {
+		t.Errorf("seed %d didn't survive migration, got %d", g.Seed, got.Seed)
+	}
+	if !reflect.DeepEqual(got.Words, g.Words) || !reflect.DeepEqual(got.WordSet, g.WordSet) {
+		t.Error("words didn't survive migration")
+	}
+	id, _ := identifyWordSet(canonical)
+	if got.WordSetID != id.String() {
+		t.Errorf("migrated word set ID = %q, want %s", got.WordSetID, id)
+	}
+
+	record, err := encodeGame(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(record), "v2:{") {
+		t.Errorf("record starts %.10q", record)
+	}
+	if _, v, err := decodeGame(record); err != nil || v != SchemaVersion {
+		t.Errorf("decoding current record: version %d, %v", v, err)
+	}
+}
+
+func TestDecodeNewerRecord(t *testing.T) {
+	for _, record := range []string{`v99:{"id":"foo"}`, `v:{}`, `v2{}`} {
+		if _, _, err := decodeGame([]byte(record)); err == nil {
+			t.Errorf("decoding %q succeeded", record)
+		}
+	}
+}
+
+func TestPebbleMigrate(t *testing.T) {
+	ps := openTestStore(t)
+	legacy := newGame("legacy", randomState(testWords), GameOptions{})
+	k := mkkey(legacy.CreatedAt.Unix(), legacy.ID)
+	if err := ps.DB.Set(k, legacyRecord(t, legacy), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.DB.Set(indexKey(legacy.ID), k, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Save(newGame("current", randomState(testWords), GameOptions{})); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ps.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 2 || report.Outdated[1] != 1 || report.Migrated != 0 {
+		t.Errorf("dry run reported %+v", report)
+	}
+	v, closer, err := ps.DB.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(string(v), "v") {
+		t.Error("dry run rewrote the record")
+	}
+	closer.Close()
+
+	if report, err = ps.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 1 {
+		t.Errorf("migrated %d records, want 1", report.Migrated)
+	}
+	if report, err = ps.Migrate(true); err != nil || len(report.Outdated) != 0 {
+		t.Errorf("after migrating: %+v, %v", report, err)
+	}
+	g, err := ps.Get("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g.Layout, legacy.Layout) {
+		t.Error("migrated game's layout changed")
+	}
+}
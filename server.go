@@ -1,23 +1,36 @@
 package codenames
 
 import (
+	"container/list"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"net/http"
 	"net/http/pprof"
-	"os"
-	"sort"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+)
 
-	"github.com/jbowens/dictionary"
+const (
+	DefaultPollTimeout      = 15 * time.Second
+	DefaultMaxWordSetSize   = 10000
+	DefaultMaxGamesInMemory = 10000
 )
 
+// maxEncodedWordLen is the room allowed for each word of a custom
+// word set in a /next-game request body, including its quotes and
+// separator.
+const maxEncodedWordLen = 64
+
 var closed chan struct{}
 
 func init() {
@@ -29,55 +42,189 @@ type Server struct {
 	Server http.Server
 	Store  Store
 
-	tpl         *template.Template
-	gameIDWords []string
+	// Logger receives the server's logs. If nil, logs are
+	// written to stderr.
+	Logger *Logger
+
+	// SpectatorKey is the AES key used to seal spectator tokens.
+	// If nil, a random key is generated when the server starts
+	// and spectator links won't survive a restart.
+	SpectatorKey []byte
+
+	// RateLimits configures the limits applied to incoming
+	// requests. The zero value applies no limits.
+	RateLimits RateLimits
+
+	// BootstrapPassword protects the /checkpoint and /replication
+	// endpoints, from which followers copy the store. If empty,
+	// the endpoints aren't exposed.
+	BootstrapPassword string
+	// PProfPassword protects the /debug/pprof endpoints.
+	PProfPassword string
+	// AdminToken is the bearer token that authorizes requests to
+	// the /admin API. If empty, the API isn't exposed.
+	AdminToken string
+
+	// AssetsDir, if set, is a directory laid out like the repository
+	// from which word lists and static files are read instead of
+	// those embedded in the binary. Static files are then served
+	// uncached, so changes show up without a restart.
+	AssetsDir string
+
+	// Page configures the HTML page that hosts the app. Unset
+	// options default to those of DefaultPage.
+	Page PageOptions
+
+	// PollTimeout bounds how long a /game-state request waits for
+	// the game to change. Defaults to DefaultPollTimeout.
+	PollTimeout time.Duration
+	// MaxWordSetSize bounds the number of words in a custom word
+	// set, and so the size of the requests that carry one.
+	// Defaults to DefaultMaxWordSetSize.
+	MaxWordSetSize int
+	// MaxGamesInMemory bounds the number of games held in memory.
+	// Beyond it, the least recently used games are evicted, to be
+	// loaded from the Store again when next needed. Defaults to
+	// DefaultMaxGamesInMemory.
+	MaxGamesInMemory int
+	// Retention decides when games are forgotten, both in memory
+	// and in the Store. Unset durations default to those of
+	// DefaultRetention.
+	Retention RetentionPolicy
+
+	// TLSCertFile and TLSKeyFile, if set, make the server serve
+	// HTTPS (and HTTP/2). The certificate is reloaded when the
+	// files change or when ReloadCertificate is called.
+	TLSCertFile string
+	TLSKeyFile  string
+	// RedirectAddr, if set when serving HTTPS, is the address of a
+	// plain HTTP listener that redirects every request to HTTPS.
+	RedirectAddr string
+
+	store         Store // Store, instrumented
+	metrics       *metrics
+	tpl           *template.Template
+	csp           string
+	assets        *assets
+	gameIDWords   []string
+	spectatorAEAD cipher.AEAD
+	wordSets      WordSets   // custom word sets, shared by games using them
+	changes       *changeLog // changes for followers; nil without BootstrapPassword
 
 	mu           sync.Mutex
-	games        map[string]*GameHandle
+	games        map[string]*GameHandle // the games held in memory
+	loads        map[string]*gameLoad   // loads from the store in progress
+	lru          *list.List             // of *GameHandle, most recently used first
 	defaultWords []string
+	defaultSetID string // ID of defaultWords
 	mux          *http.ServeMux
 
-	statOpenRequests  int64 // atomic access
-	statTotalRequests int64 // atomic access
+	shutdownMu sync.Mutex
+	shutdown   chan struct{}  // closed when the server is shutting down
+	background sync.WaitGroup // background work, which Shutdown waits for
+	certs      *certReloader
+	redirect   *http.Server
+
+	clientLimiter   *limiter
+	nextGameLimiter *limiter
+	gameLimiter     *limiter
+
+	statOpenRequests      int64 // atomic access
+	statTotalRequests     int64 // atomic access
+	statRateLimitedClient int64 // atomic access
+	statRateLimitedGame   int64 // atomic access
 }
 
+// ErrGameNotFound is returned by a Store's Get method when there's
+// no game with the requested ID.
+var ErrGameNotFound = errors.New("game not found")
+
 type Store interface {
+	// Get returns the game with the given ID, or ErrGameNotFound.
+	Get(id string) (*Game, error)
+	// List returns up to limit games, starting after cursor, and
+	// the cursor to continue from. An empty cursor starts from the
+	// beginning; an empty returned cursor means there are no more
+	// games.
+	List(cursor string, limit int) ([]*Game, string, error)
 	Save(*Game) error
 	Delete(*Game) error
-	Checkpoint(io.Writer) error
+	// Checkpoint writes a checkpoint of the entire store to w,
+	// leaving out the file prefixes the receiver already has.
+	Checkpoint(w io.Writer, have []CheckpointPrefix) error
+}
+
+// asyncSaver is implemented by stores that can queue a save and
+// wait for it to be durable separately.
+type asyncSaver interface {
+	// SaveAsync encodes the game and queues it to be saved,
+	// returning a function that waits until it's durable.
+	SaveAsync(*Game) (wait func() error)
+}
+
+// saveAsync queues g to be saved to s, returning a function that
+// waits until it's durable. Stores that can't queue saves save g
+// before saveAsync returns.
+func saveAsync(s Store, g *Game) (wait func() error) {
+	if as, ok := s.(asyncSaver); ok {
+		return as.SaveAsync(g)
+	}
+	err := s.Save(g)
+	return func() error { return err }
 }
 
 type GameHandle struct {
 	store Store
+	elem  *list.Element // position in Server.lru; guarded by Server.mu
 
 	mu        sync.Mutex
 	updated   chan struct{} // closed when the game is updated
 	replaced  chan struct{} // closed when the game has been replaced
 	marshaled []byte
 	g         *Game
+	saving    int // updates whose saves aren't durable yet
+}
+
+// newHandle returns a handle for a new game, saving it to the
+// store.
+func newHandle(log *Logger, g *Game, s Store) *GameHandle {
+	gh := loadedHandle(g, s)
+	err := s.Save(g)
+	if err != nil {
+		log.Error("unable to write game to disk", "game_id", g.ID, "err", err)
+	}
+	return gh
 }
 
-func newHandle(g *Game, s Store) *GameHandle {
-	gh := &GameHandle{
+// loadedHandle returns a handle for a game loaded from the store.
+func loadedHandle(g *Game, s Store) *GameHandle {
+	return &GameHandle{
 		store:    s,
 		g:        g,
 		updated:  make(chan struct{}),
 		replaced: make(chan struct{}),
 	}
-	err := s.Save(g)
-	if err != nil {
-		log.Printf("Unable to write updated game %q to disk: %s\n", gh.g.ID, err)
-	}
-	return gh
 }
 
-func (gh *GameHandle) update(fn func(*Game) bool) {
+// update applies fn to the game and saves it if fn reports that
+// it was updated. The save is queued while the game is locked but
+// waited for after unlocking it, so that the game's readers and
+// writers don't wait on the disk; update returns, and the game's
+// watchers are woken, once the updated game is durable.
+func (gh *GameHandle) update(log *Logger, fn func(*Game) bool) {
+	gh.updateAsync(log, fn)()
+}
+
+// updateAsync is like update, but returns once the game is updated
+// in memory. The returned function waits for the update to be
+// durable, then wakes long-polling clients.
+func (gh *GameHandle) updateAsync(log *Logger, fn func(*Game) bool) (wait func()) {
 	gh.mu.Lock()
-	defer gh.mu.Unlock()
 	ok := fn(gh.g)
 	if !ok {
 		// game wasn't updated
-		return
+		gh.mu.Unlock()
+		return func() {}
 	}
 
 	gh.marshaled = nil
@@ -85,12 +232,19 @@ func (gh *GameHandle) update(fn func(*Game) bool) {
 	gh.updated = make(chan struct{})
 
 	// write the updated game to disk
-	err := gh.store.Save(gh.g)
-	if err != nil {
-		log.Printf("Unable to write updated game %q to disk: %s\n", gh.g.ID, err)
-	}
+	saved := saveAsync(gh.store, gh.g)
+	gh.saving++
+	gh.mu.Unlock()
 
-	close(ch)
+	return func() {
+		if err := saved(); err != nil {
+			log.Error("unable to write updated game to disk", "err", err)
+		}
+		gh.mu.Lock()
+		gh.saving--
+		gh.mu.Unlock()
+		close(ch)
+	}
 }
 
 func (gh *GameHandle) gameStateChanged(stateID *string) (updated <-chan struct{}, replaced <-chan struct{}) {
@@ -122,53 +276,82 @@ func (gh *GameHandle) MarshalJSON() ([]byte, error) {
 	return gh.marshaled, err
 }
 
-func (s *Server) getGame(gameID string) *GameHandle {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// getGame returns the handle of the game with the given ID,
+// creating the game if it doesn't exist. It returns an error if the
+// game couldn't be loaded from the store.
+func (s *Server) getGame(log *Logger, gameID string) (*GameHandle, error) {
+	return s.lookup(log, gameID, func() *Game {
+		state := randomState(s.defaultWords)
+		state.WordSetID = s.defaultSetID
+		return newGame(gameID, state, GameOptions{})
+	})
+}
 
-	gh, ok := s.games[gameID]
-	if ok {
-		return gh
-	}
-	gh = newHandle(newGame(gameID, randomState(s.defaultWords), GameOptions{}), s.Store)
-	s.games[gameID] = gh
-	return gh
+// loadError responds to a request for a game that couldn't be
+// loaded from the store.
+func loadError(rw http.ResponseWriter, log *Logger, err error) {
+	log.Error("unable to load game from the store", "err", err)
+	http.Error(rw, "Unable to load game", 500)
 }
 
 // POST /game-state
 func (s *Server) handleGameState(rw http.ResponseWriter, req *http.Request) {
 	var body struct {
-		GameID  string  `json:"game_id"`
-		StateID *string `json:"state_id"`
+		GameID         string  `json:"game_id"`
+		StateID        *string `json:"state_id"`
+		SpectatorToken string  `json:"spectator_token"`
 	}
 	err := json.NewDecoder(req.Body).Decode(&body)
 	if err != nil {
 		http.Error(rw, "Error decoding request body", 400)
 		return
 	}
+	if body.SpectatorToken != "" {
+		s.handleSpectatorState(rw, req, body.SpectatorToken, body.StateID)
+		return
+	}
 
-	gh := s.getGame(body.GameID)
+	log := gameLogger(req, body.GameID)
+	gh, err := s.getGame(log, body.GameID)
+	if err != nil {
+		loadError(rw, log, err)
+		return
+	}
 
 	updated, replaced := gh.gameStateChanged(body.StateID)
 
+	atomic.AddInt64(&s.metrics.waiters, 1)
+	defer atomic.AddInt64(&s.metrics.waiters, -1)
 	select {
 	case <-req.Context().Done():
 		return
-	case <-time.After(15 * time.Second):
+	case <-s.shuttingDown():
+		// Respond immediately so the client reconnects, hopefully
+		// to a server that isn't going away.
+		rw.Header().Set("Connection", "close")
+		writeGame(rw, gh)
+	case <-time.After(s.PollTimeout):
 		writeGame(rw, gh)
 	case <-updated:
 		writeGame(rw, gh)
 	case <-replaced:
-		gh = s.getGame(body.GameID)
+		if gh, err = s.getGame(log, body.GameID); err != nil {
+			loadError(rw, log, err)
+			return
+		}
 		writeGame(rw, gh)
 	}
 }
 
+// errReadOnly is returned to spectators that attempt to modify a game.
+const errReadOnly = "Spectator links are read-only"
+
 // POST /guess
 func (s *Server) handleGuess(rw http.ResponseWriter, req *http.Request) {
 	var request struct {
-		GameID string `json:"game_id"`
-		Index  int    `json:"index"`
+		GameID         string `json:"game_id"`
+		Index          int    `json:"index"`
+		SpectatorToken string `json:"spectator_token"`
 	}
 
 	decoder := json.NewDecoder(req.Body)
@@ -176,11 +359,22 @@ func (s *Server) handleGuess(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Error decoding", 400)
 		return
 	}
+	if request.SpectatorToken != "" {
+		http.Error(rw, errReadOnly, 403)
+		return
+	}
+	if !s.allowGame(rw, request.GameID) {
+		return
+	}
 
-	gh := s.getGame(request.GameID)
+	log := gameLogger(req, request.GameID)
+	gh, err := s.getGame(log, request.GameID)
+	if err != nil {
+		loadError(rw, log, err)
+		return
+	}
 
-	var err error
-	gh.update(func(g *Game) bool {
+	gh.update(log, func(g *Game) bool {
 		err = g.Guess(request.Index)
 		return err == nil
 	})
@@ -188,14 +382,16 @@ func (s *Server) handleGuess(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, err.Error(), 400)
 		return
 	}
+	atomic.AddInt64(&s.metrics.guesses, 1)
 	writeGame(rw, gh)
 }
 
 // POST /end-turn
 func (s *Server) handleEndTurn(rw http.ResponseWriter, req *http.Request) {
 	var request struct {
-		GameID       string `json:"game_id"`
-		CurrentRound int    `json:"current_round"`
+		GameID         string `json:"game_id"`
+		CurrentRound   int    `json:"current_round"`
+		SpectatorToken string `json:"spectator_token"`
 	}
 
 	decoder := json.NewDecoder(req.Body)
@@ -203,11 +399,27 @@ func (s *Server) handleEndTurn(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Error decoding", 400)
 		return
 	}
+	if request.SpectatorToken != "" {
+		http.Error(rw, errReadOnly, 403)
+		return
+	}
+	if !s.allowGame(rw, request.GameID) {
+		return
+	}
 
-	gh := s.getGame(request.GameID)
+	log := gameLogger(req, request.GameID)
+	gh, err := s.getGame(log, request.GameID)
+	if err != nil {
+		loadError(rw, log, err)
+		return
+	}
 
-	gh.update(func(g *Game) bool {
-		return g.NextTurn(request.CurrentRound)
+	gh.update(log, func(g *Game) bool {
+		if !g.NextTurn(request.CurrentRound) {
+			return false
+		}
+		atomic.AddInt64(&s.metrics.turns, 1)
+		return true
 	})
 	writeGame(rw, gh)
 }
@@ -219,81 +431,117 @@ func (s *Server) handleNextGame(rw http.ResponseWriter, req *http.Request) {
 		CreateNew       bool     `json:"create_new"`
 		TimerDurationMS int64    `json:"timer_duration_ms"`
 		EnforceTimer    bool     `json:"enforce_timer"`
+		SpectatorToken  string   `json:"spectator_token"`
 	}
 
-	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+	// Bound the body before decoding it, since the word set is
+	// only checked against MaxWordSetSize once it's decoded.
+	body := http.MaxBytesReader(rw, req.Body, int64(s.MaxWordSetSize*maxEncodedWordLen+4096))
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			http.Error(rw, "Too many words in the set.", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(rw, "Error decoding", 400)
 		return
 	}
-	wordSet := map[string]bool{}
-	for _, w := range request.WordSet {
-		wordSet[strings.TrimSpace(strings.ToUpper(w))] = true
-	}
-	if len(wordSet) > 0 && len(wordSet) < 25 {
-		http.Error(rw, "Need at least 25 words", 400)
+	if request.SpectatorToken != "" {
+		http.Error(rw, errReadOnly, 403)
 		return
 	}
-	if len(wordSet) > 10000 {
-		http.Error(rw, "Too many words in the set.", 400)
+	if !s.allowGame(rw, request.GameID) {
 		return
 	}
+	log := gameLogger(req, request.GameID)
 
-	var gh *GameHandle
-	func() {
-		s.mu.Lock()
-		defer s.mu.Unlock()
-
-		words := s.defaultWords
-		if len(wordSet) > 0 {
-			words = nil
-			for w := range wordSet {
-				words = append(words, w)
-			}
-			sort.Strings(words)
+	words, wordSetID := s.defaultWords, s.defaultSetID
+	if len(request.WordSet) > 0 {
+		id, canonical, err := canonicalizeWords(request.WordSet)
+		if err != nil {
+			http.Error(rw, "Need at least 25 words", 400)
+			return
 		}
-
-		opts := GameOptions{
-			TimerDurationMS: request.TimerDurationMS,
-			EnforceTimer:    request.EnforceTimer,
+		if len(canonical) > s.MaxWordSetSize {
+			http.Error(rw, "Too many words in the set.", 400)
+			return
 		}
+		words, wordSetID = s.wordSets.Intern(id, canonical), id.String()
+	}
 
-		var ok bool
-		gh, ok = s.games[request.GameID]
-		if !ok {
+	opts := GameOptions{
+		TimerDurationMS: request.TimerDurationMS,
+		EnforceTimer:    request.EnforceTimer,
+	}
+	for {
+		var created bool
+		gh, err := s.lookup(log, request.GameID, func() *Game {
 			// no game exists, create for the first time
-			gh = newHandle(newGame(request.GameID, randomState(words), opts), s.Store)
-			s.games[request.GameID] = gh
-		} else if request.CreateNew {
-			replacedCh := gh.replaced
-
-			previousGame := gh.g
-
-			nextState := nextGameState(gh.g.GameState)
-			gh = newHandle(newGame(request.GameID, nextState, opts), s.Store)
-			s.games[request.GameID] = gh
-
-			// signal to waiting /game-state goroutines that the
-			// old game was swapped out for a new game.
-			close(replacedCh)
-
-			// Delete the old game from the store. This isn't strictly
-			// necessary, but it helps us reclaim disk space a little more
-			// quickly.
-			err := s.Store.Delete(previousGame)
-			if err != nil {
-				log.Printf("Unable to delete old game %q from disk: %s\n", previousGame.ID, err)
-			}
+			created = true
+			state := randomState(words)
+			state.WordSetID = wordSetID
+			return newGame(request.GameID, state, opts)
+		})
+		if err != nil {
+			loadError(rw, log, err)
+			return
 		}
-	}()
-	writeGame(rw, gh)
+		if created || !request.CreateNew {
+			writeGame(rw, gh)
+			return
+		}
+
+		s.mu.Lock()
+		if s.games[request.GameID] != gh {
+			// The game was replaced or evicted concurrently.
+			s.mu.Unlock()
+			continue
+		}
+		gh = s.nextGameLocked(log, gh, opts)
+		s.mu.Unlock()
+		writeGame(rw, gh)
+		return
+	}
+}
+
+// nextGameLocked replaces the game held by gh with the next game in
+// its word permutation, carrying the chat over, and returns the new
+// game's handle. s.mu must be held.
+func (s *Server) nextGameLocked(log *Logger, gh *GameHandle, opts GameOptions) *GameHandle {
+	gh.mu.Lock()
+	previousGame := gh.g
+	nextState := nextGameState(previousGame.GameState)
+	chat := previousGame.Chat
+	gh.mu.Unlock()
+
+	next := newGame(previousGame.ID, nextState, opts)
+	next.Chat = chat
+	next.announce(next.StartingTeam, "A new game has started. %s goes first.",
+		capitalize(next.StartingTeam.String()))
+	nextGH := newHandle(log, next, s.store)
+	s.addLocked(nextGH)
+
+	// signal to waiting /game-state goroutines that the
+	// old game was swapped out for a new game.
+	close(gh.replaced)
+
+	// Delete the old game from the store. This isn't strictly
+	// necessary, but it helps us reclaim disk space a little more
+	// quickly.
+	err := s.store.Delete(previousGame)
+	if err != nil {
+		log.Error("unable to delete old game from disk", "err", err)
+	}
+	return nextGH
 }
 
 type statsResponse struct {
-	GamesTotal          int   `json:"games_total"`
-	GamesInProgress     int   `json:"games_in_progress"`
-	GamesCreatedOneHour int   `json:"games_created_1h"`
-	RequestsTotal       int64 `json:"requests_total_process_lifetime"`
-	RequestsInFlight    int64 `json:"requests_in_flight"`
+	GamesTotal            int   `json:"games_total"`
+	GamesInProgress       int   `json:"games_in_progress"`
+	GamesCreatedOneHour   int   `json:"games_created_1h"`
+	RequestsTotal         int64 `json:"requests_total_process_lifetime"`
+	RequestsInFlight      int64 `json:"requests_in_flight"`
+	RequestsLimitedClient int64 `json:"requests_rate_limited_client"`
+	RequestsLimitedGame   int64 `json:"requests_rate_limited_game"`
 }
 
 func (s *Server) handleStats(rw http.ResponseWriter, req *http.Request) {
@@ -314,99 +562,252 @@ func (s *Server) handleStats(rw http.ResponseWriter, req *http.Request) {
 		gh.mu.Unlock()
 	}
 	writeJSON(rw, statsResponse{
-		GamesTotal:          len(s.games),
-		GamesInProgress:     inProgress,
-		GamesCreatedOneHour: createdWithinAnHour,
-		RequestsTotal:       atomic.LoadInt64(&s.statTotalRequests),
-		RequestsInFlight:    atomic.LoadInt64(&s.statOpenRequests),
+		GamesTotal:            len(s.games),
+		GamesInProgress:       inProgress,
+		GamesCreatedOneHour:   createdWithinAnHour,
+		RequestsTotal:         atomic.LoadInt64(&s.statTotalRequests),
+		RequestsInFlight:      atomic.LoadInt64(&s.statOpenRequests),
+		RequestsLimitedClient: atomic.LoadInt64(&s.statRateLimitedClient),
+		RequestsLimitedGame:   atomic.LoadInt64(&s.statRateLimitedGame),
 	})
 }
 
+// GET /checkpoint?have=<name>:<size>:<sha256>
+//
+// Each have parameter describes the start of a file the receiver
+// already has from an interrupted transfer.
 func (s *Server) handleCheckpoint(rw http.ResponseWriter, req *http.Request) {
-	err := s.Store.Checkpoint(rw)
-	if err != nil {
-		log.Printf("[ERROR] Write checkpoint %s\n", err)
-	}
-}
-
-func (s *Server) cleanupOldGames() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for id, gh := range s.games {
-		gh.mu.Lock()
-		if gh.g.WinningTeam != nil && gh.g.CreatedAt.Add(3*time.Hour).Before(time.Now()) {
-			delete(s.games, id)
-			log.Printf("Removed completed game %s\n", id)
-		} else if gh.g.CreatedAt.Add(72 * time.Hour).Before(time.Now()) {
-			delete(s.games, id)
-			log.Printf("Removed expired game %s\n", id)
+	var have []CheckpointPrefix
+	for _, v := range req.URL.Query()["have"] {
+		p, err := ParseCheckpointPrefix(v)
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
 		}
-		gh.mu.Unlock()
+		have = append(have, p)
+	}
+	err := s.store.Checkpoint(rw, have)
+	if err != nil {
+		logger(req).Error("unable to write checkpoint", "err", err)
 	}
 }
 
 func (s *Server) Start(games map[string]*Game) error {
-	gameIDs, err := dictionary.Load("assets/game-id-words.txt")
+	var err error
+	s.assets, err = loadAssets(s.AssetsDir)
 	if err != nil {
 		return err
 	}
-	d, err := dictionary.Load("assets/original.txt")
+	gameIDs, err := s.assets.words("assets/game-id-words.txt")
 	if err != nil {
 		return err
 	}
-	s.tpl, err = template.New("index").Parse(tpl)
+	defaultWords, err := s.assets.words("assets/original.txt")
 	if err != nil {
 		return err
 	}
+	if s.Logger == nil {
+		s.Logger = defaultLogger
+	}
+	if s.Server.ErrorLog == nil {
+		s.Server.ErrorLog = s.Logger.StdLogger(LevelWarn)
+	}
+	if s.PollTimeout == 0 {
+		s.PollTimeout = DefaultPollTimeout
+	}
+	if s.MaxWordSetSize == 0 {
+		s.MaxWordSetSize = DefaultMaxWordSetSize
+	}
+	s.Retention = s.Retention.withDefaults()
+	if err := s.initPage(); err != nil {
+		return err
+	}
 
 	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
 	s.mux.HandleFunc("/stats", s.handleStats)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
 	s.mux.HandleFunc("/next-game", s.handleNextGame)
 	s.mux.HandleFunc("/end-turn", s.handleEndTurn)
 	s.mux.HandleFunc("/guess", s.handleGuess)
 	s.mux.HandleFunc("/game-state", s.handleGameState)
-	s.mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("frontend/dist"))))
+	s.mux.HandleFunc("/chat", s.handleChat)
+	s.mux.HandleFunc("/spectator-link", s.handleSpectatorLink)
+	s.mux.HandleFunc("/spectate/", s.handleSpectate)
+	s.mux.Handle("/static/", s.assets)
+	if s.Page.Fonts == FontsSelfHosted {
+		s.mux.Handle("/fonts/", http.StripPrefix("/fonts/", http.FileServer(http.Dir(s.Page.FontsDir))))
+	}
 	s.mux.HandleFunc("/", s.handleIndex)
 
-	bootstrapPW := os.Getenv("BOOTSTRAPPW")
 	// If no bootstrap PW is set, don't expose the checkpoint endpoint so we
 	// don't default to open.
-	if bootstrapPW != "" {
-		log.Printf("/checkpoint endpoint enabled\n")
+	if s.BootstrapPassword != "" {
+		s.Logger.Info("/checkpoint endpoint enabled")
 		s.mux.Handle("/checkpoint", basicAuth(
 			http.HandlerFunc(s.handleCheckpoint),
-			os.Getenv("BOOTSTRAPPW"),
+			s.BootstrapPassword,
 			"admin"))
+		s.changes = newChangeLog(replicationLogSize)
+		s.mux.Handle("/replication/", basicAuth(
+			http.HandlerFunc(s.handleReplication),
+			s.BootstrapPassword,
+			"admin"))
+	}
+	if s.AdminToken != "" {
+		s.Logger.Info("/admin API enabled")
+		s.mux.Handle("/admin/", bearerAuth(http.HandlerFunc(s.handleAdmin), s.AdminToken))
 	}
 
-	gameIDs = dictionary.Filter(gameIDs, func(s string) bool { return len(s) >= 3 })
-	s.gameIDWords = gameIDs.Words()
-	for i, w := range s.gameIDWords {
-		s.gameIDWords[i] = strings.ToLower(w)
+	for _, w := range gameIDs {
+		if len(w) >= 3 {
+			s.gameIDWords = append(s.gameIDWords, strings.ToLower(w))
+		}
 	}
 
 	s.games = make(map[string]*GameHandle)
-	s.defaultWords = d.Words()
-	sort.Strings(s.defaultWords)
-	s.Server.Handler = withPProfHandler(s)
+	id, canonical, err := s.wordSets.Canonicalize(defaultWords)
+	if err != nil {
+		return fmt.Errorf("default words: %w", err)
+	}
+	s.defaultWords, s.defaultSetID = canonical, id.String()
+	s.Server.Handler = withPProfHandler(s, s.PProfPassword)
 
 	if s.Store == nil {
 		s.Store = discardStore{}
 	}
+	s.metrics = newMetrics()
+	store := s.Store
+	if s.changes != nil {
+		store = replicatedStore{Store: s.Store, changes: s.changes}
+	}
+	s.store = instrumentedStore{Store: store, m: s.metrics}
 
-	if games != nil {
-		for _, g := range games {
-			s.games[g.ID] = newHandle(g, s.Store)
+	if s.SpectatorKey == nil {
+		s.SpectatorKey = make([]byte, 32)
+		if _, err := rand.Read(s.SpectatorKey); err != nil {
+			return err
 		}
+		s.Logger.Warn("no spectator key configured; spectator links won't survive a restart")
+	}
+	s.spectatorAEAD, err = newSpectatorAEAD(s.SpectatorKey)
+	if err != nil {
+		return fmt.Errorf("spectator key: %w", err)
+	}
+
+	if s.MaxGamesInMemory == 0 {
+		s.MaxGamesInMemory = DefaultMaxGamesInMemory
 	}
+	s.lru = list.New()
+	for _, g := range games {
+		s.addLocked(newHandle(s.Logger, g, s.store))
+	}
+
+	s.initRateLimits()
+	s.startBackground(10 * time.Minute)
+
+	if s.TLSCertFile != "" || s.TLSKeyFile != "" {
+		return s.listenAndServeTLS()
+	}
+	return s.Server.ListenAndServe()
+}
 
+// startBackground starts the server's periodic background work,
+// which runs every interval until the server shuts down.
+func (s *Server) startBackground(interval time.Duration) {
+	s.background.Add(1)
 	go func() {
-		for range time.Tick(10 * time.Minute) {
-			s.cleanupOldGames()
+		defer s.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.backgroundWork()
+			case <-s.shuttingDown():
+				return
+			}
 		}
 	}()
+}
 
-	return s.Server.ListenAndServe()
+// backgroundWork expires games and forgets idle rate limits. A
+// panic is logged rather than crashing the server; the work is
+// tried again on the next tick.
+func (s *Server) backgroundWork() {
+	defer func() {
+		if v := recover(); v != nil {
+			s.Logger.Error("background work panicked", "panic", v, "stack", string(debug.Stack()))
+		}
+	}()
+	s.expireGames()
+	s.sweepRateLimits()
+}
+
+// Shutdown gracefully shuts down the server. It wakes any
+// long-polling requests so their clients reconnect, stops the
+// server's background work, stops accepting new connections and
+// waits for in-flight requests and background work to finish or
+// for ctx to expire. Once it returns nil, nothing is using the
+// server's Store.
+//
+// Shutdown doesn't close the server's Store.
+func (s *Server) Shutdown(ctx context.Context) error {
+	// Both listeners are shut down even if one fails, so that
+	// neither keeps serving.
+	var err error
+	if redirect := s.startShutdown(); redirect != nil {
+		err = redirect.Shutdown(ctx)
+	}
+	if serr := s.Server.Shutdown(ctx); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for background work: %w", ctx.Err())
+	}
+}
+
+// startShutdown marks the server as shutting down, which wakes
+// long-polling requests and stops background work. It returns the
+// server's redirect listener, if any.
+func (s *Server) startShutdown() (redirect *http.Server) {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	ch := s.shutdownLocked()
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+	return s.redirect
+}
+
+// shuttingDown returns a channel that's closed when the server
+// begins shutting down.
+func (s *Server) shuttingDown() <-chan struct{} {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	return s.shutdownLocked()
+}
+
+func (s *Server) shutdownLocked() chan struct{} {
+	if s.shutdown == nil {
+		s.shutdown = make(chan struct{})
+	}
+	return s.shutdown
 }
 
 func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -414,17 +815,40 @@ func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	atomic.AddInt64(&s.statOpenRequests, 1)
 	defer func() { atomic.AddInt64(&s.statOpenRequests, -1) }()
 
-	s.mux.ServeHTTP(rw, req)
+	start := time.Now()
+	route := s.routeOf(req)
+	requestID := newRequestID()
+	rw.Header().Set("X-Request-Id", requestID)
+	req, rl := withLogger(req, s.Logger.With("request_id", requestID, "route", route))
+	sr := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	defer func() {
+		d := time.Since(start)
+		s.metrics.observeRequest(route, d)
+		rl.l.Debug("request", "method", req.Method, "path", req.URL.Path,
+			"status", sr.status, "duration_ms", d.Milliseconds())
+	}()
+
+	if !unlimitedRoutes[route] && !s.allowClient(sr, req) {
+		return
+	}
+	if s.changes != nil && writeRoutes[route] {
+		if !s.changes.beginWrite() {
+			http.Error(sr, errHandedOff.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer s.changes.endWrite()
+	}
+	s.mux.ServeHTTP(sr, req)
 }
 
-func withPProfHandler(next http.Handler) http.Handler {
+func withPProfHandler(next http.Handler, password string) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	pprofHandler := basicAuth(mux, os.Getenv("PPROFPW"), "admin")
+	pprofHandler := basicAuth(mux, password, "admin")
 
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		if strings.HasPrefix(req.URL.Path, "/debug/pprof") {
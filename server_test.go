@@ -0,0 +1,208 @@
+package codenames
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a Server initialized enough to call its
+// handlers directly, without listening.
+func newTestServer() *Server {
+	s := &Server{
+		Store:        discardStore{},
+		games:        make(map[string]*GameHandle),
+		defaultWords: testWords,
+		gameIDWords:  testWords,
+		metrics:      newMetrics(),
+		PollTimeout:  DefaultPollTimeout,
+
+		MaxGamesInMemory: DefaultMaxGamesInMemory,
+		lru:              list.New(),
+	}
+	s.store = instrumentedStore{Store: s.Store, m: s.metrics}
+	s.initRateLimits()
+	return s
+}
+
+// mustGetGame returns the handle of a game, creating it if it
+// doesn't exist.
+func mustGetGame(t *testing.T, s *Server, id string) *GameHandle {
+	t.Helper()
+	gh, err := s.getGame(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gh
+}
+
+func TestShutdownWakesLongPolls(t *testing.T) {
+	s := newTestServer()
+	gh := mustGetGame(t, s, "foo")
+	stateID := gh.g.StateID()
+
+	body, _ := json.Marshal(map[string]interface{}{"game_id": "foo", "state_id": stateID})
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleGameState(rec, httptest.NewRequest("POST", "/game-state", strings.NewReader(string(body))))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("long poll returned before the game changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("long poll wasn't woken by shutdown")
+	}
+	if rec.Code != 200 || rec.Header().Get("Connection") != "close" {
+		t.Errorf("got status %d, Connection %q", rec.Code, rec.Header().Get("Connection"))
+	}
+}
+
+// expiringStore is a store whose expiry runs fn.
+type expiringStore struct {
+	discardStore
+	fn func()
+}
+
+func (es expiringStore) DeleteExpired(RetentionPolicy, time.Time) ([]string, error) {
+	es.fn()
+	return nil, nil
+}
+
+func TestShutdownWaitsForBackgroundWork(t *testing.T) {
+	s := newTestServer()
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s.store = expiringStore{fn: func() {
+		once.Do(func() { close(started) })
+		<-release
+	}}
+	s.startBackground(time.Millisecond)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown during background work returned %v, want a deadline error", err)
+	}
+	close(release)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown after background work finished: %v", err)
+	}
+}
+
+func TestShutdownStopsBothListeners(t *testing.T) {
+	s := newTestServer()
+	s.Server.Addr = "127.0.0.1:0"
+
+	// A request to the redirect listener that never finishes keeps
+	// it from shutting down in time.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s.redirect = &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(received)
+		<-release
+	})}
+	go s.redirect.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want a deadline error", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Server.ListenAndServe() }()
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("the main listener wasn't shut down: %v", err)
+		}
+	case <-time.After(time.Second):
+		s.Server.Close()
+		t.Error("the main listener wasn't shut down")
+	}
+}
+
+func TestBackgroundWorkRecovers(t *testing.T) {
+	s := newTestServer()
+	s.store = expiringStore{fn: func() { panic("boom") }}
+	s.backgroundWork()
+	// The server is still usable.
+	mustGetGame(t, s, "foo")
+}
+
+func TestNextGameWordSet(t *testing.T) {
+	s := newTestServer()
+	s.MaxWordSetSize = DefaultMaxWordSetSize
+	nextGame := func(id string, words []string) *Game {
+		t.Helper()
+		body, _ := json.Marshal(map[string]interface{}{"game_id": id, "word_set": words})
+		rec := httptest.NewRecorder()
+		s.handleNextGame(rec, httptest.NewRequest("POST", "/next-game", strings.NewReader(string(body))))
+		if rec.Code != 200 {
+			t.Fatalf("next-game %s: got status %d: %s", id, rec.Code, rec.Body)
+		}
+		return s.games[id].g
+	}
+
+	custom := append([]string{"  zebra", "Zebra"}, testWords...)
+	foo := nextGame("foo", custom)
+	bar := nextGame("bar", testWords)
+	id, canonical, _ := canonicalizeWords(custom)
+	if foo.WordSetID != id.String() || !reflect.DeepEqual(foo.WordSet, canonical) {
+		t.Errorf("got word set %s %v, want %s %v", foo.WordSetID, foo.WordSet, id, canonical)
+	}
+	if bar.WordSetID == "" || bar.WordSetID == foo.WordSetID {
+		t.Errorf("games with different word sets have IDs %q and %q", foo.WordSetID, bar.WordSetID)
+	}
+	// Games with the same set share one copy of it.
+	baz := nextGame("baz", custom)
+	if &baz.WordSet[0] != &foo.WordSet[0] {
+		t.Error("games with the same word set don't share it")
+	}
+
+	// A body too large for any word set within the limit is
+	// rejected before it's decoded.
+	huge := make([]string, s.MaxWordSetSize+1)
+	for i := range huge {
+		huge[i] = strings.Repeat("x", maxEncodedWordLen)
+	}
+	body, _ := json.Marshal(map[string]interface{}{"game_id": "qux", "word_set": huge})
+	rec := httptest.NewRecorder()
+	s.handleNextGame(rec, httptest.NewRequest("POST", "/next-game", strings.NewReader(string(body))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("next-game with a %d-byte body: got status %d, want %d", len(body), rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"game_id": "qux", "word_set": []string{"a", "b"}})
+	rec = httptest.NewRecorder()
+	s.handleNextGame(rec, httptest.NewRequest("POST", "/next-game", strings.NewReader(string(body))))
+	if rec.Code != 400 {
+		t.Errorf("next-game with 2 words: got status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,278 @@
+package codenames
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxSpectatorDelay bounds the delay a spectator link may request.
+const maxSpectatorDelay = 10 * time.Minute
+
+// spectatorGrant is the payload of a spectator token. Tokens are
+// sealed with the server's key, so a spectator never learns the
+// ID of the game it's watching and can't address the game through
+// the endpoints that mutate it.
+type spectatorGrant struct {
+	GameID    string `json:"g"`
+	Spymaster bool   `json:"s,omitempty"`
+	DelayMS   int64  `json:"d,omitempty"`
+}
+
+func (sg spectatorGrant) delay() time.Duration {
+	return time.Duration(sg.DelayMS) * time.Millisecond
+}
+
+func newSpectatorAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *Server) sealSpectatorToken(sg spectatorGrant) (string, error) {
+	plaintext, err := json.Marshal(sg)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.spectatorAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.spectatorAEAD.Seal(nonce, nonce, plaintext, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Server) openSpectatorToken(token string) (spectatorGrant, error) {
+	var sg spectatorGrant
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return sg, errors.New("malformed spectator token")
+	}
+	nonceSize := s.spectatorAEAD.NonceSize()
+	if len(sealed) < nonceSize {
+		return sg, errors.New("malformed spectator token")
+	}
+	plaintext, err := s.spectatorAEAD.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return sg, errors.New("invalid spectator token")
+	}
+	if err := json.Unmarshal(plaintext, &sg); err != nil {
+		return sg, fmt.Errorf("decoding spectator token: %w", err)
+	}
+	return sg, nil
+}
+
+// spectatorView is the read-only representation of a game sent
+// to spectators.
+type spectatorView struct {
+	*Game
+	StateID   string `json:"state_id"`
+	Spectator bool   `json:"spectator"`
+	Spymaster bool   `json:"spymaster"`
+	DelayMS   int64  `json:"delay_ms,omitempty"`
+}
+
+// spectate returns the view of the game visible to the holder
+// of grant at time now. It also returns the time at which the
+// view will next change on its own, if any, and channels that
+// are closed when the underlying game is updated or replaced.
+func (gh *GameHandle) spectate(sg spectatorGrant, now time.Time) (view spectatorView, next time.Time, updated, replaced <-chan struct{}) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+
+	cutoff := now.Add(-sg.delay())
+	var g *Game
+	if sg.delay() == 0 || !gh.g.replayable() {
+		// Spectators see the game as it is if there's no delay,
+		// or if there are no events to replay it from.
+		// Messages bump UpdatedAt, so take it from the events, as
+		// a replay does, rather than reveal when spymasters chat.
+		live := *gh.g
+		live.Chat = gh.g.Chat.before(cutoff)
+		live.UpdatedAt = live.CreatedAt
+		if n := len(live.Events); n > 0 {
+			live.UpdatedAt = live.Events[n-1].At
+		}
+		g = &live
+	} else {
+		g = gh.g.viewAt(cutoff)
+		if len(g.Events) < len(gh.g.Events) {
+			next = gh.g.Events[len(g.Events)].At.Add(sg.delay())
+		}
+	}
+
+	// Chat changes the view too, as messages become visible, but it
+	// doesn't change the replayed game's UpdatedAt.
+	changedAt := g.UpdatedAt
+	channels := [][]Message{gh.g.Messages}
+	if sg.Spymaster {
+		channels = append(channels, gh.g.SpymasterMessages)
+	}
+	for _, msgs := range channels {
+		for _, m := range msgs {
+			if !m.At.After(cutoff) {
+				if m.At.After(changedAt) {
+					changedAt = m.At
+				}
+			} else if at := m.At.Add(sg.delay()); next.IsZero() || at.Before(next) {
+				next = at
+			}
+		}
+	}
+
+	// Never reveal the game ID; it's the only thing a client needs
+	// in order to modify the game.
+	g.ID = ""
+	if !sg.Spymaster && g.WinningTeam == nil {
+		// Hide the key, including the state it could be derived from.
+		layout := make([]Team, len(g.Layout))
+		for i, t := range g.Layout {
+			if g.Revealed[i] {
+				layout[i] = t
+			}
+		}
+		g.Layout = layout
+		g.Seed = 0
+		g.PermIndex = 0
+		g.WordSet = nil
+		g.WordSetID = ""
+	}
+	if !sg.Spymaster {
+		g.SpymasterMessages = nil
+	}
+
+	view = spectatorView{
+		Game:      g,
+		StateID:   stateIDAt(changedAt),
+		Spectator: true,
+		Spymaster: sg.Spymaster,
+		DelayMS:   sg.DelayMS,
+	}
+	return view, next, gh.updated, gh.replaced
+}
+
+// POST /spectator-link
+func (s *Server) handleSpectatorLink(rw http.ResponseWriter, req *http.Request) {
+	var request struct {
+		GameID    string `json:"game_id"`
+		Spymaster bool   `json:"spymaster"`
+		DelayMS   int64  `json:"delay_ms"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, "Error decoding", 400)
+		return
+	}
+	if request.GameID == "" {
+		http.Error(rw, "Missing game ID", 400)
+		return
+	}
+	if !s.allowGame(rw, request.GameID) {
+		return
+	}
+	if request.DelayMS < 0 || time.Duration(request.DelayMS)*time.Millisecond > maxSpectatorDelay {
+		http.Error(rw, fmt.Sprintf("Delay must be between 0 and %s", maxSpectatorDelay), 400)
+		return
+	}
+
+	log := gameLogger(req, request.GameID)
+	if _, err := s.lookup(log, request.GameID, nil); errors.Is(err, ErrGameNotFound) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		loadError(rw, log, err)
+		return
+	}
+
+	token, err := s.sealSpectatorToken(spectatorGrant{
+		GameID:    request.GameID,
+		Spymaster: request.Spymaster,
+		DelayMS:   request.DelayMS,
+	})
+	if err != nil {
+		http.Error(rw, "Unable to create spectator link", 500)
+		return
+	}
+	writeJSON(rw, struct {
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}{token, "/spectate/" + token})
+}
+
+// GET /spectate/<token>
+func (s *Server) handleSpectate(rw http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.URL.Path, "/spectate/")
+	if _, err := s.openSpectatorToken(token); err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	s.renderPage(rw, templateParameters{
+		SpectatorToken: token,
+	})
+}
+
+// handleSpectatorState implements /game-state for holders of a
+// spectator token. Like the player endpoint it long-polls, but it
+// also wakes up when a delayed event becomes visible.
+func (s *Server) handleSpectatorState(rw http.ResponseWriter, req *http.Request, token string, stateID *string) {
+	sg, err := s.openSpectatorToken(token)
+	if err != nil {
+		http.Error(rw, err.Error(), 403)
+		return
+	}
+	log := gameLogger(req, sg.GameID).With("spectator", true)
+
+	timeout := time.NewTimer(s.PollTimeout)
+	defer timeout.Stop()
+	atomic.AddInt64(&s.metrics.waiters, 1)
+	defer atomic.AddInt64(&s.metrics.waiters, -1)
+	for {
+		// Spectating never creates the game.
+		gh, err := s.lookup(log, sg.GameID, nil)
+		if errors.Is(err, ErrGameNotFound) {
+			http.NotFound(rw, req)
+			return
+		} else if err != nil {
+			loadError(rw, log, err)
+			return
+		}
+		view, next, updated, replaced := gh.spectate(sg, time.Now())
+		if stateID == nil || view.StateID != *stateID {
+			writeJSON(rw, view)
+			return
+		}
+
+		var wake *time.Timer
+		var wakeCh <-chan time.Time
+		if !next.IsZero() {
+			wake = time.NewTimer(time.Until(next))
+			wakeCh = wake.C
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.shuttingDown():
+			rw.Header().Set("Connection", "close")
+			writeJSON(rw, view)
+			return
+		case <-timeout.C:
+			writeJSON(rw, view)
+			return
+		case <-wakeCh:
+		case <-updated:
+		case <-replaced:
+		}
+		if wake != nil {
+			wake.Stop()
+		}
+	}
+}
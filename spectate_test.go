@@ -0,0 +1,164 @@
+package codenames
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpectatorToken(t *testing.T) {
+	var s Server
+	var err error
+	s.spectatorAEAD, err = newSpectatorAEAD(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := spectatorGrant{GameID: "foo", Spymaster: true, DelayMS: 30000}
+	token, err := s.sealSpectatorToken(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.openSpectatorToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("openSpectatorToken = %+v, want %+v", got, want)
+	}
+
+	tampered := []byte(token)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := s.openSpectatorToken(string(tampered)); err == nil {
+		t.Error("expected error opening tampered token")
+	}
+}
+
+func TestSpectateHidesKey(t *testing.T) {
+	g := newGame("foo", randomState(testWords), GameOptions{})
+	idx := 0
+	for g.Layout[idx] == Black {
+		idx++
+	}
+	if err := g.Guess(idx); err != nil {
+		t.Fatal(err)
+	}
+	gh := newHandle(nil, g, discardStore{})
+
+	view, _, _, _ := gh.spectate(spectatorGrant{GameID: "foo"}, time.Now())
+	if view.ID != "" {
+		t.Errorf("spectator view exposes game ID %q", view.ID)
+	}
+	if view.Seed != 0 || view.WordSet != nil {
+		t.Error("spectator view exposes the game's seed or word set")
+	}
+	for i, team := range view.Layout {
+		if !view.Revealed[i] && team != Neutral {
+			t.Errorf("spectator view exposes unrevealed cell %d", i)
+		}
+	}
+	if view.Layout[idx] != g.Layout[idx] {
+		t.Errorf("revealed cell %d is %s, want %s", idx, view.Layout[idx], g.Layout[idx])
+	}
+
+	view, _, _, _ = gh.spectate(spectatorGrant{GameID: "foo", Spymaster: true}, time.Now())
+	for i, team := range view.Layout {
+		if team != g.Layout[i] {
+			t.Fatalf("spymaster view layout differs at cell %d", i)
+		}
+	}
+
+	view, next, _, _ := gh.spectate(spectatorGrant{GameID: "foo", DelayMS: 60000}, time.Now())
+	if view.anyRevealed() {
+		t.Error("delayed spectator view shows a recent guess")
+	}
+	if want := g.Events[0].At.Add(time.Minute); !next.Equal(want) {
+		t.Errorf("next = %s, want %s", next, want)
+	}
+}
+
+func TestSpectateWithoutEvents(t *testing.T) {
+	// A game saved before events were recorded, partway through.
+	g := newGame("foo", randomState(testWords), GameOptions{})
+	g.Revealed[0] = true
+	g.Round = 2
+	gh := newHandle(nil, g, discardStore{})
+
+	for _, delayMS := range []int64{0, 60000} {
+		view, _, _, _ := gh.spectate(spectatorGrant{GameID: "foo", DelayMS: delayMS}, time.Now())
+		if !view.Revealed[0] || view.Round != 2 {
+			t.Errorf("with a delay of %dms, spectators see round %d, revealed %v", delayMS, view.Round, view.Revealed[0])
+		}
+	}
+}
+
+func TestSpectatorSeesChat(t *testing.T) {
+	g := newGame("foo", randomState(testWords), GameOptions{})
+	gh := newHandle(nil, g, discardStore{})
+	live := spectatorGrant{GameID: "foo"}
+	delayed := spectatorGrant{GameID: "foo", DelayMS: 60000}
+	before, _, _, _ := gh.spectate(live, time.Now())
+	beforeDelayed, _, _, _ := gh.spectate(delayed, time.Now())
+
+	if err := g.Say(ChannelSpymaster, "alice", Red, "psst"); err != nil {
+		t.Fatal(err)
+	}
+	if view, _, _, _ := gh.spectate(live, time.Now()); view.StateID != before.StateID {
+		t.Error("spymaster chat changed a spectator's state ID")
+	}
+	if err := g.Say(ChannelAll, "bob", Blue, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	view, next, _, _ := gh.spectate(live, time.Now())
+	if view.StateID == before.StateID || len(view.Messages) != 1 {
+		t.Errorf("chat didn't change the spectator view: state ID %s, %d messages", view.StateID, len(view.Messages))
+	}
+	if !next.IsZero() {
+		t.Errorf("next = %s, want none", next)
+	}
+
+	// A delayed spectator sees the message, and is woken, once the
+	// delay has passed.
+	view, next, _, _ = gh.spectate(delayed, time.Now())
+	if view.StateID != beforeDelayed.StateID || len(view.Messages) != 0 {
+		t.Error("delayed spectator view shows a recent message")
+	}
+	if want := g.Messages[0].At.Add(time.Minute); !next.Equal(want) {
+		t.Errorf("next = %s, want %s", next, want)
+	}
+	view, _, _, _ = gh.spectate(delayed, next)
+	if view.StateID == beforeDelayed.StateID || len(view.Messages) != 1 {
+		t.Error("delayed spectator view doesn't show the message after the delay")
+	}
+}
+
+func TestSpectateUnknownGame(t *testing.T) {
+	s := newTestServer()
+	var err error
+	s.spectatorAEAD, err = newSpectatorAEAD(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	body := `{"game_id": "missing"}`
+	s.handleSpectatorLink(rec, httptest.NewRequest("POST", "/spectator-link", strings.NewReader(body)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("linking to a missing game: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	token, err := s.sealSpectatorToken(spectatorGrant{GameID: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	s.handleSpectatorState(rec, httptest.NewRequest("POST", "/game-state", nil), token, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("spectating a missing game: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if len(s.games) != 0 {
+		t.Errorf("spectating created %d games", len(s.games))
+	}
+}
@@ -0,0 +1,563 @@
+package codenames
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// SQLiteCheckpointName is the name of the single file in a
+// SQLiteStore's checkpoint: a copy of the database.
+const SQLiteCheckpointName = "codenames.db"
+
+// sqliteTime formats timestamps in the database. It's fixed-width
+// and UTC so that timestamps sort and compare as text, and SQLite's
+// date and time functions understand it.
+const sqliteTime = "2006-01-02T15:04:05.000000000Z"
+
+// sqliteSchema creates the tables used by SQLiteStore.
+//
+// The games table holds a row for the current game with each ID.
+// Its state column holds the game as JSON, without its word set
+// and events, in the format of schema_version; the other columns
+// duplicate parts of it for ad hoc queries. Word sets are stored
+// once, under the SHA-256 of their JSON, however many games use
+// them. Events belong to the game with the same ID and creation
+// time.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS word_sets (
+		hash  TEXT PRIMARY KEY,
+		words TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS games (
+		id             TEXT PRIMARY KEY,
+		created_at     TEXT NOT NULL,
+		updated_at     TEXT NOT NULL,
+		starting_team  TEXT NOT NULL,
+		winning_team   TEXT,
+		round          INTEGER NOT NULL,
+		word_set       TEXT NOT NULL REFERENCES word_sets (hash),
+		state          TEXT NOT NULL,
+		schema_version INTEGER NOT NULL DEFAULT 1
+	)`,
+	`CREATE INDEX IF NOT EXISTS games_created_at ON games (created_at, id)`,
+	`CREATE INDEX IF NOT EXISTS games_word_set ON games (word_set)`,
+	`CREATE TABLE IF NOT EXISTS events (
+		game_id    TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		seq        INTEGER NOT NULL,
+		type       TEXT NOT NULL,
+		team       TEXT NOT NULL,
+		idx        INTEGER NOT NULL,
+		at         TEXT NOT NULL,
+		PRIMARY KEY (game_id, created_at, seq)
+	)`,
+	`CREATE TABLE IF NOT EXISTS health_probe (
+		id INTEGER PRIMARY KEY,
+		at TEXT NOT NULL
+	)`,
+}
+
+// SQLiteStore implements the Store interface on a SQLite database,
+// using a pure Go driver so that the server still builds without
+// cgo. Use OpenSQLiteStore to create one.
+type SQLiteStore struct {
+	DB     *sql.DB
+	Logger *Logger
+}
+
+// OpenSQLiteStore opens, creating if necessary, the SQLite
+// database at path.
+func OpenSQLiteStore(path string, log *Logger) (*SQLiteStore, error) {
+	// Write transactions take the database's write lock up front,
+	// rather than failing when they first write while another
+	// connection holds it.
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "synchronous(FULL)"},
+		"_txlock": {"immediate"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating schema: %w", err)
+		}
+	}
+	// Games tables created before states were versioned hold
+	// version 1 states.
+	var versioned bool
+	err = db.QueryRow(`SELECT count(*) > 0 FROM pragma_table_info('games') WHERE name = 'schema_version'`).Scan(&versioned)
+	if err == nil && !versioned {
+		_, err = db.Exec(`ALTER TABLE games ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1`)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("versioning games table: %w", err)
+	}
+	return &SQLiteStore{DB: db, Logger: log}, nil
+}
+
+// Restore loads all persisted games from storage.
+func (ss *SQLiteStore) Restore() (map[string]*Game, error) {
+	games := make(map[string]*Game)
+	var cursor string
+	for {
+		page, next, err := ss.List(cursor, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range page {
+			games[g.ID] = g
+		}
+		if next == "" {
+			return games, nil
+		}
+		cursor = next
+	}
+}
+
+// DeleteExpired deletes all games that the retention policy has
+// expired as of `now`, and any word sets no longer used by a game.
+// It returns the IDs of the deleted games.
+func (ss *SQLiteStore) DeleteExpired(rp RetentionPolicy, now time.Time) ([]string, error) {
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, created_at, updated_at, winning_team IS NOT NULL FROM games`)
+	if err != nil {
+		return nil, fmt.Errorf("listing games: %w", err)
+	}
+	type key struct{ id, createdAt string }
+	var expired []key
+	for rows.Next() {
+		var k key
+		var updatedAt string
+		var finished bool
+		if err := rows.Scan(&k.id, &k.createdAt, &updatedAt, &finished); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t, err := time.Parse(sqliteTime, updatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("game %q: %w", k.id, err)
+		}
+		if rp.expired(k.id, t, finished, now) {
+			expired = append(expired, k)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing games: %w", err)
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	ss.Logger.Info("deleting expired games", "games", len(expired))
+	for _, k := range expired {
+		if err := deleteSQLiteGame(tx, k.id, k.createdAt); err != nil {
+			return nil, err
+		}
+	}
+	if err := deleteUnusedWordSets(tx); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(expired))
+	for i, k := range expired {
+		ids[i] = k.id
+	}
+	return ids, nil
+}
+
+// Get loads the game with the given ID from storage. It returns
+// ErrGameNotFound if there's no such game.
+func (ss *SQLiteStore) Get(id string) (*Game, error) {
+	games, err := ss.query(`
+		SELECT g.schema_version, g.state, w.words FROM games g JOIN word_sets w ON w.hash = g.word_set
+		WHERE g.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(games) == 0 {
+		return nil, ErrGameNotFound
+	}
+	return games[0], nil
+}
+
+// List returns up to limit persisted games in the order they were
+// created, starting after cursor. The returned cursor is passed to
+// the next call to continue the listing; it's empty once there are
+// no more games.
+func (ss *SQLiteStore) List(cursor string, limit int) ([]*Game, string, error) {
+	// The cursor is the creation time and ID of the last game
+	// listed, separated by a space.
+	var createdAt, id string
+	if cursor != "" {
+		i := strings.IndexByte(cursor, ' ')
+		if i < 0 {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		createdAt, id = cursor[:i], cursor[i+1:]
+	}
+
+	// Ask for one more game than needed to find out whether
+	// there are any more.
+	games, err := ss.query(`
+		SELECT g.schema_version, g.state, w.words FROM games g JOIN word_sets w ON w.hash = g.word_set
+		WHERE (g.created_at, g.id) > (?, ?)
+		ORDER BY g.created_at, g.id
+		LIMIT ?`, createdAt, id, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(games) <= limit {
+		return games, "", nil
+	}
+	games = games[:limit]
+	last := games[limit-1]
+	return games, last.CreatedAt.UTC().Format(sqliteTime) + " " + last.ID, nil
+}
+
+// query runs a query selecting games' states and word sets, and
+// loads the games' events.
+func (ss *SQLiteStore) query(query string, args ...interface{}) ([]*Game, error) {
+	rows, err := ss.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying games: %w", err)
+	}
+	var games []*Game
+	for rows.Next() {
+		var version int
+		var state, words []byte
+		if err := rows.Scan(&version, &state, &words); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g, err := decodeGameVersion(version, state)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal(words, &g.WordSet); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("game %q: Unmarshal word set: %w", g.ID, err)
+		}
+		games = append(games, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("querying games: %w", err)
+	}
+
+	for _, g := range games {
+		if err := ss.loadEvents(g); err != nil {
+			return nil, fmt.Errorf("game %q: %w", g.ID, err)
+		}
+	}
+	return games, nil
+}
+
+func (ss *SQLiteStore) loadEvents(g *Game) error {
+	rows, err := ss.DB.Query(`
+		SELECT type, team, idx, at FROM events
+		WHERE game_id = ? AND created_at = ?
+		ORDER BY seq`, g.ID, g.CreatedAt.UTC().Format(sqliteTime))
+	if err != nil {
+		return fmt.Errorf("querying events: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Event
+		var team, at string
+		if err := rows.Scan(&e.Type, &team, &e.Index, &at); err != nil {
+			return err
+		}
+		e.Team = parseTeam(team)
+		if e.At, err = time.Parse(sqliteTime, at); err != nil {
+			return err
+		}
+		g.Events = append(g.Events, e)
+	}
+	return rows.Err()
+}
+
+// Save saves the game to persistent storage, replacing any game
+// with the same ID.
+func (ss *SQLiteStore) Save(g *Game) error {
+	stateJSON, err := sqliteState(g)
+	if err != nil {
+		return err
+	}
+	words, err := json.Marshal(g.WordSet)
+	if err != nil {
+		return fmt.Errorf("marshaling word set: %w", err)
+	}
+	sum := sha256.Sum256(words)
+	hash := hex.EncodeToString(sum[:])
+	createdAt := g.CreatedAt.UTC().Format(sqliteTime)
+	var winningTeam *string
+	if g.WinningTeam != nil {
+		s := g.WinningTeam.String()
+		winningTeam = &s
+	}
+
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO word_sets (hash, words) VALUES (?, ?) ON CONFLICT DO NOTHING`, hash, words)
+	if err != nil {
+		return fmt.Errorf("saving word set: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO games (id, created_at, updated_at, starting_team, winning_team, round, word_set, state, schema_version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			created_at = excluded.created_at,
+			updated_at = excluded.updated_at,
+			starting_team = excluded.starting_team,
+			winning_team = excluded.winning_team,
+			round = excluded.round,
+			word_set = excluded.word_set,
+			state = excluded.state,
+			schema_version = excluded.schema_version`,
+		g.ID, createdAt, g.UpdatedAt.UTC().Format(sqliteTime), g.StartingTeam.String(),
+		winningTeam, g.Round, hash, stateJSON, SchemaVersion)
+	if err != nil {
+		return fmt.Errorf("saving game: %w", err)
+	}
+
+	// Events are only ever appended, so only those not yet
+	// saved need inserting. Any events of an earlier game with
+	// the same ID go with it.
+	_, err = tx.Exec(`DELETE FROM events WHERE game_id = ? AND created_at <> ?`, g.ID, createdAt)
+	if err != nil {
+		return fmt.Errorf("deleting events: %w", err)
+	}
+	var saved int
+	err = tx.QueryRow(`SELECT count(*) FROM events WHERE game_id = ? AND created_at = ?`,
+		g.ID, createdAt).Scan(&saved)
+	if err != nil {
+		return fmt.Errorf("counting events: %w", err)
+	}
+	for seq := saved; seq < len(g.Events); seq++ {
+		e := g.Events[seq]
+		_, err = tx.Exec(`
+			INSERT INTO events (game_id, created_at, seq, type, team, idx, at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			g.ID, createdAt, seq, string(e.Type), e.Team.String(), e.Index, e.At.UTC().Format(sqliteTime))
+		if err != nil {
+			return fmt.Errorf("saving event: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteState returns the JSON saved in a game's state column, at
+// the current schema version.
+func sqliteState(g *Game) ([]byte, error) {
+	state := *g
+	state.WordSet = nil
+	state.Events = nil
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling game: %w", err)
+	}
+	return b, nil
+}
+
+// Migrate rewrites the state of every game saved at an older schema
+// version at the current version. If dryRun is true, it only reports
+// what it would rewrite.
+func (ss *SQLiteStore) Migrate(dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{Outdated: make(map[int]int)}
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT count(*) FROM games`).Scan(&report.Records)
+	if err != nil {
+		return report, fmt.Errorf("counting games: %w", err)
+	}
+	rows, err := tx.Query(`SELECT id, schema_version, state FROM games WHERE schema_version <> ?`, SchemaVersion)
+	if err != nil {
+		return report, fmt.Errorf("querying games: %w", err)
+	}
+	type migrated struct {
+		id    string
+		state []byte
+	}
+	var updates []migrated
+	for rows.Next() {
+		var id string
+		var version int
+		var state []byte
+		if err := rows.Scan(&id, &version, &state); err != nil {
+			rows.Close()
+			return report, err
+		}
+		report.Outdated[version]++
+		g, err := decodeGameVersion(version, state)
+		if err != nil {
+			rows.Close()
+			return report, fmt.Errorf("game %q: %w", id, err)
+		}
+		if state, err = sqliteState(g); err != nil {
+			rows.Close()
+			return report, err
+		}
+		updates = append(updates, migrated{id, state})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, fmt.Errorf("querying games: %w", err)
+	}
+	if dryRun || len(updates) == 0 {
+		return report, nil
+	}
+
+	for _, u := range updates {
+		_, err := tx.Exec(`UPDATE games SET state = ?, schema_version = ? WHERE id = ?`, u.state, SchemaVersion, u.id)
+		if err != nil {
+			return report, fmt.Errorf("updating game %q: %w", u.id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	report.Migrated = len(updates)
+	return report, nil
+}
+
+// Delete removes a game from persistent storage. If g.CreatedAt is
+// zero, the game is found by its ID alone.
+func (ss *SQLiteStore) Delete(g *Game) error {
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var createdAt string
+	if g.CreatedAt.IsZero() {
+		err := tx.QueryRow(`SELECT created_at FROM games WHERE id = ?`, g.ID).Scan(&createdAt)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	} else {
+		createdAt = g.CreatedAt.UTC().Format(sqliteTime)
+	}
+	if err := deleteSQLiteGame(tx, g.ID, createdAt); err != nil {
+		return err
+	}
+	if err := deleteUnusedWordSets(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteSQLiteGame deletes the game with the given ID and creation
+// time, and its events. A newer game with the same ID is left
+// alone.
+func deleteSQLiteGame(tx *sql.Tx, id, createdAt string) error {
+	_, err := tx.Exec(`DELETE FROM games WHERE id = ? AND created_at = ?`, id, createdAt)
+	if err != nil {
+		return fmt.Errorf("deleting game: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM events WHERE game_id = ? AND created_at = ?`, id, createdAt)
+	if err != nil {
+		return fmt.Errorf("deleting events: %w", err)
+	}
+	return nil
+}
+
+func deleteUnusedWordSets(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM word_sets WHERE hash NOT IN (SELECT word_set FROM games)`)
+	if err != nil {
+		return fmt.Errorf("deleting unused word sets: %w", err)
+	}
+	return nil
+}
+
+// Probe checks that the database accepts a durable write and reads
+// it back.
+func (ss *SQLiteStore) Probe() error {
+	want := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := ss.DB.Exec(`INSERT OR REPLACE INTO health_probe (id, at) VALUES (1, ?)`, want); err != nil {
+		return fmt.Errorf("writing probe: %w", err)
+	}
+	var got string
+	if err := ss.DB.QueryRow(`SELECT at FROM health_probe WHERE id = 1`).Scan(&got); err != nil {
+		return fmt.Errorf("reading probe: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("read back %q, wrote %q", got, want)
+	}
+	return nil
+}
+
+// Close closes the database.
+func (ss *SQLiteStore) Close() error {
+	return ss.DB.Close()
+}
+
+// Checkpoint writes a checkpoint of the entire store: a copy of the
+// database made by Backup, leaving out the prefix of it that the
+// receiver already has.
+func (ss *SQLiteStore) Checkpoint(w io.Writer, have []CheckpointPrefix) error {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := ss.Backup(dir); err != nil {
+		return err
+	}
+	sources, err := dirCheckpointSources(dir)
+	if err != nil {
+		return err
+	}
+	return writeCheckpoint(w, ss.Logger, sources, have)
+}
+
+// Backup writes a copy of the database into dir. The copy is made
+// with VACUUM INTO, which reads a consistent snapshot while other
+// connections keep writing.
+func (ss *SQLiteStore) Backup(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, SQLiteCheckpointName)
+	if _, err := ss.DB.Exec(`VACUUM INTO ?`, name); err != nil {
+		return fmt.Errorf("backing up: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package codenames
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestSQLiteStore(t *testing.T, path string) *SQLiteStore {
+	t.Helper()
+	ss, err := OpenSQLiteStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ss.Close() })
+	return ss
+}
+
+func TestSQLitePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "codenames.db")
+	ss := openTestSQLiteStore(t, path)
+
+	games := randomGames(3)
+	for _, g := range games {
+		if err := ss.Save(g); err != nil {
+			t.Fatal(err)
+		}
+		// Events saved later are appended to those already
+		// saved.
+		if err := g.Guess(0); err != nil {
+			t.Fatal(err)
+		}
+		g.NextTurn(g.Round)
+		if err := ss.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ss.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ss = openTestSQLiteStore(t, path)
+	restored, err := ss.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != len(games) {
+		t.Fatalf("restored %d games, want %d", len(restored), len(games))
+	}
+	for id, g := range games {
+		got := restored[id]
+		if got == nil {
+			t.Fatalf("game %q wasn't restored", id)
+		}
+		if !reflect.DeepEqual(got.GameState, g.GameState) || !reflect.DeepEqual(got.Layout, g.Layout) {
+			t.Errorf("%s: restored game doesn't match", id)
+		}
+		if len(got.Events) != len(g.Events) {
+			t.Fatalf("%s: restored %d events, want %d", id, len(got.Events), len(g.Events))
+		}
+		for i, e := range got.Events {
+			if e.Type != g.Events[i].Type || e.Team != g.Events[i].Team || !e.At.Equal(g.Events[i].At) {
+				t.Errorf("%s: event %d = %+v, want %+v", id, i, e, g.Events[i])
+			}
+		}
+	}
+
+	// The games share a word set, which is stored once and
+	// deleted along with the last game using it.
+	var wordSets int
+	if err := ss.DB.QueryRow(`SELECT count(*) FROM word_sets`).Scan(&wordSets); err != nil {
+		t.Fatal(err)
+	}
+	if wordSets != 1 {
+		t.Errorf("stored %d word sets, want 1", wordSets)
+	}
+	for _, g := range games {
+		if err := ss.Delete(&Game{ID: g.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rows int
+	err = ss.DB.QueryRow(`SELECT (SELECT count(*) FROM word_sets) + (SELECT count(*) FROM events)`).Scan(&rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("%d word sets and events remain after deleting every game", rows)
+	}
+}
+
+func TestSQLiteCheckpoint(t *testing.T) {
+	ss := openTestSQLiteStore(t, filepath.Join(t.TempDir(), "codenames.db"))
+	g := newGame("foo", randomState(words), GameOptions{})
+	g.UpdatedAt = time.Now().Add(-time.Hour)
+	if err := ss.Save(g); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ss.Checkpoint(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	m, err := ReceiveCheckpoint(&buf, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 1 || m.Files[0].Name != SQLiteCheckpointName {
+		t.Fatalf("checkpoint has files %+v", m.Files)
+	}
+
+	path := filepath.Join(dir, SQLiteCheckpointName)
+	got, err := openTestSQLiteStore(t, path).Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Words, g.Words) {
+		t.Errorf("checkpointed game has words %v, want %v", got.Words, g.Words)
+	}
+}
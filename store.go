@@ -1,16 +1,15 @@
 package codenames
 
 import (
-	"compress/gzip"
-	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math"
 	"os"
-	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/pebble"
@@ -18,27 +17,69 @@ import (
 
 // PebbleStore wraps a *pebble.DB with an implementation of the
 // Store interface, persisting games under a []byte(`/games/`)
-// key prefix.
+// key prefix. A secondary index under `/game-ids/` maps each game
+// ID to the key of its most recently saved game. Word sets with an
+// ID are saved once under `/wordsets/<id>` and referenced by the
+// games using them.
+//
+// Saves are group committed: saves queued while a batch is being
+// committed are written together in the next synced batch, and
+// repeated saves of a game within a batch are coalesced.
 type PebbleStore struct {
-	DB *pebble.DB
+	DB     *pebble.DB
+	Logger *Logger
+
+	// Keys, if set, encrypts the games and word sets saved. Values
+	// saved unencrypted or with an older key remain readable until
+	// Rekey rewrites them.
+	Keys *Keyring
+
+	// indexMu serializes writes that read the `/game-ids/` index
+	// or `/wordsets/` with those that modify them.
+	indexMu sync.Mutex
+
+	commitMu   sync.Mutex
+	pending    *groupCommit  // saves waiting for the next commit
+	committing chan struct{} // closed when the current commit is done; nil if there's none
+
+	wordSets WordSets // word sets loaded from the DB
 }
 
-// Restore loads all persisted games from storage.
-func (ps *PebbleStore) Restore() (map[string]*Game, error) {
-	iter := ps.DB.NewIter(&pebble.IterOptions{
+// groupCommit is a set of saves committed in a single synced batch.
+type groupCommit struct {
+	saves map[string]queuedSave // by game ID
+	done  chan struct{}         // closed once the batch is committed
+	err   error                 // set before done is closed
+}
+
+// queuedSave is a game encoded by gameKV, waiting to be committed.
+type queuedSave struct {
+	key, value []byte
+	createdAt  time.Time
+	wordSetID  string
+	wordSet    []string
+}
+
+// gamesIterOptions bounds an iterator to the `/games/` key range.
+func gamesIterOptions() *pebble.IterOptions {
+	return &pebble.IterOptions{
 		LowerBound: []byte("/games/"),
 		UpperBound: []byte(fmt.Sprintf("/games/%019d", math.MaxInt64)),
-	})
+	}
+}
+
+// Restore loads all persisted games from storage.
+func (ps *PebbleStore) Restore() (map[string]*Game, error) {
+	iter := ps.DB.NewIter(gamesIterOptions())
 	defer iter.Close()
 
 	games := make(map[string]*Game)
 	for _ = iter.First(); iter.Valid(); iter.Next() {
-		var g Game
-		err := json.Unmarshal(iter.Value(), &g)
+		g, err := ps.unmarshalGame(iter.Key(), iter.Value())
 		if err != nil {
-			return nil, fmt.Errorf("Unmarshal game: %w", err)
+			return nil, err
 		}
-		games[g.ID] = &g
+		games[g.ID] = g
 	}
 	if err := iter.Error(); err != nil {
 		return nil, fmt.Errorf("restore iter: %w", err)
@@ -46,46 +87,508 @@ func (ps *PebbleStore) Restore() (map[string]*Game, error) {
 	return games, nil
 }
 
-// DeleteExpired deletes all games created before `expiry.`
-func (ps *PebbleStore) DeleteExpired(expiry time.Time) error {
-	return ps.DB.DeleteRange(
-		mkkey(0, ""),
-		mkkey(expiry.Unix(), ""),
-		nil,
-	)
+// DeleteExpired deletes all games that the retention policy has
+// expired as of `now`, and any word sets no longer used by a game.
+// It returns the IDs of the deleted games.
+func (ps *PebbleStore) DeleteExpired(rp RetentionPolicy, now time.Time) ([]string, error) {
+	// The lock is taken before the iterator is created, so that
+	// it sees every word set reference saved before the word sets
+	// are collected.
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+
+	iter := ps.DB.NewIter(gamesIterOptions())
+	defer iter.Close()
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	var expired []string
+	used := make(map[string]bool)
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		// Avoid decoding the entire game, which may include
+		// thousands of words.
+		var g struct {
+			ID          string    `json:"id"`
+			UpdatedAt   time.Time `json:"updated_at"`
+			WinningTeam *Team     `json:"winning_team"`
+			WordSetID   string    `json:"word_set_id"`
+		}
+		// These fields are the same in every schema version.
+		record, err := ps.open(iter.Key(), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		_, body, err := recordVersion(record)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, &g); err != nil {
+			return nil, fmt.Errorf("Unmarshal game: %w", err)
+		}
+		if rp.expired(g.ID, g.UpdatedAt, g.WinningTeam != nil, now) {
+			if err := ps.deleteLocked(b, g.ID, iter.Key()); err != nil {
+				return nil, err
+			}
+			expired = append(expired, g.ID)
+		} else if g.WordSetID != "" {
+			used[g.WordSetID] = true
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("expiry iter: %w", err)
+	}
+	// Saves queued but not yet committed may use word sets that no
+	// committed game does.
+	ps.pendingWordSetsLocked(used)
+	unused, err := ps.deleteUnusedWordSets(b, used)
+	if err != nil {
+		return nil, err
+	}
+	if b.Empty() {
+		return nil, nil
+	}
+	ps.Logger.Info("deleting expired games", "games", len(expired), "word_sets", unused)
+	if err := b.Commit(nil); err != nil {
+		return nil, err
+	}
+	return expired, nil
 }
 
-// Save saves the game to persistent storage.
-func (ps *PebbleStore) Save(g *Game) error {
-	k, v, err := gameKV(g)
+// Get loads the game with the given ID from storage. It returns
+// ErrGameNotFound if there's no such game.
+func (ps *PebbleStore) Get(id string) (*Game, error) {
+	k, err := ps.lookup(id)
 	if err != nil {
-		return fmt.Errorf("trySave: %w", err)
+		return nil, err
+	}
+	v, closer, err := ps.DB.Get(k)
+	if err == pebble.ErrNotFound {
+		// The index entry is orphaned; CheckIndex repairs it.
+		return nil, ErrGameNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("db.Get: %w", err)
+	}
+	defer closer.Close()
+	return ps.unmarshalGame(k, v)
+}
+
+// List returns up to limit persisted games in the order they were
+// created, starting after cursor. The returned cursor is passed to
+// the next call to continue the listing; it's empty once there are
+// no more games.
+func (ps *PebbleStore) List(cursor string, limit int) ([]*Game, string, error) {
+	iter := ps.DB.NewIter(gamesIterOptions())
+	defer iter.Close()
+
+	var games []*Game
+	var valid bool
+	if cursor == "" {
+		valid = iter.First()
+	} else {
+		valid = iter.SeekGE(append([]byte(cursor), 0))
+	}
+	var last []byte
+	for ; valid && len(games) < limit; valid = iter.Next() {
+		g, err := ps.unmarshalGame(iter.Key(), iter.Value())
+		if err != nil {
+			return nil, "", err
+		}
+		games = append(games, g)
+		last = append(last[:0], iter.Key()...)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, "", fmt.Errorf("list iter: %w", err)
+	}
+	if !valid {
+		return games, "", nil
 	}
+	return games, string(last), nil
+}
+
+// Save saves the game to persistent storage, pointing the index at
+// it, and saves its word set if it has an ID and isn't saved yet.
+// It returns once the game is durable.
+func (ps *PebbleStore) Save(g *Game) error {
+	return ps.SaveAsync(g)()
+}
 
-	err = ps.DB.Set(k, v, &pebble.WriteOptions{Sync: true})
+// SaveAsync encodes the game and queues it to be saved, returning
+// a function that waits until it's durable. The game may be
+// modified as soon as SaveAsync returns. A later save of the same
+// game that's queued before this one is committed replaces it.
+func (ps *PebbleStore) SaveAsync(g *Game) (wait func() error) {
+	k, v, err := ps.gameKV(g)
 	if err != nil {
-		return fmt.Errorf("db.Set: %w", err)
+		err = fmt.Errorf("trySave: %w", err)
+		return func() error { return err }
+	}
+
+	ps.commitMu.Lock()
+	if ps.pending == nil {
+		ps.pending = &groupCommit{
+			saves: make(map[string]queuedSave),
+			done:  make(chan struct{}),
+		}
 	}
-	return err
+	gc := ps.pending
+	gc.saves[g.ID] = queuedSave{key: k, value: v, createdAt: g.CreatedAt, wordSetID: g.WordSetID, wordSet: g.WordSet}
+	ps.commitMu.Unlock()
+	return func() error { return ps.waitForCommit(gc) }
 }
 
-// Delete removes a game from persistent storage.
+// waitForCommit waits until gc is committed. If no commit is in
+// progress, the caller commits every queued save, including gc's;
+// otherwise it waits for the current commit, which is either gc or
+// is followed by it.
+func (ps *PebbleStore) waitForCommit(gc *groupCommit) error {
+	for {
+		ps.commitMu.Lock()
+		select {
+		case <-gc.done:
+			ps.commitMu.Unlock()
+			return gc.err
+		default:
+		}
+		committing := ps.committing
+		if committing == nil {
+			committing = make(chan struct{})
+			ps.committing = committing
+			ps.commitMu.Unlock()
+
+			ps.commitPending()
+
+			ps.commitMu.Lock()
+			ps.committing = nil
+			ps.commitMu.Unlock()
+			close(committing)
+			continue
+		}
+		ps.commitMu.Unlock()
+
+		select {
+		case <-gc.done:
+			return gc.err
+		case <-committing:
+		}
+	}
+}
+
+// commitPending commits the queued saves in a single synced batch.
+func (ps *PebbleStore) commitPending() {
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+	ps.commitMu.Lock()
+	gc := ps.pending
+	ps.pending = nil
+	ps.commitMu.Unlock()
+	if gc == nil {
+		return
+	}
+	gc.err = ps.commitLocked(gc.saves)
+	close(gc.done)
+}
+
+// commitLocked writes saves in a single synced batch. ps.indexMu
+// must be held.
+func (ps *PebbleStore) commitLocked(saves map[string]queuedSave) error {
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	for id, qs := range saves {
+		if qs.wordSetID != "" {
+			if err := ps.saveWordSetLocked(b, qs.wordSetID, qs.wordSet); err != nil {
+				return err
+			}
+		}
+		if err := b.Set(qs.key, qs.value, nil); err != nil {
+			return err
+		}
+		if err := b.Set(indexKey(id), qs.key, nil); err != nil {
+			return err
+		}
+	}
+	if b.Empty() {
+		// Every save was dropped by a delete.
+		return nil
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("batch.Commit: %w", err)
+	}
+	return nil
+}
+
+// dropPendingLocked removes a queued save of the game with the
+// given ID and creation time from the next commit, so that it can't
+// recreate the game once it's deleted. If createdAt is zero, a
+// queued save of any game with the ID is removed. ps.indexMu must
+// be held.
+func (ps *PebbleStore) dropPendingLocked(id string, createdAt time.Time) {
+	ps.commitMu.Lock()
+	defer ps.commitMu.Unlock()
+	if ps.pending == nil {
+		return
+	}
+	if qs, ok := ps.pending.saves[id]; ok && (createdAt.IsZero() || qs.createdAt.Equal(createdAt)) {
+		delete(ps.pending.saves, id)
+	}
+}
+
+// pendingWordSetsLocked adds the IDs of the word sets used by
+// queued saves to used. ps.indexMu must be held.
+func (ps *PebbleStore) pendingWordSetsLocked(used map[string]bool) {
+	ps.commitMu.Lock()
+	defer ps.commitMu.Unlock()
+	if ps.pending == nil {
+		return
+	}
+	for _, qs := range ps.pending.saves {
+		if qs.wordSetID != "" {
+			used[qs.wordSetID] = true
+		}
+	}
+}
+
+// Delete removes a game from persistent storage. If g.CreatedAt is
+// zero, the game is found by its ID alone.
 func (ps *PebbleStore) Delete(g *Game) error {
-	k := mkkey(g.CreatedAt.Unix(), g.ID)
-	err := ps.DB.Delete(k, nil)
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+
+	ps.dropPendingLocked(g.ID, g.CreatedAt)
+	var k []byte
+	if g.CreatedAt.IsZero() {
+		var err error
+		k, err = ps.lookup(g.ID)
+		if err == ErrGameNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	} else {
+		k = mkkey(g.CreatedAt.Unix(), g.ID)
+		// Keys only have a resolution of a second, so a game with
+		// the same ID created in the same second, such as the next
+		// game in the room, may have replaced g under k.
+		createdAt, err := ps.createdAt(k)
+		if err == ErrGameNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !createdAt.Equal(g.CreatedAt) {
+			return nil
+		}
+	}
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	if err := ps.deleteLocked(b, g.ID, k); err != nil {
+		return err
+	}
+	err := b.Commit(nil)
 	if err != nil {
-		return fmt.Errorf("db.Delete: %w", err)
+		return fmt.Errorf("batch.Commit: %w", err)
 	}
 	return nil
 }
 
-type CheckpointFile struct {
-	Name string
-	Data []byte
+// createdAt returns the creation time of the game stored under
+// primary key k, or ErrGameNotFound if there's none.
+func (ps *PebbleStore) createdAt(k []byte) (time.Time, error) {
+	v, closer, err := ps.DB.Get(k)
+	if err == pebble.ErrNotFound {
+		return time.Time{}, ErrGameNotFound
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("db.Get: %w", err)
+	}
+	defer closer.Close()
+	record, err := ps.open(k, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, body, err := recordVersion(record)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The creation time is the same in every schema version.
+	var g struct {
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := json.Unmarshal(body, &g); err != nil {
+		return time.Time{}, fmt.Errorf("Unmarshal game: %w", err)
+	}
+	return g.CreatedAt, nil
 }
 
-// Checkpoint returns a serialized represenation of the entire store.
-func (ps *PebbleStore) Checkpoint(w io.Writer) error {
+// Migrate rewrites every game saved at an older schema version at
+// the current version. If dryRun is true, it only reports what it
+// would rewrite.
+func (ps *PebbleStore) Migrate(dryRun bool) (MigrationReport, error) {
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+
+	iter := ps.DB.NewIter(gamesIterOptions())
+	defer iter.Close()
+
+	report := MigrationReport{Outdated: make(map[int]int)}
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		report.Records++
+		record, err := ps.open(iter.Key(), iter.Value())
+		if err != nil {
+			return report, err
+		}
+		v, _, err := recordVersion(record)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", iter.Key(), err)
+		}
+		if v == SchemaVersion {
+			continue
+		}
+		report.Outdated[v]++
+		g, err := ps.unmarshalGame(iter.Key(), iter.Value())
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", iter.Key(), err)
+		}
+		if dryRun {
+			continue
+		}
+		// The game keeps its key, even if mkkey would now
+		// format it differently.
+		_, value, err := ps.gameKV(g)
+		if err != nil {
+			return report, err
+		}
+		if g.WordSetID != "" {
+			if err := ps.saveWordSetLocked(b, g.WordSetID, g.WordSet); err != nil {
+				return report, err
+			}
+		}
+		if err := b.Set(iter.Key(), value, nil); err != nil {
+			return report, err
+		}
+		report.Migrated++
+	}
+	if err := iter.Error(); err != nil {
+		return report, fmt.Errorf("migrate iter: %w", err)
+	}
+	if b.Empty() {
+		return report, nil
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return report, fmt.Errorf("batch.Commit: %w", err)
+	}
+	return report, nil
+}
+
+// RekeyReport describes the values Rekey found and rewrote.
+type RekeyReport struct {
+	Values    int // games and word sets in the store
+	Rewritten int // those that weren't encrypted with the current key
+}
+
+// Rekey re-encrypts every game and word set that isn't encrypted
+// with the first key in ps.Keys, including those saved unencrypted,
+// then compacts the store so that the old values are dropped from
+// its files. Once it's done, the other keys may be retired. If
+// dryRun is true, it only reports what it would rewrite.
+func (ps *PebbleStore) Rekey(dryRun bool) (RekeyReport, error) {
+	var report RekeyReport
+	if ps.Keys == nil {
+		return report, errors.New("no encryption key is configured")
+	}
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	for _, opts := range []*pebble.IterOptions{
+		gamesIterOptions(),
+		{LowerBound: []byte(wordSetsPrefix), UpperBound: prefixEnd([]byte(wordSetsPrefix))},
+	} {
+		if err := ps.rekeyRange(b, opts, dryRun, &report); err != nil {
+			return report, err
+		}
+	}
+	if b.Empty() {
+		return report, nil
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return report, fmt.Errorf("batch.Commit: %w", err)
+	}
+	if err := ps.DB.Compact([]byte{}, []byte{0xFF, 0xFF, 0xFF, 0xFF}, true /* parallel */); err != nil {
+		return report, fmt.Errorf("db.Compact: %w", err)
+	}
+	return report, nil
+}
+
+// rekeyRange adds the values in an iterator's bounds that Rekey
+// rewrites to b.
+func (ps *PebbleStore) rekeyRange(b *pebble.Batch, opts *pebble.IterOptions, dryRun bool, report *RekeyReport) error {
+	iter := ps.DB.NewIter(opts)
+	defer iter.Close()
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		report.Values++
+		if ps.Keys.current(iter.Value()) {
+			continue
+		}
+		v, err := ps.open(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+		report.Rewritten++
+		if dryRun {
+			continue
+		}
+		if err := b.Set(iter.Key(), ps.seal(iter.Key(), v), nil); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("rekey iter: %w", err)
+	}
+	return nil
+}
+
+// probeKey is written and read back by Probe. It sorts outside of
+// the `/games/` key range.
+var probeKey = []byte("/health/probe")
+
+// Probe checks that the database accepts a durable write and reads
+// it back.
+func (ps *PebbleStore) Probe() error {
+	want := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := ps.DB.Set(probeKey, want, &pebble.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("db.Set: %w", err)
+	}
+	got, closer, err := ps.DB.Get(probeKey)
+	if err != nil {
+		return fmt.Errorf("db.Get: %w", err)
+	}
+	defer closer.Close()
+	if string(got) != string(want) {
+		return fmt.Errorf("read back %q, wrote %q", got, want)
+	}
+	return nil
+}
+
+// Backup writes a Pebble checkpoint of the database into dir, which
+// mustn't exist. Its sstables are hard links where possible.
+func (ps *PebbleStore) Backup(dir string) error {
+	return ps.DB.Checkpoint(dir)
+}
+
+// Close flushes the database's memtables to disk and closes it.
+func (ps *PebbleStore) Close() error {
+	if err := ps.DB.Flush(); err != nil {
+		return fmt.Errorf("db.Flush: %w", err)
+	}
+	return ps.DB.Close()
+}
+
+// Checkpoint writes a checkpoint of the entire store, leaving out
+// the file prefixes the receiver already has.
+func (ps *PebbleStore) Checkpoint(w io.Writer, have []CheckpointPrefix) error {
 	// Compact the entire key space. The database tends to be small and there
 	// tends to be a significant number of obsolete keys, so this shouldn't be
 	// too expensive but will reduce the number of bytes we need to send over
@@ -111,38 +614,82 @@ func (ps *PebbleStore) Checkpoint(w io.Writer) error {
 	}
 
 	// Write all the files in the checkpoint out over the network.
-	gzipWriter := gzip.NewWriter(w)
-	enc := gob.NewEncoder(gzipWriter)
-	err = filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
-		}
-		b, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		relPath, err := filepath.Rel(name, path)
-		if err != nil {
-			return err
-		}
-		log.Printf("Checkpoint sending file %s (%d bytes)\n", relPath, len(b))
-		return enc.Encode(CheckpointFile{
-			Name: relPath,
-			Data: b,
-		})
-	})
+	sources, err := dirCheckpointSources(name)
 	if err != nil {
 		return err
 	}
-	return gzipWriter.Close()
+	return writeCheckpoint(w, ps.Logger, sources, have)
+}
+
+// writeMetrics exports a subset of Pebble's metrics.
+func (ps *PebbleStore) writeMetrics(mw metricsWriter) {
+	m := ps.DB.Metrics()
+
+	mw.metric("pebble_disk_space_usage_bytes", "gauge",
+		"Total disk space used by the database.", float64(m.DiskSpaceUsage()))
+	mw.metric("pebble_compactions_total", "counter",
+		"Number of compactions.", float64(m.Compact.Count))
+	mw.metric("pebble_compaction_debt_bytes", "gauge",
+		"Estimated number of bytes that need compacting.", float64(m.Compact.EstimatedDebt))
+	mw.metric("pebble_flushes_total", "counter",
+		"Number of memtable flushes.", float64(m.Flush.Count))
+	mw.metric("pebble_memtable_size_bytes", "gauge",
+		"Bytes allocated by memtables.", float64(m.MemTable.Size))
+	mw.metric("pebble_memtables", "gauge",
+		"Number of memtables.", float64(m.MemTable.Count))
+	mw.metric("pebble_wal_files", "gauge",
+		"Number of live WAL files.", float64(m.WAL.Files))
+	mw.metric("pebble_wal_size_bytes", "gauge",
+		"Size of the live WAL files.", float64(m.WAL.Size))
+	mw.metric("pebble_wal_written_bytes_total", "counter",
+		"Bytes written to the WAL.", float64(m.WAL.BytesWritten))
+	mw.metric("pebble_block_cache_size_bytes", "gauge",
+		"Bytes in use by the block cache.", float64(m.BlockCache.Size))
+	mw.metric("pebble_block_cache_hits_total", "counter",
+		"Number of block cache hits.", float64(m.BlockCache.Hits))
+	mw.metric("pebble_block_cache_misses_total", "counter",
+		"Number of block cache misses.", float64(m.BlockCache.Misses))
+
+	mw.header("pebble_level_files", "gauge", "Number of sstables in each level of the LSM.")
+	for level, lm := range m.Levels {
+		mw.sample("pebble_level_files", float64(lm.NumFiles), "level", strconv.Itoa(level))
+	}
+	mw.header("pebble_level_size_bytes", "gauge", "Size of the sstables in each level of the LSM.")
+	for level, lm := range m.Levels {
+		mw.sample("pebble_level_size_bytes", float64(lm.Size), "level", strconv.Itoa(level))
+	}
 }
 
-func gameKV(g *Game) (key, value []byte, err error) {
-	value, err = json.Marshal(g)
+// gameKV returns a game's primary key and value, encrypted if
+// ps.Keys is set. A word set with an ID is saved separately, so
+// it's left out of the value.
+func (ps *PebbleStore) gameKV(g *Game) (key, value []byte, err error) {
+	if g.WordSetID != "" {
+		withoutWords := *g
+		withoutWords.WordSet = nil
+		g = &withoutWords
+	}
+	value, err = encodeGame(g)
 	if err != nil {
 		return nil, nil, fmt.Errorf("marshaling GameState: %w", err)
 	}
-	return mkkey(g.CreatedAt.Unix(), g.ID), value, nil
+	key = mkkey(g.CreatedAt.Unix(), g.ID)
+	return key, ps.seal(key, value), nil
+}
+
+// seal encrypts a value to be saved under key k, if ps.Keys is set.
+// The value is bound to its key, so it can't be moved to another.
+func (ps *PebbleStore) seal(k, v []byte) []byte {
+	return ps.Keys.seal(v, k)
+}
+
+// open decrypts a value saved under key k by seal.
+func (ps *PebbleStore) open(k, v []byte) ([]byte, error) {
+	v, err := ps.Keys.open(v, k)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", k, err)
+	}
+	return v, nil
 }
 
 func mkkey(unixSecs int64, id string) []byte {
@@ -153,8 +700,106 @@ func mkkey(unixSecs int64, id string) []byte {
 	return []byte(fmt.Sprintf("/games/%019d/%q", unixSecs, id))
 }
 
+// unmarshalGame decodes a game saved by gameKV at any schema
+// version, loading its word set if it was saved separately.
+func (ps *PebbleStore) unmarshalGame(k, v []byte) (*Game, error) {
+	v, err := ps.open(k, v)
+	if err != nil {
+		return nil, err
+	}
+	g, _, err := decodeGame(v)
+	if err != nil {
+		return nil, err
+	}
+	if g.WordSetID != "" && g.WordSet == nil {
+		words, err := ps.loadWordSet(g.WordSetID)
+		if err != nil {
+			return nil, fmt.Errorf("game %q: %w", g.ID, err)
+		}
+		g.WordSet = words
+	}
+	return g, nil
+}
+
+func wordSetKey(id string) []byte {
+	return []byte(wordSetsPrefix + id)
+}
+
+// loadWordSet returns the word set saved under the given ID.
+func (ps *PebbleStore) loadWordSet(idStr string) ([]string, error) {
+	id, err := parseWordSetID(idStr)
+	if err != nil {
+		return nil, err
+	}
+	if words, ok := ps.wordSets.Get(id); ok {
+		return words, nil
+	}
+	k := wordSetKey(idStr)
+	v, closer, err := ps.DB.Get(k)
+	if err == pebble.ErrNotFound {
+		return nil, fmt.Errorf("word set %s is missing", idStr)
+	} else if err != nil {
+		return nil, fmt.Errorf("db.Get: %w", err)
+	}
+	defer closer.Close()
+	if v, err = ps.open(k, v); err != nil {
+		return nil, err
+	}
+	var words []string
+	if err := json.Unmarshal(v, &words); err != nil {
+		return nil, fmt.Errorf("Unmarshal word set %s: %w", idStr, err)
+	}
+	return ps.wordSets.Intern(id, words), nil
+}
+
+// saveWordSetLocked adds the word set with the given ID to b, if it
+// isn't already saved. ps.indexMu must be held until b is
+// committed, so that DeleteExpired doesn't delete the set in the
+// meantime.
+func (ps *PebbleStore) saveWordSetLocked(b *pebble.Batch, id string, words []string) error {
+	k := wordSetKey(id)
+	_, closer, err := ps.DB.Get(k)
+	if err == nil {
+		return closer.Close()
+	} else if err != pebble.ErrNotFound {
+		return fmt.Errorf("db.Get: %w", err)
+	}
+	v, err := json.Marshal(words)
+	if err != nil {
+		return fmt.Errorf("marshaling word set: %w", err)
+	}
+	return b.Set(k, ps.seal(k, v), nil)
+}
+
+// deleteUnusedWordSets adds the deletion of every saved word set
+// not in used to b, returning how many there are. ps.indexMu must
+// be held until b is committed.
+func (ps *PebbleStore) deleteUnusedWordSets(b *pebble.Batch, used map[string]bool) (int, error) {
+	iter := ps.DB.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(wordSetsPrefix),
+		UpperBound: prefixEnd([]byte(wordSetsPrefix)),
+	})
+	defer iter.Close()
+	var unused int
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		if used[string(iter.Key()[len(wordSetsPrefix):])] {
+			continue
+		}
+		if err := b.Delete(iter.Key(), nil); err != nil {
+			return 0, err
+		}
+		unused++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("word sets iter: %w", err)
+	}
+	return unused, nil
+}
+
 type discardStore struct{}
 
-func (ds discardStore) Save(*Game) error           { return nil }
-func (ds discardStore) Delete(*Game) error         { return nil }
-func (ds discardStore) Checkpoint(io.Writer) error { return nil }
+func (ds discardStore) Get(string) (*Game, error)                      { return nil, ErrGameNotFound }
+func (ds discardStore) List(string, int) ([]*Game, string, error)      { return nil, "", nil }
+func (ds discardStore) Save(*Game) error                               { return nil }
+func (ds discardStore) Delete(*Game) error                             { return nil }
+func (ds discardStore) Checkpoint(io.Writer, []CheckpointPrefix) error { return nil }
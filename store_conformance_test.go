@@ -0,0 +1,61 @@
+package codenames_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jbowens/codenames"
+	"github.com/jbowens/codenames/storetest"
+)
+
+// receiveCheckpoint writes the files in a checkpoint into dir.
+func receiveCheckpoint(t *testing.T, checkpoint []byte, dir string) {
+	t.Helper()
+	if _, err := codenames.ReceiveCheckpoint(bytes.NewReader(checkpoint), dir, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, checkpoint []byte) storetest.Store {
+		ms := new(codenames.MemoryStore)
+		if checkpoint != nil {
+			if err := ms.ReadCheckpoint(bytes.NewReader(checkpoint)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ms
+	})
+}
+
+func TestPebbleStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, checkpoint []byte) storetest.Store {
+		dir := t.TempDir()
+		if checkpoint != nil {
+			receiveCheckpoint(t, checkpoint, dir)
+		}
+		db, err := pebble.Open(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return &codenames.PebbleStore{DB: db}
+	})
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, checkpoint []byte) storetest.Store {
+		dir := t.TempDir()
+		if checkpoint != nil {
+			receiveCheckpoint(t, checkpoint, dir)
+		}
+		ss, err := codenames.OpenSQLiteStore(filepath.Join(dir, codenames.SQLiteCheckpointName), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ss.Close() })
+		return ss
+	})
+}
@@ -1,9 +1,15 @@
 package codenames
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"os"
 	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/jbowens/dictionary"
@@ -52,6 +58,10 @@ func TestPersist(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
+	// The probe key mustn't be mistaken for a game.
+	if err := ps.Probe(); err != nil {
+		t.Fatal(err)
+	}
 	if err := ps.DB.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -91,3 +101,344 @@ func TestPersist(t *testing.T) {
 
 	}
 }
+
+func TestDeleteExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-delete-expired-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ps PebbleStore
+	ps.DB, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DB.Close()
+
+	// An old game that's still being played must survive; a game
+	// that hasn't been touched in a long time must not.
+	games := randomGames(2)
+	var active, idle *Game
+	for _, g := range games {
+		if active == nil {
+			active = g
+		} else {
+			idle = g
+		}
+	}
+	active.CreatedAt = time.Now().Add(-72 * time.Hour)
+	idle.UpdatedAt = time.Now().Add(-48 * time.Hour)
+	for _, g := range games {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ps.DeleteExpired(DefaultRetention, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ps.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored[active.ID]; !ok {
+		t.Errorf("active game %q was deleted", active.ID)
+	}
+	if _, ok := restored[idle.ID]; ok {
+		t.Errorf("idle game %q wasn't deleted", idle.ID)
+	}
+}
+
+func openTestStore(t testing.TB) *PebbleStore {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "test-store-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return &PebbleStore{DB: db}
+}
+
+func TestGetAndList(t *testing.T) {
+	ps := openTestStore(t)
+	games := randomGames(5)
+	for _, g := range games {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, g := range games {
+		got, err := ps.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%q): %s", id, err)
+		}
+		if got.ID != id || !reflect.DeepEqual(got.Words, g.Words) {
+			t.Errorf("Get(%q) returned game %q with words %v", id, got.ID, got.Words)
+		}
+	}
+	if _, err := ps.Get("missing"); err != ErrGameNotFound {
+		t.Errorf("Get(missing) returned %v, want ErrGameNotFound", err)
+	}
+
+	listed := map[string]bool{}
+	var cursor string
+	for pages := 0; ; pages++ {
+		if pages > len(games) {
+			t.Fatal("listing didn't terminate")
+		}
+		page, next, err := ps.List(cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 2 {
+			t.Fatalf("got page of %d games, want at most 2", len(page))
+		}
+		for _, g := range page {
+			if listed[g.ID] {
+				t.Errorf("game %q listed twice", g.ID)
+			}
+			listed[g.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(listed) != len(games) {
+		t.Errorf("listed %d games, want %d", len(listed), len(games))
+	}
+}
+
+func TestWordSetsSavedOnce(t *testing.T) {
+	ps := openTestStore(t)
+	id, custom, err := canonicalizeWords(words[:40])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gameID := range []string{"foo", "bar"} {
+		state := randomState(custom)
+		state.WordSetID = id.String()
+		if err := ps.Save(newGame(gameID, state, GameOptions{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countWordSets := func() int {
+		iter := ps.DB.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(wordSetsPrefix),
+			UpperBound: prefixEnd([]byte(wordSetsPrefix)),
+		})
+		defer iter.Close()
+		var n int
+		for _ = iter.First(); iter.Valid(); iter.Next() {
+			n++
+		}
+		return n
+	}
+	if n := countWordSets(); n != 1 {
+		t.Fatalf("saved %d word sets, want 1", n)
+	}
+	k, err := ps.lookup("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, closer, err := ps.DB.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved GameState
+	_, body, err := recordVersion(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(body, &saved); err != nil {
+		t.Fatal(err)
+	}
+	closer.Close()
+	if saved.WordSet != nil || saved.WordSetID != id.String() {
+		t.Errorf("game was saved with word set %v and ID %q", saved.WordSet, saved.WordSetID)
+	}
+
+	// A fresh store loads the set from the DB.
+	fresh := &PebbleStore{DB: ps.DB}
+	g, err := fresh.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g.WordSet, custom) {
+		t.Errorf("loaded word set %v, want %v", g.WordSet, custom)
+	}
+
+	// The set is kept while any game uses it.
+	if err := ps.Delete(&Game{ID: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.DeleteExpired(DefaultRetention, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countWordSets(); n != 1 {
+		t.Fatalf("%d word sets remain while a game uses one", n)
+	}
+	if err := ps.Delete(&Game{ID: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.DeleteExpired(DefaultRetention, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countWordSets(); n != 0 {
+		t.Errorf("%d word sets remain after deleting every game", n)
+	}
+}
+
+func TestDeleteReplacedQueued(t *testing.T) {
+	// Deleting a game mustn't drop a queued save of the game that
+	// replaced it, even though their keys are the same when they're
+	// created in the same second.
+	ps := openTestStore(t)
+	prev := newGame("foo", randomState(testWords), GameOptions{})
+	if err := ps.Save(prev); err != nil {
+		t.Fatal(err)
+	}
+	next := newGame("foo", nextGameState(prev.GameState), GameOptions{})
+	next.CreatedAt = prev.CreatedAt.Add(time.Nanosecond)
+	wait := ps.SaveAsync(next)
+	if err := ps.Delete(prev); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ps.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(next.CreatedAt) {
+		t.Errorf("got the game created at %s, want the one created at %s", got.CreatedAt, next.CreatedAt)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	ps := openTestStore(t)
+
+	// Saves of a game queued before a commit are coalesced.
+	g := newGame("foo", randomState(words), GameOptions{})
+	wait1 := ps.SaveAsync(g)
+	g.NextTurn(g.Round)
+	wait2 := ps.SaveAsync(g)
+	if n := len(ps.pending.saves); n != 1 {
+		t.Errorf("%d saves queued, want 1", n)
+	}
+	if err := wait1(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait2(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ps.Get("foo"); err != nil || got.Round != 1 {
+		t.Fatalf("Get = %v, %v; want round 1", got, err)
+	}
+
+	// A queued save doesn't recreate a game deleted before it's
+	// committed.
+	wait := ps.SaveAsync(g)
+	if err := ps.Delete(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.Get("foo"); err != ErrGameNotFound {
+		t.Fatalf("Get deleted game: %v", err)
+	}
+
+	// Concurrent saves are all durable once acknowledged.
+	games := randomGames(20)
+	var wg sync.WaitGroup
+	for _, g := range games {
+		wg.Add(1)
+		go func(g *Game) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				g.NextTurn(g.Round)
+				if err := ps.Save(g); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	for id := range games {
+		got, err := ps.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Round != 10 {
+			t.Errorf("%s: saved round %d, want 10", id, got.Round)
+		}
+	}
+}
+
+// BenchmarkSave compares committing a synced batch for each save, as
+// Save did before saves were group committed, with group commits,
+// for games saved by concurrent clients.
+func BenchmarkSave(b *testing.B) {
+	b.Run("batch-per-save", func(b *testing.B) {
+		benchmarkSave(b, func(ps *PebbleStore, g *Game) error {
+			k, v, err := ps.gameKV(g)
+			if err != nil {
+				return err
+			}
+			ps.indexMu.Lock()
+			defer ps.indexMu.Unlock()
+			batch := ps.DB.NewBatch()
+			defer batch.Close()
+			if err := ps.saveWordSetLocked(batch, g.WordSetID, g.WordSet); err != nil {
+				return err
+			}
+			if err := batch.Set(k, v, nil); err != nil {
+				return err
+			}
+			if err := batch.Set(indexKey(g.ID), k, nil); err != nil {
+				return err
+			}
+			return batch.Commit(&pebble.WriteOptions{Sync: true})
+		})
+	})
+	b.Run("group-commit", func(b *testing.B) {
+		benchmarkSave(b, (*PebbleStore).Save)
+	})
+}
+
+func benchmarkSave(b *testing.B, save func(*PebbleStore, *Game) error) {
+	ps := openTestStore(b)
+	_, canonical, err := canonicalizeWords(words)
+	if err != nil {
+		b.Fatal(err)
+	}
+	id, _ := identifyWordSet(canonical)
+	var clients int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		state := randomState(canonical)
+		state.WordSetID = id.String()
+		g := newGame(strconv.FormatInt(atomic.AddInt64(&clients, 1), 10), state, GameOptions{})
+		for pb.Next() {
+			g.NextTurn(g.Round)
+			if err := save(ps, g); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,404 @@
+// Package storetest is a conformance suite for implementations of
+// codenames.Store. Run it from an implementation's tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T, checkpoint []byte) storetest.Store {
+//			...
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jbowens/codenames"
+)
+
+// Store is a codenames.Store that the server can also restore games
+// from and expire games in, as it does at startup.
+type Store interface {
+	codenames.Store
+	Restore() (map[string]*codenames.Game, error)
+	DeleteExpired(rp codenames.RetentionPolicy, now time.Time) ([]string, error)
+}
+
+// Factory returns an empty store for a test, closing it with
+// t.Cleanup. If checkpoint isn't nil, the store must instead hold
+// the contents of the checkpoint, which was written by another
+// store from the same factory.
+type Factory func(t *testing.T, checkpoint []byte) Store
+
+// Run checks that the stores returned by newStore have the
+// semantics the server relies on.
+func Run(t *testing.T, newStore Factory) {
+	t.Run("SaveAndGet", func(t *testing.T) { testSaveAndGet(t, newStore(t, nil)) })
+	t.Run("Snapshot", func(t *testing.T) { testSnapshot(t, newStore(t, nil)) })
+	t.Run("Replace", func(t *testing.T) { testReplace(t, newStore(t, nil), time.Hour) })
+	t.Run("ReplaceInSameSecond", func(t *testing.T) { testReplace(t, newStore(t, nil), time.Millisecond) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, newStore(t, nil)) })
+	t.Run("List", func(t *testing.T) { testList(t, newStore(t, nil)) })
+	t.Run("Restore", func(t *testing.T) { testRestore(t, newStore(t, nil)) })
+	t.Run("DeleteExpired", func(t *testing.T) { testDeleteExpired(t, newStore(t, nil)) })
+	t.Run("Checkpoint", func(t *testing.T) { testCheckpoint(t, newStore) })
+}
+
+// epoch is the creation time of the games in the suite. It has a
+// fractional second, which stores must preserve.
+var epoch = time.Date(2021, 3, 14, 15, 9, 26, 535897932, time.UTC)
+
+var wordSet = func() []string {
+	words := make([]string, 30)
+	for i := range words {
+		words[i] = fmt.Sprintf("word%02d", i)
+	}
+	return words
+}()
+
+// newGame returns a game with one guess made.
+func newGame(id string, createdAt time.Time) *codenames.Game {
+	var layout []codenames.Team
+	layout = append(layout, codenames.Red.Repeat(9)...)
+	layout = append(layout, codenames.Blue.Repeat(8)...)
+	layout = append(layout, codenames.Neutral.Repeat(7)...)
+	layout = append(layout, codenames.Black)
+	revealed := make([]bool, 25)
+	revealed[3] = true
+
+	return &codenames.Game{
+		GameState: codenames.GameState{
+			Seed:     int64(len(id)),
+			Revealed: revealed,
+			WordSet:  append([]string(nil), wordSet...),
+		},
+		ID:           id,
+		CreatedAt:    createdAt,
+		UpdatedAt:    createdAt.Add(time.Minute),
+		StartingTeam: codenames.Red,
+		Words:        append([]string(nil), wordSet[:25]...),
+		Layout:       layout,
+		Events: []codenames.Event{
+			{Type: codenames.EventGuess, Team: codenames.Red, Index: 3, At: createdAt.Add(time.Minute)},
+		},
+		GameOptions: codenames.GameOptions{TimerDurationMS: 60000},
+	}
+}
+
+func save(t *testing.T, s Store, games ...*codenames.Game) {
+	t.Helper()
+	for _, g := range games {
+		if err := s.Save(g); err != nil {
+			t.Fatalf("Save(%q): %s", g.ID, err)
+		}
+	}
+}
+
+func get(t *testing.T, s Store, id string) *codenames.Game {
+	t.Helper()
+	g, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get(%q): %s", id, err)
+	}
+	return g
+}
+
+func listAll(t *testing.T, s Store, limit int) []*codenames.Game {
+	t.Helper()
+	var all []*codenames.Game
+	var cursor string
+	for {
+		page, next, err := s.List(cursor, limit)
+		if err != nil {
+			t.Fatalf("List(%q, %d): %s", cursor, limit, err)
+		}
+		if len(page) > limit {
+			t.Fatalf("List(%q, %d) returned %d games", cursor, limit, len(page))
+		}
+		all = append(all, page...)
+		if next == "" {
+			return all
+		}
+		if len(page) == 0 {
+			t.Fatalf("List(%q, %d) returned no games and cursor %q", cursor, limit, next)
+		}
+		cursor = next
+	}
+}
+
+// checkGame fails the test if got differs from want. Times are
+// compared with Equal, since stores needn't preserve their
+// locations.
+func checkGame(t *testing.T, got, want *codenames.Game) {
+	t.Helper()
+	if got.ID != want.ID {
+		t.Fatalf("got game %q, want %q", got.ID, want.ID)
+	}
+	for _, c := range []struct {
+		field     string
+		got, want interface{}
+	}{
+		{"GameState", got.GameState, want.GameState},
+		{"StartingTeam", got.StartingTeam, want.StartingTeam},
+		{"WinningTeam", got.WinningTeam, want.WinningTeam},
+		{"Words", got.Words, want.Words},
+		{"Layout", got.Layout, want.Layout},
+		{"GameOptions", got.GameOptions, want.GameOptions},
+		{"Chat", got.Chat, want.Chat},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: %s = %+v, want %+v", want.ID, c.field, c.got, c.want)
+		}
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(want.UpdatedAt) {
+		t.Errorf("%s: created/updated at %s/%s, want %s/%s", want.ID,
+			got.CreatedAt, got.UpdatedAt, want.CreatedAt, want.UpdatedAt)
+	}
+	if len(got.Events) != len(want.Events) {
+		t.Fatalf("%s: got %d events, want %d", want.ID, len(got.Events), len(want.Events))
+	}
+	for i, e := range got.Events {
+		w := want.Events[i]
+		if e.Type != w.Type || e.Team != w.Team || e.Index != w.Index || !e.At.Equal(w.At) {
+			t.Errorf("%s: event %d = %+v, want %+v", want.ID, i, e, w)
+		}
+	}
+}
+
+func testSaveAndGet(t *testing.T, s Store) {
+	if _, err := s.Get("missing"); !errors.Is(err, codenames.ErrGameNotFound) {
+		t.Errorf("Get(missing) returned %v, want ErrGameNotFound", err)
+	}
+
+	active := newGame("active", epoch)
+	finished := newGame("finished", epoch)
+	winner := codenames.Blue
+	finished.WinningTeam = &winner
+	finished.Chat.Messages = []codenames.Message{{Text: "Blue wins!", Team: codenames.Blue, At: epoch}}
+	save(t, s, active, finished)
+
+	checkGame(t, get(t, s, "active"), active)
+	checkGame(t, get(t, s, "finished"), finished)
+}
+
+func testSnapshot(t *testing.T, s Store) {
+	g := newGame("foo", epoch)
+	save(t, s, g)
+	want := newGame("foo", epoch)
+
+	// Changing the game doesn't change the saved game until it's
+	// saved again.
+	g.Round = 1
+	g.Revealed[0] = true
+	g.Events = append(g.Events, codenames.Event{Type: codenames.EventEndTurn, Team: codenames.Red, At: epoch.Add(2 * time.Minute)})
+	checkGame(t, get(t, s, "foo"), want)
+
+	save(t, s, g)
+	checkGame(t, get(t, s, "foo"), g)
+}
+
+func testReplace(t *testing.T, s Store, after time.Duration) {
+	// The server replaces a room's game by saving the next game
+	// and then deleting the previous one.
+	prev := newGame("foo", epoch)
+	next := newGame("foo", epoch.Add(after))
+	next.Words[0], next.Words[1] = next.Words[1], next.Words[0]
+	save(t, s, prev, next)
+	checkGame(t, get(t, s, "foo"), next)
+	if err := s.Delete(prev); err != nil {
+		t.Fatal(err)
+	}
+	checkGame(t, get(t, s, "foo"), next)
+
+	if games := listAll(t, s, 10); len(games) != 1 {
+		t.Errorf("listed %d games after replacing one, want 1", len(games))
+	}
+	restored, err := s.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored["foo"] == nil {
+		t.Fatalf("restored %d games after replacing one, want foo", len(restored))
+	}
+	checkGame(t, restored["foo"], next)
+}
+
+func testDelete(t *testing.T, s Store) {
+	foo, bar := newGame("foo", epoch), newGame("bar", epoch)
+	save(t, s, foo, bar)
+
+	if err := s.Delete(foo); err != nil {
+		t.Fatal(err)
+	}
+	// A game with only its ID set is deleted by ID.
+	if err := s.Delete(&codenames.Game{ID: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"foo", "bar"} {
+		if _, err := s.Get(id); !errors.Is(err, codenames.ErrGameNotFound) {
+			t.Errorf("Get(%q) after Delete returned %v, want ErrGameNotFound", id, err)
+		}
+	}
+	if games := listAll(t, s, 10); len(games) != 0 {
+		t.Errorf("listed %d games after deleting them all", len(games))
+	}
+
+	// Deleting a missing game isn't an error.
+	if err := s.Delete(foo); err != nil {
+		t.Errorf("deleting a deleted game: %s", err)
+	}
+	if err := s.Delete(&codenames.Game{ID: "missing"}); err != nil {
+		t.Errorf("deleting a missing game: %s", err)
+	}
+}
+
+func testList(t *testing.T, s Store) {
+	if games := listAll(t, s, 3); len(games) != 0 {
+		t.Fatalf("listed %d games in an empty store", len(games))
+	}
+
+	want := map[string]bool{}
+	for i := 0; i < 8; i++ {
+		id := fmt.Sprintf("game-%d", 7-i)
+		save(t, s, newGame(id, epoch.Add(time.Duration(i)*time.Second)))
+		want[id] = true
+	}
+	for _, limit := range []int{1, 3, 8, 100} {
+		games := listAll(t, s, limit)
+		got := map[string]bool{}
+		for i, g := range games {
+			if got[g.ID] {
+				t.Errorf("limit %d: game %q listed twice", limit, g.ID)
+			}
+			got[g.ID] = true
+			if i > 0 && g.CreatedAt.Before(games[i-1].CreatedAt) {
+				t.Errorf("limit %d: game %q listed after a newer game", limit, g.ID)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("limit %d: listed %v, want %v", limit, got, want)
+		}
+	}
+}
+
+func testRestore(t *testing.T, s Store) {
+	games := []*codenames.Game{newGame("foo", epoch), newGame("bar", epoch.Add(time.Second)), newGame("baz", epoch)}
+	save(t, s, games...)
+
+	restored, err := s.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != len(games) {
+		t.Errorf("restored %d games, want %d", len(restored), len(games))
+	}
+	for _, g := range games {
+		got, ok := restored[g.ID]
+		if !ok {
+			t.Errorf("game %q wasn't restored", g.ID)
+			continue
+		}
+		checkGame(t, got, g)
+	}
+}
+
+func testDeleteExpired(t *testing.T, s Store) {
+	now := epoch.Add(1000 * time.Hour)
+	rp := codenames.RetentionPolicy{
+		Idle:     24 * time.Hour,
+		Finished: time.Hour,
+		Rooms: map[string]codenames.RoomRetention{
+			"pinned":    {Pinned: true},
+			"ephemeral": {TTL: time.Minute},
+		},
+	}
+	updated := map[string]time.Duration{
+		"active":    time.Hour,
+		"idle":      48 * time.Hour,
+		"finished":  2 * time.Hour,
+		"pinned":    500 * time.Hour,
+		"ephemeral": 2 * time.Minute,
+	}
+	for id, ago := range updated {
+		g := newGame(id, epoch)
+		g.UpdatedAt = now.Add(-ago)
+		if id == "finished" {
+			winner := codenames.Red
+			g.WinningTeam = &winner
+		}
+		save(t, s, g)
+	}
+
+	deleted, err := s.DeleteExpired(rp, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(deleted)
+	if got := strings.Join(deleted, " "); got != "ephemeral finished idle" {
+		t.Errorf("DeleteExpired deleted %q, want %q", got, "ephemeral finished idle")
+	}
+	for id := range updated {
+		_, err := s.Get(id)
+		switch id {
+		case "active", "pinned":
+			if err != nil {
+				t.Errorf("Get(%q): %s; the game shouldn't have expired", id, err)
+			}
+		default:
+			if !errors.Is(err, codenames.ErrGameNotFound) {
+				t.Errorf("Get(%q) returned %v; the game should have expired", id, err)
+			}
+		}
+	}
+	restored, err := s.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 {
+		t.Errorf("restored %d games after expiry, want 2", len(restored))
+	}
+}
+
+func testCheckpoint(t *testing.T, newStore Factory) {
+	s := newStore(t, nil)
+	games := []*codenames.Game{newGame("foo", epoch), newGame("bar", epoch)}
+	save(t, s, games...)
+
+	var buf bytes.Buffer
+	if err := s.Checkpoint(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	files, err := codenames.ReadCheckpointFiles(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decoding checkpoint: %s", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("checkpoint has no files")
+	}
+
+	// The store is still usable, and changes made after the
+	// checkpoint aren't in it.
+	save(t, s, newGame("later", epoch))
+	checkGame(t, get(t, s, "foo"), games[0])
+
+	restored, err := newStore(t, buf.Bytes()).Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != len(games) {
+		t.Errorf("restored %d games from the checkpoint, want %d", len(restored), len(games))
+	}
+	for _, g := range games {
+		got, ok := restored[g.ID]
+		if !ok {
+			t.Errorf("game %q isn't in the checkpoint", g.ID)
+			continue
+		}
+		checkGame(t, got, g)
+	}
+}
@@ -0,0 +1,174 @@
+package codenames
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often the certificate files are checked
+// for changes.
+const certPollInterval = time.Minute
+
+// certReloader provides the server's TLS certificate, reloading it
+// from disk when asked to or when the files change. Because the
+// certificate is looked up on every handshake, reloading it doesn't
+// affect established connections.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the most recent modification time of the
+// certificate and key files.
+func (cr *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// changed returns true if the files have been modified since the
+// certificate was last loaded.
+func (cr *certReloader) changed() bool {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return false
+	}
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return !modTime.Equal(cr.modTime)
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// watch reloads the certificate whenever its files change, until
+// stop is closed.
+func (cr *certReloader) watch(log *Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if !cr.changed() {
+			continue
+		}
+		// The files may be mid-update; if so, the next poll will
+		// try again.
+		if err := cr.reload(); err != nil {
+			log.Warn("unable to reload changed TLS certificate", "err", err)
+			continue
+		}
+		log.Info("reloaded changed TLS certificate")
+	}
+}
+
+// ReloadCertificate reloads the server's TLS certificate and key
+// from disk. Connections established with the old certificate are
+// unaffected.
+func (s *Server) ReloadCertificate() error {
+	s.shutdownMu.Lock()
+	cr := s.certs
+	s.shutdownMu.Unlock()
+	if cr == nil {
+		return fmt.Errorf("TLS isn't enabled")
+	}
+	return cr.reload()
+}
+
+func (s *Server) listenAndServeTLS() error {
+	cr, err := newCertReloader(s.TLSCertFile, s.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	if s.Server.TLSConfig == nil {
+		s.Server.TLSConfig = &tls.Config{}
+	}
+	s.Server.TLSConfig.GetCertificate = cr.getCertificate
+	s.Server.TLSConfig.MinVersion = tls.VersionTLS12
+	go cr.watch(s.Logger, s.shuttingDown())
+
+	s.shutdownMu.Lock()
+	s.certs = cr
+	if s.RedirectAddr != "" {
+		s.redirect = &http.Server{
+			Addr:     s.RedirectAddr,
+			Handler:  redirectHandler(s.Server.Addr),
+			ErrorLog: s.Server.ErrorLog,
+		}
+		go func(srv *http.Server) {
+			err := srv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				s.Logger.Error("HTTPS redirect server exited", "err", err)
+			}
+		}(s.redirect)
+	}
+	s.shutdownMu.Unlock()
+
+	// ServeTLS configures HTTP/2 automatically.
+	return s.Server.ListenAndServeTLS("", "")
+}
+
+// redirectHandler redirects every request to the same URL over
+// HTTPS, on the port of the server listening at tlsAddr.
+func redirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(rw, req, u.String(), http.StatusMovedPermanently)
+	})
+}
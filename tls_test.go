@@ -0,0 +1,133 @@
+package codenames
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for commonName and
+// its key to the given files.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codenames-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	commonName := func(cr *certReloader) string {
+		cert, err := cr.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	writeTestCert(t, certFile, keyFile, "old")
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(cr); got != "old" {
+		t.Errorf("got certificate for %q, want %q", got, "old")
+	}
+	if cr.changed() {
+		t.Error("changed() = true before the files were modified")
+	}
+
+	writeTestCert(t, certFile, keyFile, "new")
+	future := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cr.changed() {
+		t.Error("changed() = false after the files were modified")
+	}
+	if err := cr.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(cr); got != "new" {
+		t.Errorf("got certificate for %q, want %q", got, "new")
+	}
+
+	// A broken certificate is reported, and the old one kept.
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.reload(); err == nil {
+		t.Error("reload succeeded with an invalid certificate")
+	}
+	if got := commonName(cr); got != "new" {
+		t.Errorf("got certificate for %q, want %q", got, "new")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	testCases := []struct {
+		tlsAddr string
+		url     string
+		want    string
+	}{
+		{":443", "http://example.com/foo?bar=1", "https://example.com/foo?bar=1"},
+		{":443", "http://example.com:80/", "https://example.com/"},
+		{":8443", "http://example.com:8080/foo", "https://example.com:8443/foo"},
+	}
+	for _, tc := range testCases {
+		rw := httptest.NewRecorder()
+		redirectHandler(tc.tlsAddr).ServeHTTP(rw, httptest.NewRequest("GET", tc.url, nil))
+		if rw.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: got status %d, want %d", tc.url, rw.Code, http.StatusMovedPermanently)
+		}
+		if got := rw.Header().Get("Location"); got != tc.want {
+			t.Errorf("%s: redirected to %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
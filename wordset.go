@@ -2,6 +2,7 @@ package codenames
 
 import (
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -10,12 +11,31 @@ import (
 	"sync"
 )
 
+// maxInternedWordSets bounds the number of word sets a WordSets
+// holds. Interning only saves memory, so forgetting a set that's
+// still in use costs nothing but a second copy of it.
+const maxInternedWordSets = 1000
+
+// wordSetID identifies a canonicalized word set by its hash.
 type wordSetID [sha1.Size]byte
 
 func (i wordSetID) String() string {
 	return fmt.Sprintf("%x", i[:])
 }
 
+// parseWordSetID parses a word set ID formatted by String.
+func parseWordSetID(s string) (wordSetID, error) {
+	var id wordSetID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("invalid word set ID %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// WordSets interns canonicalized word sets by ID, so that games
+// using the same set share one copy of it.
 type WordSets struct {
 	mu   sync.Mutex
 	byID map[wordSetID][]string
@@ -27,11 +47,47 @@ func (ws *WordSets) init() {
 	}
 }
 
+// Canonicalize uppercases, deduplicates and sorts words, returning
+// the resulting set's ID and its interned copy.
 func (ws *WordSets) Canonicalize(words []string) (wordSetID, []string, error) {
+	id, words, err := canonicalizeWords(words)
+	if err != nil {
+		return wordSetID{}, nil, err
+	}
+	return id, ws.Intern(id, words), nil
+}
+
+// Intern returns the interned copy of the word set with the given
+// ID, interning words as that copy if there isn't one yet.
+func (ws *WordSets) Intern(id wordSetID, words []string) []string {
 	ws.mu.Lock()
 	defer ws.mu.Unlock()
 	ws.init()
 
+	if interned, ok := ws.byID[id]; ok {
+		return interned
+	}
+	if len(ws.byID) >= maxInternedWordSets {
+		for evicted := range ws.byID {
+			delete(ws.byID, evicted)
+			break
+		}
+	}
+	ws.byID[id] = words
+	return words
+}
+
+// Get returns the interned word set with the given ID, if any.
+func (ws *WordSets) Get(id wordSetID) ([]string, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	words, ok := ws.byID[id]
+	return words, ok
+}
+
+// canonicalizeWords returns the canonical form of a word set and
+// its ID, leaving words unmodified.
+func canonicalizeWords(words []string) (wordSetID, []string, error) {
 	set := map[string]bool{}
 	for _, w := range words {
 		set[strings.TrimSpace(strings.ToUpper(w))] = true
@@ -40,25 +96,38 @@ func (ws *WordSets) Canonicalize(words []string) (wordSetID, []string, error) {
 		return wordSetID{}, nil, errors.New("need at least 25 words")
 	}
 
-	words = words[:0]
+	canonical := make([]string, 0, len(set))
 	for w := range set {
-		words = append(words, w)
+		canonical = append(canonical, w)
 	}
-	sort.Strings(words)
+	sort.Strings(canonical)
 
 	// Calculate the word set ID, a hash of the canonicalized word set.
 	h := sha1.New()
-	for _, w := range words {
+	for _, w := range canonical {
 		io.WriteString(h, w)
 		h.Write([]byte{0x00})
 	}
-	idBytes := h.Sum(nil)
 	var id wordSetID
-	copy(id[:], idBytes)
+	copy(id[:], h.Sum(nil))
+	return id, canonical, nil
+}
 
-	if interned, ok := ws.byID[id]; ok {
-		return id, interned, nil
+// identifyWordSet returns the ID of words if they're already in
+// canonical form, as the word sets of games created before games
+// recorded their word set's ID always are.
+func identifyWordSet(words []string) (wordSetID, bool) {
+	if len(words) == 0 {
+		return wordSetID{}, false
 	}
-	ws.byID[id] = words
-	return id, words, nil
+	id, canonical, err := canonicalizeWords(words)
+	if err != nil || len(canonical) != len(words) {
+		return wordSetID{}, false
+	}
+	for i, w := range canonical {
+		if words[i] != w {
+			return wordSetID{}, false
+		}
+	}
+	return id, true
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"reflect"
 	"testing"
 )
 
@@ -41,3 +42,25 @@ func TestWordSetCanonicalize(t *testing.T) {
 		}
 	}
 }
+
+func TestIdentifyWordSet(t *testing.T) {
+	words := append([]string{"zebra", " apple "}, testWords...)
+	input := append([]string{}, words...)
+	id, canonical, err := canonicalizeWords(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(input, words) {
+		t.Error("canonicalizeWords modified its input")
+	}
+	if _, ok := identifyWordSet(words); ok {
+		t.Error("identified a word set that isn't canonical")
+	}
+	got, ok := identifyWordSet(canonical)
+	if !ok || got != id {
+		t.Errorf("identifyWordSet(canonical) = %s, %t; want %s", got, ok, id)
+	}
+	if parsed, err := parseWordSetID(id.String()); err != nil || parsed != id {
+		t.Errorf("parseWordSetID(%s) = %s, %v", id, parsed, err)
+	}
+}